@@ -1,53 +1,32 @@
 package build
 
 import (
-	"bufio"
+	"fabric-ops/cmd/registry"
 	"fmt"
-	"github.com/go-git/go-git/v5"
 	"log"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"regexp"
-	"runtime"
 	"strings"
 )
 
-/**
-Go inbuilt filepath lib doesn't support ** globbing https://github.com/golang/go/issues/11862
-So, implemented using walk. If we need to glob on other files later, then will include other Go libs for this
-*/
-func GlobFiles(rootDir string, pattern regexp.Regexp) []string {
-	fileList := []string{}
-	filepath.Walk(rootDir, func(path string, f os.FileInfo, err error) error {
-		if pattern.MatchString(path) {
-			fileList = append(fileList, path)
+// DockerBuildVersion returns image version of repo rendered from tag format (DEFAULT_TAG_FORMAT if empty), see GitVersion for fields of template.
+// Images are tagged `latest` only if allowed, as `latest` hides which commit is deployed
+func DockerBuildVersion(repoDir string, format string, allowLatest bool) string {
+	if format == "" {
+		format = DEFAULT_TAG_FORMAT
+	}
+	version, err := DescribeRepo(repoDir)
+	if err != nil {
+		if !allowLatest {
+			log.Fatalln(repoDir, " is not a Git repo (", err, "), so Docker images would be tagged as `latest`. Use --allow-latest to allow it")
 		}
-		return nil
-	})
-	return fileList
-}
-
-func DockerBuildVersion(repoDir string) string {
-	//git describe --long --always --dirty --match='v*.*'
-	// git describe is not implemented in go-git library, hence using format <branch name>-<short commit hash>
-	tag := "latest"
-	repo, err := git.PlainOpen(repoDir)
-	if err != nil || repo == nil {
 		log.Println("[WARN] "+repoDir+" is not a Git repo. Docker images will be tagged as `latest`", err)
-		return tag
+		return "latest"
 	}
-	ref, err := repo.Head()
+	tag, err := FormatVersion(format, version)
 	if err != nil {
-		log.Println(err)
+		log.Fatalln(err)
 	}
-	branch := ref.Name().Short()
-	hash := ref.Hash().String()[0:7]
-
-	if branch == "" || hash == "" {
-		log.Println("[WARN] "+repoDir+" is not a Git repo. Docker images will be tagged as `latest`", err)
-	} else {
-		tag = strings.Join([]string{hash, branch}, "-")
+	if tag == "latest" && !allowLatest {
+		log.Fatalln("Image tag format ", format, " renders `latest`. Use --allow-latest to allow it")
 	}
 	return tag
 }
@@ -58,70 +37,67 @@ docker tag ${IMAGE}:${DOCKER_IMAGE_TAG} ${DOCKER_IMAGE}
 cortex docker login
 docker push ${DOCKER_IMAGE}
 */
-// Later this will be replaced with daemonless & rootless build
-func BuildActionImage(namespace string, name string, version string, dockerfile string, buildContext string, dockerRegistry string) string {
-	var dockerImage = fmt.Sprint( name, ":", version)
-	if len(namespace) > 0 {
-		dockerImage = fmt.Sprint(namespace, "/", dockerImage)
-	}
-	var dockerTag = fmt.Sprint(dockerRegistry, "/", dockerImage)
-	var dockerBuildCmd = strings.Join([]string{"docker build -t", dockerImage, "-f", dockerfile, buildContext}, " ")
-	log.Println("Building: ", dockerBuildCmd)
-	NativeExitOnError(dockerBuildCmd)
+// Image is built using selected Builder (docker by default, or daemonless & rootless podman, buildah or kaniko). Returns image tag and digest of pushed image.
+// Build args, target, labels and platforms are from fabric-build.yaml of Dockerfile. Build output is logged by logger, which prefixes output of concurrent builds
+func BuildActionImage(namespace string, name string, version string, dockerfile string, buildContext string, dockerRegistry string, config BuildConfig, logger *log.Logger) (string, string, error) {
+	var dockerImage = dockerImageName(namespace, name, version)
+	var dockerTag = DockerImageTag(namespace, name, version, dockerRegistry)
+	spec := BuildSpec{Dockerfile: dockerfile, Context: buildContext, Image: dockerImage, BuildArgs: config.BuildArgs, Target: config.Target,
+		Labels: config.Labels, Platforms: config.Platforms, Logger: logger}
 	if len(dockerRegistry) > 1 {
-		var dockerTagCmd = strings.Join([]string{"docker tag", dockerImage, dockerTag}, " ")
-		NativeExitOnError(dockerTagCmd)
-		log.Println("Pushing docker image tag: ", dockerTag)
-		NativeExitOnError(fmt.Sprint("docker push ", dockerTag))
+		spec.Tag = dockerTag
 	} else {
-		log.Println("Docker registry not provided skipping docker push")
+		logger.Println("Docker registry not provided skipping docker push")
 	}
-
-
-	return dockerTag
+	logger.Println("Building: ", dockerImage, " from ", dockerfile, " using ", builder.Name())
+	digest, err := builder.Build(spec)
+	if err != nil {
+		return dockerTag, "", err
+	}
+	if digest != "" {
+		logger.Println("Pushed ", dockerTag, " with digest ", digest)
+	}
+	return dockerTag, digest, nil
 }
 
-func DockerLogin(dockerRegistry string, dockerUser string, dockerPassword string) {
-	NativeExitOnError(strings.Join([]string{"docker login", "-u", dockerUser, "--password", dockerPassword, dockerRegistry}, " "))
+// ContextHashVersion returns image version from hash of build context, so image of unchanged action has same tag across commits
+func ContextHashVersion(dockerfile string, buildContext string) (string, error) {
+	hash, err := ContextHash(buildContext, dockerfile)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash build context %s of %s: %w", buildContext, dockerfile, err)
+	}
+	return "ctx-" + hash[:12], nil
 }
 
-/**
-This method executes shell commands and returns command output logs, but os.Exit if program returns exit code > 0. So caller doesn't have to handle error.
-We need to create other method to return error and don't exit for scenario where we shouldn't exit app on a command failure
-*/
-func NativeExitOnError(cmd string) {
-	hostOs := runtime.GOOS
-	var shell *exec.Cmd
-	switch hostOs {
-	case "windows":
-		shell = exec.Command("cmd", "/C", cmd)
-	default:
-		shell = exec.Command("/bin/sh", "-c", cmd)
+// ExistingImageDigest returns digest of image tag in registry, empty if it doesn't exist. `latest` is mutable, so it is always built.
+// Failure to query registry isn't fatal, image is built as before
+func ExistingImageDigest(dockerTag string, logger *log.Logger) string {
+	if strings.HasSuffix(dockerTag, ":latest") {
+		return ""
+	}
+	digest, err := registry.ImageDigest(dockerTag)
+	if err != nil {
+		logger.Println("[WARN] Failed to check if ", dockerTag, " exists in registry, building it. ", err)
+		return ""
 	}
+	return digest
+}
 
-	// stream output of command
-	stdout, _ := shell.StdoutPipe()
-	shell.Stderr = shell.Stdout
-	err := shell.Start()
+// DockerImageTag returns image tag in registry as <registry>/<namespace>/<name>:<version>
+func DockerImageTag(namespace string, name string, version string, dockerRegistry string) string {
+	return fmt.Sprint(dockerRegistry, "/", dockerImageName(namespace, name, version))
+}
 
-	scanner := bufio.NewScanner(stdout)
-	scanner.Split(bufio.ScanLines)
-	for scanner.Scan() {
-		m := scanner.Text()
-		log.Print(m)
+func dockerImageName(namespace string, name string, version string) string {
+	var dockerImage = fmt.Sprint(name, ":", version)
+	if len(namespace) > 0 {
+		dockerImage = fmt.Sprint(namespace, "/", dockerImage)
 	}
-	err = shell.Wait()
+	return dockerImage
+}
 
-	if err != nil {
-		log.Println("Failed to execute: ", cmd)
-		if exitError, ok := err.(*exec.ExitError); ok {
-			exitCode := exitError.ExitCode()
-			if exitCode > 0 {
-				log.Fatalln(" Exit Code [", exitCode, "] failed with error ", err)
-				os.Exit(exitCode)
-			}
-		} else {
-			log.Fatalln(err)
-		}
+func DockerLogin(dockerRegistry string, dockerUser string, dockerPassword string) {
+	if err := builder.Login(dockerRegistry, dockerUser, dockerPassword); err != nil {
+		log.Fatalln(err)
 	}
 }
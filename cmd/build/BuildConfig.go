@@ -0,0 +1,72 @@
+package build
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// BUILD_CONFIG_FILE is optional build configuration in directory of Dockerfile
+const BUILD_CONFIG_FILE = "fabric-build.yaml"
+
+// BuildConfig is build configuration of a Dockerfile, for repos not following convention of image name as directory name of Dockerfile
+type BuildConfig struct {
+	Image     string            `yaml:"image,omitempty"`   // image name, defaults to directory name of Dockerfile. Actions using image of this name are substituted
+	Context   string            `yaml:"context,omitempty"` // relative to directory of Dockerfile, or DOCKERFILE_CURRENT_DIR, DOCKERFILE_PARENT_DIR or REPO_ROOT as DOCKER_BUILD_CONTEXT
+	BuildArgs map[string]string `yaml:"buildArgs,omitempty"`
+	Target    string            `yaml:"target,omitempty"` // stage of multi-stage Dockerfile
+	Labels    map[string]string `yaml:"labels,omitempty"`
+	Platforms []string          `yaml:"platforms,omitempty"` // like linux/amd64, multiple platforms are built as manifest list by podman and buildah
+	Skip      bool              `yaml:"skip,omitempty"`
+}
+
+// LoadBuildConfig reads fabric-build.yaml in directory of Dockerfile. Missing file is empty config
+func LoadBuildConfig(dockerfile string) (BuildConfig, error) {
+	var config BuildConfig
+	path := filepath.Join(filepath.Dir(dockerfile), BUILD_CONFIG_FILE)
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return config, err
+	}
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return config, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// ImageName returns image name from config, or directory name of Dockerfile
+func (c BuildConfig) ImageName(dockerfile string) string {
+	if c.Image != "" {
+		return c.Image
+	}
+	return filepath.Base(filepath.Dir(dockerfile))
+}
+
+// buildFlags returns CLI flags of build args, target and labels for podman, buildah and kaniko. Flags are sorted for reproducible commands
+func buildFlags(spec BuildSpec) []string {
+	var flags []string
+	for _, key := range sortedKeys(spec.BuildArgs) {
+		flags = append(flags, "--build-arg", key+"="+spec.BuildArgs[key])
+	}
+	if spec.Target != "" {
+		flags = append(flags, "--target", spec.Target)
+	}
+	for _, key := range sortedKeys(spec.Labels) {
+		flags = append(flags, "--label", key+"="+spec.Labels[key])
+	}
+	return flags
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
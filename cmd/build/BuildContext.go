@@ -0,0 +1,270 @@
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const DOCKER_IGNORE_FILE = ".dockerignore"
+
+// ignorePattern is a line of .dockerignore, `!` prefixed patterns are exceptions
+type ignorePattern struct {
+	regex     *regexp.Regexp
+	exclusion bool
+}
+
+// globRegex converts glob to regex matching complete slash separated path. `**` matches any number of directories, `*` and `?` don't match `/`
+func globRegex(pattern string) (*regexp.Regexp, error) {
+	var regex strings.Builder
+	regex.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**/") {
+				regex.WriteString("(.*/)?")
+				i += 2
+			} else if strings.HasPrefix(pattern[i:], "**") {
+				regex.WriteString(".*")
+				i++
+			} else {
+				regex.WriteString("[^/]*")
+			}
+		case '?':
+			regex.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				regex.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			regex.WriteString("[" + class + "]")
+			i += end
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			regex.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			regex.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	regex.WriteString("$")
+	return regexp.Compile(regex.String())
+}
+
+// readDockerIgnore reads .dockerignore of build context. Missing file has no patterns
+func readDockerIgnore(contextDir string) ([]ignorePattern, error) {
+	return readIgnoreFile(filepath.Join(contextDir, DOCKER_IGNORE_FILE))
+}
+
+// readIgnoreFile reads patterns of ignore file in .dockerignore format. Missing file has no patterns
+func readIgnoreFile(path string) ([]ignorePattern, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var patterns []ignorePattern
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern, err := parseIgnorePattern(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s in %s: %w", line, path, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, scanner.Err()
+}
+
+// parseIgnorePattern parses pattern relative to root directory, `!` prefix makes it an exception
+func parseIgnorePattern(line string) (ignorePattern, error) {
+	pattern := ignorePattern{}
+	if strings.HasPrefix(line, "!") {
+		pattern.exclusion = true
+		line = strings.TrimSpace(line[1:])
+	}
+	line = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(line)), "/")
+	var err error
+	pattern.regex, err = globRegex(line)
+	return pattern, err
+}
+
+// isIgnored checks whether path (relative to context, slash separated) is ignored. Pattern matching a directory ignores files in it, and last matching pattern wins
+func isIgnored(patterns []ignorePattern, relPath string) bool {
+	ignored := false
+	for _, pattern := range patterns {
+		matched := false
+		for path := relPath; path != "." && path != ""; path = parentPath(path) {
+			if pattern.regex.MatchString(path) {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			ignored = !pattern.exclusion
+		}
+	}
+	return ignored
+}
+
+func parentPath(path string) string {
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+func hasExclusions(patterns []ignorePattern) bool {
+	for _, pattern := range patterns {
+		if pattern.exclusion {
+			return true
+		}
+	}
+	return false
+}
+
+// contextDockerfile returns name of Dockerfile in build context tar. Dockerfile outside of build context is added to tar with a generated name
+func contextDockerfile(contextDir string, dockerfile string) (name string, external bool, err error) {
+	absContext, err := filepath.Abs(contextDir)
+	if err != nil {
+		return "", false, err
+	}
+	absDockerfile, err := filepath.Abs(dockerfile)
+	if err != nil {
+		return "", false, err
+	}
+	rel, err := filepath.Rel(absContext, absDockerfile)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ".fabric-dockerfile-" + filepath.Base(dockerfile), true, nil
+	}
+	return filepath.ToSlash(rel), false, nil
+}
+
+// walkBuildContext visits files of build context directory with their names in build context, excluding files ignored in .dockerignore.
+// Dockerfile and .dockerignore are always included, Dockerfile outside of build context is visited last
+func walkBuildContext(contextDir string, dockerfile string, visit func(path string, name string, info os.FileInfo) error) error {
+	dockerfileName, external, err := contextDockerfile(contextDir, dockerfile)
+	if err != nil {
+		return err
+	}
+	patterns, err := readDockerIgnore(contextDir)
+	if err != nil {
+		return err
+	}
+	exclusions := hasExclusions(patterns)
+	err = filepath.Walk(contextDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(contextDir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != dockerfileName && rel != DOCKER_IGNORE_FILE && isIgnored(patterns, rel) {
+			// files in ignored directory may be re-included by exception, so directory is skipped only if there are no exceptions
+			if info.IsDir() && !exclusions {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return visit(path, rel, info)
+	})
+	if err != nil || !external {
+		return err
+	}
+	info, err := os.Stat(dockerfile)
+	if err != nil {
+		return err
+	}
+	return visit(dockerfile, dockerfileName, info)
+}
+
+// writeBuildContext writes build context as tar stream
+func writeBuildContext(writer io.Writer, contextDir string, dockerfile string) error {
+	archive := tar.NewWriter(writer)
+	err := walkBuildContext(contextDir, dockerfile, func(path string, name string, info os.FileInfo) error {
+		return addToTar(archive, path, name, info)
+	})
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// ContextHash returns sha256 of build context (names, modes and content of files, and Dockerfile). It doesn't depend on file modification time, so it's same for same content in any checkout
+func ContextHash(contextDir string, dockerfile string) (string, error) {
+	hash := sha256.New()
+	err := walkBuildContext(contextDir, dockerfile, func(path string, name string, info os.FileInfo) error {
+		fmt.Fprintf(hash, "%s\x00%o\x00%d\x00", name, info.Mode(), info.Size())
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(path)
+			fmt.Fprint(hash, link)
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(hash, file)
+		return err
+	})
+	return hex.EncodeToString(hash.Sum(nil)), err
+}
+
+// addToTar adds file, directory or symlink to tar. Other file types (like sockets) are skipped. Owner is root as in `docker build`
+func addToTar(archive *tar.Writer, path string, name string, info os.FileInfo) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	} else if !info.Mode().IsRegular() && !info.IsDir() {
+		return nil
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(archive, file)
+	return err
+}
@@ -0,0 +1,297 @@
+package build
+
+import (
+	"bufio"
+	"errors"
+	"fabric-ops/cmd/registry"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	BUILDER_DOCKER  = "docker"
+	BUILDER_PODMAN  = "podman"
+	BUILDER_BUILDAH = "buildah"
+	BUILDER_KANIKO  = "kaniko"
+)
+
+// BuildSpec is image to be built from Dockerfile
+type BuildSpec struct {
+	Dockerfile string
+	Context    string // build context directory
+	Image      string // local image name <namespace>/<name>:<version>
+	Tag        string // image in registry to push, empty if not pushed
+	BuildArgs  map[string]string
+	Target     string // stage of multi-stage Dockerfile
+	Labels     map[string]string
+	Platforms  []string
+	Logger     *log.Logger // logs build output, defaults to standard logger
+}
+
+// cliBuildArgs returns arguments of podman build and buildah bud. Image of multiple platforms is built as manifest list
+func cliBuildArgs(subcommand string, spec BuildSpec) []string {
+	args := append([]string{subcommand, "-f", spec.Dockerfile}, buildFlags(spec)...)
+	if len(spec.Platforms) > 0 {
+		args = append(args, "--platform", strings.Join(spec.Platforms, ","))
+	}
+	if len(spec.Platforms) > 1 {
+		args = append(args, "--manifest", spec.Image)
+	} else {
+		args = append(args, "-t", spec.Image)
+	}
+	return append(args, spec.Context)
+}
+
+func (s BuildSpec) logger() *log.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return log.Default()
+}
+
+// Builder builds and pushes container images. Docker needs a daemon (used over Docker Engine API), podman and buildah are daemonless and rootless, and kaniko runs in a container without privileges
+type Builder interface {
+	Name() string
+	Build(spec BuildSpec) (string, error) // returns digest of pushed image, empty if not pushed
+	Login(registry string, user string, password string) error
+}
+
+var builder Builder = dockerBuilder{}
+
+// SetBuilder selects builder by name: docker (default), podman, buildah or kaniko
+func SetBuilder(name string) error {
+	switch name {
+	case "", BUILDER_DOCKER:
+		builder = dockerBuilder{}
+	case BUILDER_PODMAN:
+		builder = cliBuilder{command: BUILDER_PODMAN}
+	case BUILDER_BUILDAH:
+		builder = buildahBuilder{}
+	case BUILDER_KANIKO:
+		builder = kanikoBuilder{}
+	default:
+		return errors.New(fmt.Sprint("Unknown image builder ", name, ". Supported builders are docker, podman, buildah and kaniko"))
+	}
+	return nil
+}
+
+// cliBuilder is for podman, having same CLI as docker
+type cliBuilder struct {
+	command string
+}
+
+func (b cliBuilder) Name() string {
+	return b.command
+}
+
+func (b cliBuilder) Build(spec BuildSpec) (string, error) {
+	logger := spec.logger()
+	if len(spec.Platforms) > 1 {
+		// images are added to existing manifest list, so manifest list of previous build is removed
+		exec.Command(b.command, "manifest", "rm", spec.Image).Run()
+	}
+	if err := runCommand(logger, b.command, cliBuildArgs("build", spec)...); err != nil {
+		return "", err
+	}
+	if spec.Tag == "" {
+		return "", nil
+	}
+	if len(spec.Platforms) > 1 {
+		logger.Println("Pushing docker image tag: ", spec.Tag, " for platforms ", spec.Platforms)
+		return withDigestFile(func(digestFile string) error {
+			return withAuthConfig(spec.Tag, true, func(configDir string) error {
+				return runCommand(logger, b.command, append(authFileArgs(configDir, "manifest", "push"), "--all", "--digestfile", digestFile, spec.Image, "docker://"+spec.Tag)...)
+			})
+		})
+	}
+	if err := runCommand(logger, b.command, "tag", spec.Image, spec.Tag); err != nil {
+		return "", err
+	}
+	logger.Println("Pushing docker image tag: ", spec.Tag)
+	return withDigestFile(func(digestFile string) error {
+		return withAuthConfig(spec.Tag, true, func(configDir string) error {
+			return runCommand(logger, b.command, append(authFileArgs(configDir, "push"), "--digestfile", digestFile, spec.Tag)...)
+		})
+	})
+}
+
+func (b cliBuilder) Login(registry string, user string, password string) error {
+	// password is passed on stdin, so it isn't in process list
+	return runCommandInput(log.Default(), strings.NewReader(password), b.command, "login", "-u", user, "--password-stdin", registry)
+}
+
+// buildahBuilder builds using `buildah bud`, which doesn't need a daemon
+type buildahBuilder struct{}
+
+func (buildahBuilder) Name() string {
+	return BUILDER_BUILDAH
+}
+
+func (buildahBuilder) Build(spec BuildSpec) (string, error) {
+	logger := spec.logger()
+	if len(spec.Platforms) > 1 {
+		// images are added to existing manifest list, so manifest list of previous build is removed
+		exec.Command(BUILDER_BUILDAH, "manifest", "rm", spec.Image).Run()
+	}
+	if err := runCommand(logger, BUILDER_BUILDAH, cliBuildArgs("bud", spec)...); err != nil {
+		return "", err
+	}
+	if spec.Tag == "" {
+		return "", nil
+	}
+	if len(spec.Platforms) > 1 {
+		logger.Println("Pushing docker image tag: ", spec.Tag, " for platforms ", spec.Platforms)
+		return withDigestFile(func(digestFile string) error {
+			return withAuthConfig(spec.Tag, true, func(configDir string) error {
+				return runCommand(logger, BUILDER_BUILDAH, append(authFileArgs(configDir, "manifest", "push"), "--all", "--digestfile", digestFile, spec.Image, "docker://"+spec.Tag)...)
+			})
+		})
+	}
+	logger.Println("Pushing docker image tag: ", spec.Tag)
+	return withDigestFile(func(digestFile string) error {
+		return withAuthConfig(spec.Tag, true, func(configDir string) error {
+			return runCommand(logger, BUILDER_BUILDAH, append(authFileArgs(configDir, "push"), "--digestfile", digestFile, spec.Image, "docker://"+spec.Tag)...)
+		})
+	})
+}
+
+func (buildahBuilder) Login(registry string, user string, password string) error {
+	// password is passed on stdin, so it isn't in process list
+	return runCommandInput(log.Default(), strings.NewReader(password), BUILDER_BUILDAH, "login", "-u", user, "--password-stdin", registry)
+}
+
+// kanikoBuilder runs kaniko executor, which builds and pushes in a single step. Executor path defaults to /kaniko/executor, set KANIKO_EXECUTOR to change it.
+// Kaniko reads registry credentials from $DOCKER_CONFIG/config.json (/kaniko/.docker/config.json in kaniko image), default credentials of registry are passed in a temp docker config
+type kanikoBuilder struct{}
+
+func (kanikoBuilder) Name() string {
+	return BUILDER_KANIKO
+}
+
+func (kanikoBuilder) Build(spec BuildSpec) (string, error) {
+	context, err := filepath.Abs(spec.Context)
+	if err != nil {
+		return "", err
+	}
+	args := append([]string{"--dockerfile=" + spec.Dockerfile, "--context=dir://" + context}, buildFlags(spec)...)
+	switch len(spec.Platforms) {
+	case 0:
+	case 1:
+		args = append(args, "--custom-platform="+spec.Platforms[0])
+	default:
+		return "", errors.New("kaniko builds image of single platform, use podman or buildah to build image of multiple platforms")
+	}
+	executor := os.Getenv("KANIKO_EXECUTOR")
+	if executor == "" {
+		executor = "/kaniko/executor"
+	}
+	if spec.Tag == "" {
+		return "", runCommand(spec.logger(), executor, append(args, "--no-push", "--destination="+spec.Image)...)
+	}
+	return withDigestFile(func(digestFile string) error {
+		return withAuthConfig(spec.Tag, false, func(configDir string) error {
+			command := exec.Command(executor, append(args, "--destination="+spec.Tag, "--digest-file="+digestFile)...)
+			if configDir != "" {
+				command.Env = append(os.Environ(), "DOCKER_CONFIG="+configDir)
+			}
+			return runExec(spec.logger(), command)
+		})
+	})
+}
+
+// Login saves credentials in docker config, which kaniko reads
+func (kanikoBuilder) Login(registry string, user string, password string) error {
+	return saveLogin(registry, user, password)
+}
+
+// saveLogin validates credentials with registry API and saves them in docker config (or its credential helper)
+func saveLogin(registryURL string, user string, password string) error {
+	credentials := registry.Credentials{Username: user, Password: password}
+	if err := registry.Login(registryURL, credentials); err != nil {
+		return err
+	}
+	return registry.SaveCredentials(registryURL, credentials)
+}
+
+// withAuthConfig runs push of image with directory of temp copy of docker config having default credentials of image registry, like Cortex token for DCI registry.
+// With containersAuth (podman and buildah), containers auth file is merged into the copy. Directory is empty if registry doesn't have default credentials
+// or user has its credentials, then builder reads config of user
+func withAuthConfig(image string, containersAuth bool, push func(configDir string) error) error {
+	dir, err := ioutil.TempDir("", "fabric-auth-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	written, err := registry.WriteAuthConfig(filepath.Join(dir, "config.json"), registry.Host(image), containersAuth)
+	if err != nil {
+		return err
+	}
+	if !written {
+		dir = ""
+	}
+	return push(dir)
+}
+
+// authFileArgs adds --authfile of docker config directory, if any, to podman or buildah subcommand
+func authFileArgs(configDir string, args ...string) []string {
+	if configDir != "" {
+		args = append(args, "--authfile", filepath.Join(configDir, "config.json"))
+	}
+	return args
+}
+
+// withDigestFile runs push writing digest of pushed image to a temp file, and returns the digest
+func withDigestFile(push func(digestFile string) error) (string, error) {
+	file, err := ioutil.TempFile("", "fabric-digest-")
+	if err != nil {
+		return "", err
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	if err := push(file.Name()); err != nil {
+		return "", err
+	}
+	digest, err := ioutil.ReadFile(file.Name())
+	return strings.TrimSpace(string(digest)), err
+}
+
+// runCommand executes program streaming its output to logger, so output of concurrent builds can be told apart
+func runCommand(logger *log.Logger, name string, args ...string) error {
+	return runCommandInput(logger, nil, name, args...)
+}
+
+// runCommandInput executes program reading stdin from input, like secrets which must not be passed as arguments
+func runCommandInput(logger *log.Logger, input io.Reader, name string, args ...string) error {
+	command := exec.Command(name, args...)
+	command.Stdin = input
+	return runExec(logger, command)
+}
+
+// runExec executes command streaming its output to logger
+func runExec(logger *log.Logger, command *exec.Cmd) error {
+	name := command.Args[0]
+	args := command.Args[1:]
+	stdout, err := command.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	command.Stderr = command.Stdout
+	if err := command.Start(); err != nil {
+		return fmt.Errorf("failed to execute %s: %w", name, err)
+	}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Split(bufio.ScanLines)
+	for scanner.Scan() {
+		logger.Print(scanner.Text())
+	}
+	if err := command.Wait(); err != nil {
+		return fmt.Errorf("failed to execute %s %s: %w", name, strings.Join(args, " "), err)
+	}
+	return nil
+}
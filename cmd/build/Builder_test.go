@@ -0,0 +1,43 @@
+package build
+
+import (
+	"encoding/base64"
+	"fabric-ops/cmd/registry"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKanikoBuilderPassesDefaultCredentials(t *testing.T) {
+	userConfig := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", userConfig)
+	registry.SetDefaultCredentials("dci.example.com", registry.Credentials{Username: "cli", Password: "cortex-token"})
+	// executor logs docker config it reads and writes digest
+	executor := filepath.Join(t.TempDir(), "executor")
+	script := "#!/bin/sh\ncat \"$DOCKER_CONFIG/config.json\"\necho\nfor arg; do case $arg in --digest-file=*) echo sha256:feed > \"${arg#--digest-file=}\";; esac; done\n"
+	if err := os.WriteFile(executor, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KANIKO_EXECUTOR", executor)
+	context := t.TempDir()
+	writeFiles(t, context, map[string]string{"Dockerfile": "FROM alpine\n"})
+
+	var output strings.Builder
+	spec := BuildSpec{Dockerfile: filepath.Join(context, "Dockerfile"), Context: context, Image: "team/app:v1", Tag: "dci.example.com/team/app:v1", Logger: log.New(&output, "", 0)}
+	digest, err := kanikoBuilder{}.Build(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != "sha256:feed" {
+		t.Errorf("digest = %q, want sha256:feed", digest)
+	}
+	if auth := base64.StdEncoding.EncodeToString([]byte("cli:cortex-token")); !strings.Contains(output.String(), auth) {
+		t.Errorf("kaniko read docker config %q, want default credentials of dci.example.com", output.String())
+	}
+	if files, _ := ioutil.ReadDir(userConfig); len(files) > 0 {
+		t.Errorf("default credentials saved in docker config of user")
+	}
+}
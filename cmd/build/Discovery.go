@@ -0,0 +1,102 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// FABRIC_IGNORE_FILE in repo root excludes paths from Dockerfile discovery, in .dockerignore format
+	FABRIC_IGNORE_FILE = ".fabricignore"
+	// DEFAULT_DOCKERFILE_INCLUDE matches files named Dockerfile in any directory of repo
+	DEFAULT_DOCKERFILE_INCLUDE = "**/Dockerfile"
+	// DEFAULT_DOCKERFILE_EXCLUDE excludes dependencies, which may have Dockerfiles of their own
+	DEFAULT_DOCKERFILE_EXCLUDE = "**/node_modules,**/vendor"
+)
+
+// directories never searched for Dockerfiles: git metadata, work directory of deployments and fabric config
+var skippedDirs = map[string]bool{".git": true, "_tmp": true, ".fabric": true}
+
+// SplitPatterns splits comma separated glob patterns, returning defaults if there are none
+func SplitPatterns(patterns string, defaults string) []string {
+	if strings.TrimSpace(patterns) == "" {
+		patterns = defaults
+	}
+	var list []string
+	for _, pattern := range strings.Split(patterns, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			list = append(list, pattern)
+		}
+	}
+	return list
+}
+
+// FindDockerfiles returns Dockerfiles in repo matching any of include globs, except paths matching exclude globs or patterns of .fabricignore in repo.
+// Globs are relative to repo, `**` matches any number of directories. Exclude globs are in .dockerignore format, so `!` prefixed globs are exceptions.
+// Directories .git, _tmp and .fabric are never searched
+func FindDockerfiles(repoDir string, include []string, exclude []string) ([]string, error) {
+	var includes []*regexp.Regexp
+	for _, pattern := range include {
+		regex, err := globRegex(strings.TrimPrefix(filepath.ToSlash(filepath.Clean(pattern)), "/"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid Dockerfile include pattern %s: %w", pattern, err)
+		}
+		includes = append(includes, regex)
+	}
+	var excludes []ignorePattern
+	for _, line := range exclude {
+		pattern, err := parseIgnorePattern(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Dockerfile exclude pattern %s: %w", line, err)
+		}
+		excludes = append(excludes, pattern)
+	}
+	// .fabricignore is applied after exclude globs, so it can make exceptions to them
+	ignored, err := readIgnoreFile(filepath.Join(repoDir, FABRIC_IGNORE_FILE))
+	if err != nil {
+		return nil, err
+	}
+	excludes = append(excludes, ignored...)
+	exclusions := hasExclusions(excludes)
+
+	dockerfiles := []string{}
+	err = filepath.Walk(repoDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(repoDir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			// files in excluded directory may be re-included by exception, so directory is skipped only if there are no exceptions
+			if skippedDirs[info.Name()] || (!exclusions && isIgnored(excludes, rel)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !matchesAny(includes, rel) || isIgnored(excludes, rel) {
+			return nil
+		}
+		// directories named like Dockerfile (and broken links) are not Dockerfiles
+		if stat, err := os.Stat(path); err != nil || !stat.Mode().IsRegular() {
+			return nil
+		}
+		dockerfiles = append(dockerfiles, path)
+		return nil
+	})
+	return dockerfiles, err
+}
+
+func matchesAny(regexes []*regexp.Regexp, path string) bool {
+	for _, regex := range regexes {
+		if regex.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,308 @@
+package build
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fabric-ops/cmd/registry"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	DEFAULT_DOCKER_HOST = "unix:///var/run/docker.sock"
+	// Docker Engine API version, supported by Docker 20.10 onwards
+	DOCKER_API_VERSION = "v1.41"
+)
+
+// dockerBuilder builds, tags and pushes images using Docker Engine API, so it doesn't need a shell or docker CLI
+type dockerBuilder struct{}
+
+func (dockerBuilder) Name() string {
+	return BUILDER_DOCKER
+}
+
+func (dockerBuilder) Build(spec BuildSpec) (string, error) {
+	engine, err := newDockerEngine(spec.logger())
+	if err != nil {
+		return "", err
+	}
+	if err := engine.build(spec); err != nil {
+		return "", err
+	}
+	if spec.Tag == "" {
+		return "", nil
+	}
+	if err := engine.tag(spec.Image, spec.Tag); err != nil {
+		return "", err
+	}
+	engine.logger.Println("Pushing docker image tag: ", spec.Tag)
+	return engine.push(spec.Tag)
+}
+
+// Login validates credentials with registry and saves them in docker config, as `docker login` does, so docker daemon isn't needed for login
+func (dockerBuilder) Login(registryURL string, user string, password string) error {
+	return saveLogin(registryURL, user, password)
+}
+
+// dockerEngine is client of Docker Engine API at DOCKER_HOST (unix:// or tcp://, with TLS if DOCKER_TLS_VERIFY or DOCKER_CERT_PATH is set), or /var/run/docker.sock
+type dockerEngine struct {
+	client  *http.Client
+	baseURL string
+	logger  *log.Logger
+}
+
+func newDockerEngine(logger *log.Logger) (*dockerEngine, error) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = DEFAULT_DOCKER_HOST
+	}
+	hostURL, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DOCKER_HOST %s: %w", host, err)
+	}
+	transport := &http.Transport{}
+	switch hostURL.Scheme {
+	case "unix":
+		socket := hostURL.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		}
+		return &dockerEngine{client: &http.Client{Transport: transport}, baseURL: "http://docker/" + DOCKER_API_VERSION, logger: logger}, nil
+	case "tcp", "http", "https":
+		scheme := "http"
+		if os.Getenv("DOCKER_TLS_VERIFY") != "" || os.Getenv("DOCKER_CERT_PATH") != "" || hostURL.Scheme == "https" {
+			scheme = "https"
+			if transport.TLSClientConfig, err = dockerTLSConfig(); err != nil {
+				return nil, err
+			}
+		}
+		return &dockerEngine{client: &http.Client{Transport: transport}, baseURL: scheme + "://" + hostURL.Host + "/" + DOCKER_API_VERSION, logger: logger}, nil
+	default:
+		return nil, errors.New(fmt.Sprint("Unsupported DOCKER_HOST ", host, ". Docker Engine is supported over unix:// or tcp://"))
+	}
+}
+
+// dockerTLSConfig loads ca.pem, cert.pem and key.pem from DOCKER_CERT_PATH (defaults to ~/.docker). Server certificate is verified only if DOCKER_TLS_VERIFY is set
+func dockerTLSConfig() (*tls.Config, error) {
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if certPath == "" {
+		home, _ := os.UserHomeDir()
+		certPath = filepath.Join(home, ".docker")
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: os.Getenv("DOCKER_TLS_VERIFY") == ""}
+	if ca, err := ioutil.ReadFile(filepath.Join(certPath, "ca.pem")); err == nil {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM(ca)
+	}
+	certFile, keyFile := filepath.Join(certPath, "cert.pem"), filepath.Join(certPath, "key.pem")
+	if _, err := os.Stat(certFile); err == nil {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load docker client certificate from %s: %w", certPath, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// jsonMessage is a message of progress stream of build and push
+type jsonMessage struct {
+	Stream      string `json:"stream"`
+	Status      string `json:"status"`
+	ID          string `json:"id"`
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	Aux json.RawMessage `json:"aux"`
+}
+
+func (e *dockerEngine) post(path string, query url.Values, contentType string, body io.Reader, auth string) (*http.Response, error) {
+	request, err := http.NewRequest(http.MethodPost, e.baseURL+path+"?"+query.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	if auth != "" {
+		request.Header.Set("X-Registry-Auth", auth)
+	}
+	response, err := e.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Docker Engine: %w", err)
+	}
+	if response.StatusCode >= 300 {
+		defer response.Body.Close()
+		content, _ := ioutil.ReadAll(response.Body)
+		message := strings.TrimSpace(string(content))
+		var engineError struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(content, &engineError) == nil && engineError.Message != "" {
+			message = engineError.Message
+		}
+		return nil, errors.New(fmt.Sprint("Docker Engine API ", path, " failed with status ", response.StatusCode, ": ", message))
+	}
+	return response, nil
+}
+
+// readMessages reads progress stream, calling handle for each message. Error message of stream is returned as error
+func readMessages(body io.Reader, handle func(message jsonMessage)) error {
+	decoder := json.NewDecoder(body)
+	for {
+		var message jsonMessage
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read Docker Engine progress: %w", err)
+		}
+		if message.Error != "" || message.ErrorDetail.Message != "" {
+			if message.ErrorDetail.Message != "" {
+				return errors.New(message.ErrorDetail.Message)
+			}
+			return errors.New(message.Error)
+		}
+		handle(message)
+	}
+}
+
+// build streams build context as tar to Docker Engine and logs build output
+func (e *dockerEngine) build(spec BuildSpec) error {
+	dockerfileName, _, err := contextDockerfile(spec.Context, spec.Dockerfile)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"t": {spec.Image}, "dockerfile": {dockerfileName}, "rm": {"1"}, "forcerm": {"1"}}
+	if len(spec.BuildArgs) > 0 {
+		buildArgs, _ := json.Marshal(spec.BuildArgs)
+		query.Set("buildargs", string(buildArgs))
+	}
+	if len(spec.Labels) > 0 {
+		labels, _ := json.Marshal(spec.Labels)
+		query.Set("labels", string(labels))
+	}
+	if spec.Target != "" {
+		query.Set("target", spec.Target)
+	}
+	switch len(spec.Platforms) {
+	case 0:
+	case 1:
+		query.Set("platform", spec.Platforms[0])
+	default:
+		return errors.New("docker builder builds image of single platform, use podman or buildah to build image of multiple platforms")
+	}
+	reader, writer := io.Pipe()
+	defer reader.Close()
+	go func() {
+		writer.CloseWithError(writeBuildContext(writer, spec.Context, spec.Dockerfile))
+	}()
+	response, err := e.post("/build", query, "application/x-tar", reader, "")
+	if err != nil {
+		return fmt.Errorf("failed to build %s: %w", spec.Image, err)
+	}
+	defer response.Body.Close()
+	err = readMessages(response.Body, func(message jsonMessage) {
+		for _, line := range strings.Split(strings.TrimRight(message.Stream, "\n"), "\n") {
+			if strings.TrimSpace(line) != "" {
+				e.logger.Print(line)
+			}
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to build %s: %w", spec.Image, err)
+	}
+	return nil
+}
+
+// tag tags image as target image (with registry)
+func (e *dockerEngine) tag(image string, target string) error {
+	repository, tag := splitImageTag(target)
+	response, err := e.post("/images/"+image+"/tag", url.Values{"repo": {repository}, "tag": {tag}}, "", nil, "")
+	if err != nil {
+		return fmt.Errorf("failed to tag %s as %s: %w", image, target, err)
+	}
+	response.Body.Close()
+	return nil
+}
+
+// push pushes image to registry using credentials in docker config, and returns digest of pushed image
+func (e *dockerEngine) push(image string) (string, error) {
+	auth, err := registryAuth(image)
+	if err != nil {
+		return "", err
+	}
+	repository, tag := splitImageTag(image)
+	response, err := e.post("/images/"+repository+"/push", url.Values{"tag": {tag}}, "", nil, auth)
+	if err != nil {
+		return "", fmt.Errorf("failed to push %s: %w", image, err)
+	}
+	defer response.Body.Close()
+	digest := ""
+	err = readMessages(response.Body, e.progressLogger(func(message jsonMessage) {
+		var aux struct {
+			Digest string `json:"Digest"`
+		}
+		if len(message.Aux) > 0 && json.Unmarshal(message.Aux, &aux) == nil && aux.Digest != "" {
+			digest = aux.Digest
+		}
+	}))
+	if err != nil {
+		return "", fmt.Errorf("failed to push %s: %w", image, err)
+	}
+	return digest, nil
+}
+
+// progressLogger logs status of push when it changes for a layer (like Pushing -> Pushed), skipping progress bars
+func (e *dockerEngine) progressLogger(handle func(message jsonMessage)) func(message jsonMessage) {
+	statuses := map[string]string{}
+	return func(message jsonMessage) {
+		if message.Status != "" && statuses[message.ID] != message.Status {
+			statuses[message.ID] = message.Status
+			e.logger.Println(strings.TrimSpace(message.ID + " " + message.Status))
+		}
+		if handle != nil {
+			handle(message)
+		}
+	}
+}
+
+// registryAuth returns X-Registry-Auth header with credentials of image registry in docker config (or its credential helper), or default credentials of registry
+func registryAuth(image string) (string, error) {
+	host := registry.Host(image)
+	credentials, err := registry.LookupCredentials(host)
+	if err != nil {
+		return "", err
+	}
+	if host == registry.DOCKER_HUB {
+		host = registry.DOCKER_HUB_CONFIG
+	}
+	auth, err := json.Marshal(struct {
+		registry.Credentials
+		ServerAddress string `json:"serveraddress"`
+	}{credentials, host})
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(auth), nil
+}
+
+// splitImageTag splits image into repository and tag, tag defaults to latest
+func splitImageTag(image string) (string, string) {
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:]
+	}
+	return image, "latest"
+}
@@ -0,0 +1,325 @@
+package build
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"encoding/json"
+	"fabric-ops/cmd/registry"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeEngine is a Docker Engine stand-in on a unix socket, recording requests and replying with progress streams like Docker does
+type fakeEngine struct {
+	mutex        sync.Mutex
+	buildQuery   map[string]string
+	buildEntries map[string]string // name to content of files in build context tar
+	buildStream  string
+	tagged       []string
+	pushed       []string
+	registryAuth string
+	pushStream   string
+}
+
+func newFakeEngine(t *testing.T) *fakeEngine {
+	dir, err := os.MkdirTemp("", "engine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := &fakeEngine{
+		buildStream: `{"stream":"Step 1/2 : FROM alpine\n"}` + "\n" + `{"stream":"Successfully built 1234\n"}`,
+		pushStream: `{"status":"The push refers to repository [registry.example.com/team/app]"}` + "\n" +
+			`{"status":"Pushing","id":"abc","progressDetail":{"current":1,"total":2}}` + "\n" +
+			`{"status":"Pushed","id":"abc"}` + "\n" +
+			`{"status":"v1: digest: sha256:feed size: 528"}` + "\n" +
+			`{"progressDetail":{},"aux":{"Tag":"v1","Digest":"sha256:feed","Size":528}}`,
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(engine.serve))
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	t.Setenv("DOCKER_HOST", "unix://"+socket)
+	return engine
+}
+
+func (e *fakeEngine) serve(w http.ResponseWriter, r *http.Request) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/"+DOCKER_API_VERSION)
+	switch {
+	case r.Method == http.MethodPost && path == "/build":
+		if r.Header.Get("Content-Type") != "application/x-tar" {
+			http.Error(w, `{"message":"build context must be tar"}`, http.StatusBadRequest)
+			return
+		}
+		e.buildQuery = map[string]string{}
+		for key := range r.URL.Query() {
+			e.buildQuery[key] = r.URL.Query().Get(key)
+		}
+		e.buildEntries = map[string]string{}
+		archive := tar.NewReader(r.Body)
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				http.Error(w, `{"message":"invalid tar"}`, http.StatusBadRequest)
+				return
+			}
+			content, _ := ioutil.ReadAll(archive)
+			e.buildEntries[header.Name] = string(content)
+		}
+		w.Write([]byte(e.buildStream))
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/images/") && strings.HasSuffix(path, "/tag"):
+		image := strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/tag")
+		e.tagged = append(e.tagged, image+" "+r.URL.Query().Get("repo")+":"+r.URL.Query().Get("tag"))
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/images/") && strings.HasSuffix(path, "/push"):
+		repository := strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/push")
+		e.pushed = append(e.pushed, repository+":"+r.URL.Query().Get("tag"))
+		e.registryAuth = r.Header.Get("X-Registry-Auth")
+		w.Write([]byte(e.pushStream))
+	default:
+		http.Error(w, `{"message":"page not found"}`, http.StatusNotFound)
+	}
+}
+
+// writeFiles writes files (by slash separated path) in directory
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDockerBuilderStreamsBuildContext(t *testing.T) {
+	engine := newFakeEngine(t)
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	context := t.TempDir()
+	writeFiles(t, context, map[string]string{
+		"docker/Dockerfile":   "FROM alpine\nCOPY . /app\n",
+		".dockerignore":       "*.log\nsecrets/\n",
+		"main.py":             "print('hello')",
+		"lib/util.py":         "pass",
+		"debug.log":           "ignored",
+		"secrets/credentials": "ignored",
+	})
+	var output strings.Builder
+	spec := BuildSpec{
+		Dockerfile: filepath.Join(context, "docker", "Dockerfile"),
+		Context:    context,
+		Image:      "team/app:v1",
+		BuildArgs:  map[string]string{"VERSION": "v1"},
+		Target:     "runtime",
+		Platforms:  []string{"linux/amd64"},
+		Logger:     log.New(&output, "", 0),
+	}
+	digest, err := dockerBuilder{}.Build(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != "" {
+		t.Errorf("digest of image not pushed = %q, want empty", digest)
+	}
+
+	var names []string
+	for name := range engine.buildEntries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if want := []string{".dockerignore", "docker/", "docker/Dockerfile", "lib/", "lib/util.py", "main.py"}; strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("build context = %v, want %v", names, want)
+	}
+	if engine.buildEntries["main.py"] != "print('hello')" {
+		t.Errorf("main.py in build context = %q", engine.buildEntries["main.py"])
+	}
+	wantQuery := map[string]string{"t": "team/app:v1", "dockerfile": "docker/Dockerfile", "buildargs": `{"VERSION":"v1"}`, "target": "runtime", "platform": "linux/amd64"}
+	for key, want := range wantQuery {
+		if engine.buildQuery[key] != want {
+			t.Errorf("build query %s = %q, want %q", key, engine.buildQuery[key], want)
+		}
+	}
+	if !strings.Contains(output.String(), "Successfully built 1234") {
+		t.Errorf("build output not logged: %q", output.String())
+	}
+	if len(engine.tagged) > 0 || len(engine.pushed) > 0 {
+		t.Errorf("image without tag was tagged %v or pushed %v", engine.tagged, engine.pushed)
+	}
+}
+
+func TestDockerBuilderAddsDockerfileOutsideContext(t *testing.T) {
+	engine := newFakeEngine(t)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"Dockerfile": "FROM alpine\n", "src/main.py": "pass"})
+	spec := BuildSpec{Dockerfile: filepath.Join(dir, "Dockerfile"), Context: filepath.Join(dir, "src"), Image: "team/app:v1", Logger: log.New(ioutil.Discard, "", 0)}
+	if _, err := (dockerBuilder{}).Build(spec); err != nil {
+		t.Fatal(err)
+	}
+	name := engine.buildQuery["dockerfile"]
+	if engine.buildEntries[name] != "FROM alpine\n" || engine.buildEntries["main.py"] != "pass" {
+		t.Errorf("build context %v doesn't have Dockerfile %s", engine.buildEntries, name)
+	}
+}
+
+func TestDockerBuilderPushesWithRegistryAuth(t *testing.T) {
+	engine := newFakeEngine(t)
+	configDir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", configDir)
+	auth := base64.StdEncoding.EncodeToString([]byte("builder:s3cret"))
+	writeFiles(t, configDir, map[string]string{"config.json": `{"auths":{"https://registry.example.com":{"auth":"` + auth + `"}}}`})
+	context := t.TempDir()
+	writeFiles(t, context, map[string]string{"Dockerfile": "FROM alpine\n"})
+
+	var output strings.Builder
+	spec := BuildSpec{
+		Dockerfile: filepath.Join(context, "Dockerfile"),
+		Context:    context,
+		Image:      "team/app:v1",
+		Tag:        "registry.example.com/team/app:v1",
+		Logger:     log.New(&output, "", 0),
+	}
+	digest, err := dockerBuilder{}.Build(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != "sha256:feed" {
+		t.Errorf("digest = %q, want digest of aux message", digest)
+	}
+	if want := []string{"team/app:v1 registry.example.com/team/app:v1"}; strings.Join(engine.tagged, ",") != strings.Join(want, ",") {
+		t.Errorf("tagged %v, want %v", engine.tagged, want)
+	}
+	if want := []string{"registry.example.com/team/app:v1"}; strings.Join(engine.pushed, ",") != strings.Join(want, ",") {
+		t.Errorf("pushed %v, want %v", engine.pushed, want)
+	}
+
+	decoded, err := base64.URLEncoding.DecodeString(engine.registryAuth)
+	if err != nil {
+		t.Fatalf("X-Registry-Auth %q is not base64: %v", engine.registryAuth, err)
+	}
+	var registryAuth struct {
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		ServerAddress string `json:"serveraddress"`
+	}
+	if err := json.Unmarshal(decoded, &registryAuth); err != nil {
+		t.Fatal(err)
+	}
+	if registryAuth.Username != "builder" || registryAuth.Password != "s3cret" || registryAuth.ServerAddress != "registry.example.com" {
+		t.Errorf("X-Registry-Auth = %s, want credentials of registry.example.com", decoded)
+	}
+
+	// status is logged once per change, progress bars are skipped
+	if strings.Count(output.String(), "abc Pushing") != 1 || !strings.Contains(output.String(), "abc Pushed") {
+		t.Errorf("push output = %q", output.String())
+	}
+}
+
+func TestDockerBuilderPushesWithDefaultCredentials(t *testing.T) {
+	engine := newFakeEngine(t)
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	registry.SetDefaultCredentials("dci.example.com", registry.Credentials{Username: "cli", Password: "cortex-token"})
+	engine.mutex.Lock()
+	engine.pushStream = `{"aux":{"Digest":"sha256:beef"}}`
+	engine.mutex.Unlock()
+
+	docker, err := newDockerEngine(log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := docker.push("dci.example.com/team/app:v2")
+	if err != nil || digest != "sha256:beef" {
+		t.Fatalf("push = %q, %v, want sha256:beef", digest, err)
+	}
+	decoded, _ := base64.URLEncoding.DecodeString(engine.registryAuth)
+	if !strings.Contains(string(decoded), `"password":"cortex-token"`) {
+		t.Errorf("X-Registry-Auth = %s, want default credentials of registry", decoded)
+	}
+}
+
+func TestDockerEngineStreamErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		build   string
+		push    string
+		wantErr string
+	}{
+		{
+			name:    "build error detail",
+			build:   `{"stream":"Step 1/2 : RUN false\n"}` + "\n" + `{"errorDetail":{"code":1,"message":"The command '/bin/sh -c false' returned a non-zero code: 1"},"error":"The command '/bin/sh -c false' returned a non-zero code: 1"}`,
+			wantErr: "failed to build team/app:v1: The command '/bin/sh -c false' returned a non-zero code: 1",
+		},
+		{
+			name:    "build error without detail",
+			build:   `{"error":"no space left on device"}`,
+			wantErr: "failed to build team/app:v1: no space left on device",
+		},
+		{
+			name:    "invalid stream",
+			build:   `{"stream":`,
+			wantErr: "failed to read Docker Engine progress",
+		},
+		{
+			name:    "push error",
+			push:    `{"status":"Preparing","id":"abc"}` + "\n" + `{"errorDetail":{"message":"denied: requested access to the resource is denied"},"error":"denied"}`,
+			wantErr: "failed to push registry.example.com/team/app:v1: denied: requested access to the resource is denied",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			engine := newFakeEngine(t)
+			t.Setenv("DOCKER_CONFIG", t.TempDir())
+			engine.mutex.Lock()
+			if test.build != "" {
+				engine.buildStream = test.build
+			}
+			if test.push != "" {
+				engine.pushStream = test.push
+			}
+			engine.mutex.Unlock()
+			context := t.TempDir()
+			writeFiles(t, context, map[string]string{"Dockerfile": "FROM alpine\n"})
+			spec := BuildSpec{Dockerfile: filepath.Join(context, "Dockerfile"), Context: context, Image: "team/app:v1", Tag: "registry.example.com/team/app:v1", Logger: log.New(ioutil.Discard, "", 0)}
+			digest, err := dockerBuilder{}.Build(spec)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("Build = %q, %v, want error containing %q", digest, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestDockerEngineStatusErrors(t *testing.T) {
+	newFakeEngine(t)
+	docker, err := newDockerEngine(log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = docker.tag("team/app:v1", "registry.example.com/team/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = docker.post("/containers/create", nil, "", nil, "")
+	if err == nil || !strings.Contains(err.Error(), "failed with status 404: page not found") {
+		t.Fatalf("post error = %v, want message of Docker Engine error", err)
+	}
+}
@@ -0,0 +1,327 @@
+package build
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	// DEFAULT_TAG_FORMAT is <short commit hash>-<branch>, as image versions before tag format was configurable
+	DEFAULT_TAG_FORMAT = "{{.ShortSHA}}-{{.Branch}}"
+	// VERSION_TAG_PATTERN matches git tags considered by describe, like `git describe --match 'v*.*'`
+	VERSION_TAG_PATTERN = "v*.*"
+	// DESCRIBE_CANDIDATES is number of most recent tagged commits considered by describe, as default of `git describe --candidates`
+	DESCRIBE_CANDIDATES = 10
+)
+
+// CI env vars having branch name, for detached HEAD checkouts in CI. Checked in order
+var ciBranchEnvVars = []string{
+	"GITHUB_HEAD_REF",        // GitHub Actions pull requests
+	"GITHUB_REF_NAME",        // GitHub Actions
+	"CI_COMMIT_REF_NAME",     // GitLab
+	"BRANCH_NAME",            // Jenkins multibranch pipeline
+	"GIT_BRANCH",             // Jenkins git plugin, like origin/main
+	"BUILDKITE_BRANCH",       // Buildkite
+	"CIRCLE_BRANCH",          // CircleCI
+	"TRAVIS_BRANCH",          // Travis CI
+	"BITBUCKET_BRANCH",       // Bitbucket Pipelines
+	"BUILD_SOURCEBRANCHNAME", // Azure Pipelines
+}
+
+var (
+	invalidTagCharsRegex = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+	dockerTagRegex       = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+)
+
+// GitVersion describes HEAD of repo, fields are available in tag format template
+type GitVersion struct {
+	Tag      string // nearest tag matching v*.*, empty if there isn't one
+	Distance int    // number of commits since Tag (or all commits if there isn't a tag)
+	SHA      string
+	ShortSHA string
+	Branch   string // branch (or CI branch for detached HEAD) usable in docker tag, like feature-x for feature/x
+	Dirty    bool   // tracked files are modified
+	Describe string // like `git describe --long --always --dirty --match 'v*.*'`, v1.2-3-gabc1234(-dirty) or abc1234(-dirty) without tag
+}
+
+// DescribeRepo describes HEAD of git repo with nearest version tag (annotated or lightweight), distance from it and dirty state
+func DescribeRepo(repoDir string) (GitVersion, error) {
+	return DescribeRevision(repoDir, "")
+}
+
+// DescribeRevision describes commit of revision (like commit hash, tag or HEAD~2) as DescribeRepo describes HEAD. Branch is the branch of HEAD,
+// as images of the commit would be tagged when built in current checkout. Dirty state is only of HEAD (empty revision)
+func DescribeRevision(repoDir string, revision string) (GitVersion, error) {
+	repo, err := git.PlainOpenWithOptions(repoDir, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return GitVersion{}, err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return GitVersion{}, fmt.Errorf("failed to get HEAD of repo: %w", err)
+	}
+	hash := head.Hash()
+	if revision != "" {
+		resolved, err := repo.ResolveRevision(plumbing.Revision(revision))
+		if err != nil {
+			return GitVersion{}, fmt.Errorf("failed to find commit %s in repo: %w", revision, err)
+		}
+		hash = *resolved
+	}
+	version := GitVersion{SHA: hash.String(), ShortSHA: hash.String()[0:7]}
+	if head.Name().IsBranch() {
+		version.Branch = head.Name().Short()
+	} else {
+		version.Branch = ciBranch()
+	}
+	version.Branch = strings.Trim(invalidTagCharsRegex.ReplaceAllString(version.Branch, "-"), "-.")
+	if version.Branch == "" {
+		version.Branch = "detached"
+	}
+
+	tags, err := versionTags(repo)
+	if err != nil {
+		return GitVersion{}, err
+	}
+	headCommit, err := repo.CommitObject(hash)
+	if err != nil {
+		return GitVersion{}, err
+	}
+	tagCommit, err := nearestTaggedCommit(headCommit, tags)
+	if err != nil {
+		return GitVersion{}, err
+	}
+	if tagCommit != nil {
+		version.Tag = tags[tagCommit.Hash][0]
+	}
+	if version.Distance, err = distance(headCommit, tagCommit); err != nil {
+		return GitVersion{}, err
+	}
+
+	worktree, err := repo.Worktree()
+	if err == nil && revision == "" {
+		status, err := worktree.Status()
+		if err != nil {
+			return GitVersion{}, fmt.Errorf("failed to get status of repo: %w", err)
+		}
+		for _, file := range status {
+			// untracked files don't make repo dirty, same as git describe
+			if file.Worktree == git.Untracked && file.Staging == git.Untracked {
+				continue
+			}
+			if file.Worktree != git.Unmodified || file.Staging != git.Unmodified {
+				version.Dirty = true
+				break
+			}
+		}
+	}
+
+	version.Describe = version.ShortSHA
+	if version.Tag != "" {
+		version.Describe = fmt.Sprint(version.Tag, "-", version.Distance, "-g", version.ShortSHA)
+	}
+	if version.Dirty {
+		version.Describe += "-dirty"
+	}
+	return version, nil
+}
+
+// ciBranch returns branch from CI env vars, `detached` if it isn't set
+func ciBranch() string {
+	for _, name := range ciBranchEnvVars {
+		if branch := os.Getenv(name); branch != "" {
+			return strings.TrimPrefix(branch, "origin/")
+		}
+	}
+	return "detached"
+}
+
+// versionTags returns names of tags matching VERSION_TAG_PATTERN by commit, sorted by semantic version descending so the highest version is first
+func versionTags(repo *git.Repository) (map[plumbing.Hash][]string, error) {
+	refs, err := repo.Tags()
+	if err != nil {
+		return nil, err
+	}
+	tags := map[plumbing.Hash][]string{}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().Short()
+		if matched, _ := path.Match(VERSION_TAG_PATTERN, name); !matched {
+			return nil
+		}
+		hash := ref.Hash()
+		// annotated tag refers to tag object, which refers to commit
+		if tag, err := repo.TagObject(hash); err == nil {
+			commit, err := tag.Commit()
+			if err != nil {
+				return nil
+			}
+			hash = commit.Hash
+		}
+		tags[hash] = append(tags[hash], name)
+		return nil
+	})
+	for _, names := range tags {
+		sort.Slice(names, func(i, j int) bool {
+			return compareVersions(names[i], names[j]) > 0
+		})
+	}
+	return tags, err
+}
+
+// compareVersions compares version tags like v1.10.0 and v1.9.0-rc.1 by semantic version: dot separated numbers are compared numerically
+// and release is higher than its pre-release. Other parts are compared as strings
+func compareVersions(a string, b string) int {
+	versionA, preA := splitPreRelease(strings.TrimPrefix(a, "v"))
+	versionB, preB := splitPreRelease(strings.TrimPrefix(b, "v"))
+	if result := compareDotted(versionA, versionB); result != 0 {
+		return result
+	}
+	switch {
+	case preA == preB:
+		return strings.Compare(a, b)
+	case preA == "":
+		return 1
+	case preB == "":
+		return -1
+	}
+	return compareDotted(preA, preB)
+}
+
+func splitPreRelease(version string) (string, string) {
+	if i := strings.Index(version, "-"); i >= 0 {
+		return version[:i], version[i+1:]
+	}
+	return version, ""
+}
+
+// compareDotted compares dot separated parts, numerically if both are numbers. Missing parts are lower
+func compareDotted(a string, b string) int {
+	partsA := strings.Split(a, ".")
+	partsB := strings.Split(b, ".")
+	for i := 0; i < len(partsA) && i < len(partsB); i++ {
+		numberA, errA := strconv.Atoi(partsA[i])
+		numberB, errB := strconv.Atoi(partsB[i])
+		switch {
+		case errA == nil && errB == nil && numberA != numberB:
+			if numberA < numberB {
+				return -1
+			}
+			return 1
+		case errA == nil && errB != nil:
+			return -1
+		case errA != nil && errB == nil:
+			return 1
+		case errA != nil && errB != nil && partsA[i] != partsB[i]:
+			return strings.Compare(partsA[i], partsB[i])
+		}
+	}
+	return len(partsA) - len(partsB)
+}
+
+// nearestTaggedCommit finds tagged commit as git describe does. Walking history from HEAD by commit date (newest first), first DESCRIBE_CANDIDATES
+// tagged commits are candidates, and the one with fewest commits since it is chosen (the newer on a tie). Returns nil if no commit is tagged
+func nearestTaggedCommit(head *object.Commit, tags map[plumbing.Hash][]string) (*object.Commit, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	var candidates []*object.Commit
+	err := object.NewCommitIterCTime(head, nil, nil).ForEach(func(commit *object.Commit) error {
+		if _, ok := tags[commit.Hash]; ok {
+			candidates = append(candidates, commit)
+			if len(candidates) == DESCRIBE_CANDIDATES {
+				return storer.ErrStop
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var nearest *object.Commit
+	nearestDistance := 0
+	for _, candidate := range candidates {
+		candidateDistance, err := distance(head, candidate)
+		if err != nil {
+			return nil, err
+		}
+		if nearest == nil || candidateDistance < nearestDistance {
+			nearest, nearestDistance = candidate, candidateDistance
+		}
+	}
+	return nearest, nil
+}
+
+// distance counts commits reachable from HEAD but not from tagged commit, as git describe does
+func distance(head *object.Commit, tagCommit *object.Commit) (int, error) {
+	tagged := map[plumbing.Hash]bool{}
+	if tagCommit != nil {
+		err := object.NewCommitPreorderIter(tagCommit, nil, nil).ForEach(func(commit *object.Commit) error {
+			tagged[commit.Hash] = true
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	count := 0
+	err := object.NewCommitPreorderIter(head, tagged, nil).ForEach(func(commit *object.Commit) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// TagPattern returns regex matching image tags rendered from tag format for any commit of branch (any branch if empty). Tags of dirty checkouts don't match `{{.Describe}}`
+func TagPattern(format string, branch string) (*regexp.Regexp, error) {
+	// format is rendered with placeholders, which are replaced with regex of fields after quoting rendered tag
+	const distance = 918273645
+	placeholders := GitVersion{Tag: "\x00tag\x00", Distance: distance, SHA: "\x00sha\x00", ShortSHA: "\x00short\x00", Branch: branch, Describe: "\x00describe\x00"}
+	if branch == "" {
+		placeholders.Branch = "\x00branch\x00"
+	}
+	tmpl, err := template.New("tag").Option("missingkey=error").Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image tag format %s: %w", format, err)
+	}
+	var tag bytes.Buffer
+	if err := tmpl.Execute(&tag, placeholders); err != nil {
+		return nil, fmt.Errorf("invalid image tag format %s: %w", format, err)
+	}
+	pattern := strings.NewReplacer(
+		"\x00tag\x00", `(v[A-Za-z0-9_.-]*)?`,
+		fmt.Sprint(distance), `[0-9]+`,
+		"\x00sha\x00", `[0-9a-f]{40}`,
+		"\x00short\x00", `[0-9a-f]{7,}`,
+		"\x00branch\x00", `[A-Za-z0-9_.-]+`,
+		"\x00describe\x00", `(v[A-Za-z0-9_.-]*-[0-9]+-g)?[0-9a-f]{7,}`,
+	).Replace(regexp.QuoteMeta(tag.String()))
+	return regexp.Compile("^" + pattern + "$")
+}
+
+// FormatVersion renders image version from tag format template (like `{{.Tag}}-{{.Distance}}-g{{.ShortSHA}}`) and validates it as docker tag
+func FormatVersion(format string, version GitVersion) (string, error) {
+	tmpl, err := template.New("tag").Option("missingkey=error").Parse(format)
+	if err != nil {
+		return "", fmt.Errorf("invalid image tag format %s: %w", format, err)
+	}
+	var tag bytes.Buffer
+	if err := tmpl.Execute(&tag, version); err != nil {
+		return "", fmt.Errorf("invalid image tag format %s: %w", format, err)
+	}
+	if !dockerTagRegex.MatchString(tag.String()) {
+		return "", errors.New(fmt.Sprint("image tag `", tag.String(), "` of format ", format, " is not a valid docker tag. Tag can have letters, digits, _ . and - (not starting with . or -) and up to 128 characters"))
+	}
+	return tag.String(), nil
+}
@@ -0,0 +1,226 @@
+package build
+
+import (
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRepo is a git repo in temporary directory, with commits dated a minute apart
+type testRepo struct {
+	t    *testing.T
+	dir  string
+	repo *git.Repository
+	time time.Time
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range ciBranchEnvVars {
+		t.Setenv(name, "")
+	}
+	return &testRepo{t: t, dir: dir, repo: repo, time: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+// commit changes tracked file and commits it with parents (HEAD if none), returning the commit
+func (r *testRepo) commit(message string, parents ...plumbing.Hash) plumbing.Hash {
+	r.t.Helper()
+	worktree, err := r.repo.Worktree()
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(r.dir, "file.txt"), []byte(message), 0644); err != nil {
+		r.t.Fatal(err)
+	}
+	if _, err := worktree.Add("file.txt"); err != nil {
+		r.t.Fatal(err)
+	}
+	r.time = r.time.Add(time.Minute)
+	signature := &object.Signature{Name: "test", Email: "test@example.com", When: r.time}
+	hash, err := worktree.Commit(message, &git.CommitOptions{Author: signature, Committer: signature, Parents: parents})
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return hash
+}
+
+func (r *testRepo) tag(name string, hash plumbing.Hash, annotated bool) {
+	r.t.Helper()
+	var options *git.CreateTagOptions
+	if annotated {
+		options = &git.CreateTagOptions{Message: name, Tagger: &object.Signature{Name: "test", Email: "test@example.com", When: r.time}}
+	}
+	if _, err := r.repo.CreateTag(name, hash, options); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+func (r *testRepo) describe(revision string) GitVersion {
+	r.t.Helper()
+	version, err := DescribeRevision(r.dir, revision)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return version
+}
+
+func TestDescribeRevision(t *testing.T) {
+	repo := newTestRepo(t)
+	first := repo.commit("first")
+	repo.commit("second")
+
+	version := repo.describe("")
+	if version.Tag != "" || version.Distance != 2 || version.Branch != "master" || version.Describe != version.ShortSHA {
+		t.Errorf("version without tags = %+v, want distance of all commits", version)
+	}
+
+	// highest version of tags on commit, by semantic version
+	tagged := repo.commit("release")
+	repo.tag("v1.9.0", tagged, false)
+	repo.tag("v1.10.0", tagged, true)
+	repo.tag("v1.10.0-rc.1", tagged, false)
+	repo.tag("release-2", tagged, false)
+	repo.tag("v0.1", first, false)
+	repo.commit("fix")
+	head := repo.commit("feature")
+	version = repo.describe("")
+	want := GitVersion{Tag: "v1.10.0", Distance: 2, SHA: head.String(), ShortSHA: head.String()[:7], Branch: "master", Describe: "v1.10.0-2-g" + head.String()[:7]}
+	if version != want {
+		t.Errorf("version = %+v, want %+v", version, want)
+	}
+
+	// modified tracked file makes checkout dirty, untracked file doesn't
+	if err := os.WriteFile(filepath.Join(repo.dir, "untracked.txt"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if version := repo.describe(""); version.Dirty {
+		t.Errorf("version = %+v, want untracked files not making checkout dirty", version)
+	}
+	if err := os.WriteFile(filepath.Join(repo.dir, "file.txt"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if version := repo.describe(""); !version.Dirty || version.Describe != want.Describe+"-dirty" {
+		t.Errorf("version = %+v, want dirty", version)
+	}
+
+	// revision is described without dirty state of checkout
+	version = repo.describe("HEAD~2")
+	if version.Tag != "v1.10.0" || version.Distance != 0 || version.SHA != tagged.String() || version.Dirty || version.Branch != "master" {
+		t.Errorf("version of HEAD~2 = %+v, want tagged commit", version)
+	}
+	if _, err := DescribeRevision(repo.dir, "v9.9"); err == nil {
+		t.Errorf("DescribeRevision of missing revision succeeded")
+	}
+}
+
+func TestDescribeRevisionChoosesTagAsGitDescribe(t *testing.T) {
+	repo := newTestRepo(t)
+	// v1.0 (first parent) and v2.0 are both 2 commits back from HEAD, but commits of side branch are also since v1.0,
+	// so there are fewer commits since v2.0
+	base := repo.commit("base")
+	repo.tag("v1.0", base, false)
+	side := base
+	for i := 0; i < 4; i++ {
+		side = repo.commit(fmt.Sprint("side ", i), side)
+	}
+	repo.tag("v2.0", side, false)
+	main := repo.commit("main", base)
+	sideMerge := repo.commit("side merge", side)
+	head := repo.commit("merge", main, sideMerge)
+
+	version := repo.describe("")
+	if version.Tag != "v2.0" || version.Distance != 3 || version.SHA != head.String() {
+		t.Errorf("version = %+v, want v2.0 with distance 3", version)
+	}
+	if version := repo.describe(main.String()); version.Tag != "v1.0" || version.Distance != 1 {
+		t.Errorf("version of main = %+v, want v1.0 with distance 1", version)
+	}
+}
+
+func TestDescribeRevisionBranch(t *testing.T) {
+	repo := newTestRepo(t)
+	head := repo.commit("first")
+	if err := repo.repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, "refs/heads/feature/new_thing")); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/feature/new_thing", head)); err != nil {
+		t.Fatal(err)
+	}
+	if version := repo.describe(""); version.Branch != "feature-new_thing" {
+		t.Errorf("branch = %q, want feature-new_thing", version.Branch)
+	}
+
+	// detached HEAD uses branch of CI
+	if err := repo.repo.Storer.SetReference(plumbing.NewHashReference(plumbing.HEAD, head)); err != nil {
+		t.Fatal(err)
+	}
+	if version := repo.describe(""); version.Branch != "detached" {
+		t.Errorf("branch = %q, want detached", version.Branch)
+	}
+	t.Setenv("GIT_BRANCH", "origin/release/1.2")
+	if version := repo.describe(""); version.Branch != "release-1.2" {
+		t.Errorf("branch = %q, want branch of CI release-1.2", version.Branch)
+	}
+
+	if _, err := DescribeRevision(t.TempDir(), ""); err == nil {
+		t.Errorf("DescribeRevision outside git repo succeeded")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	ordered := []string{"v0.9", "v1.0.0-alpha", "v1.0.0-alpha.2", "v1.0.0-alpha.10", "v1.0.0-beta", "v1.0.0", "v1.0.1", "v1.9.0", "v1.10.0", "v2.0"}
+	for i := range ordered {
+		for j := range ordered {
+			got := compareVersions(ordered[i], ordered[j])
+			if (i < j && got >= 0) || (i > j && got <= 0) || (i == j && got != 0) {
+				t.Errorf("compareVersions(%s, %s) = %d", ordered[i], ordered[j], got)
+			}
+		}
+	}
+}
+
+func TestFormatVersion(t *testing.T) {
+	version := GitVersion{Tag: "v1.10.0", Distance: 2, SHA: strings.Repeat("ab", 20), ShortSHA: "abababa", Branch: "feature-x", Describe: "v1.10.0-2-gabababa"}
+	tests := []struct {
+		format  string
+		want    string
+		wantErr string
+	}{
+		{format: DEFAULT_TAG_FORMAT, want: "abababa-feature-x"},
+		{format: "{{.Tag}}-{{.Distance}}-g{{.ShortSHA}}", want: "v1.10.0-2-gabababa"},
+		{format: "{{.Describe}}", want: "v1.10.0-2-gabababa"},
+		{format: "{{.Branch}}-{{.SHA}}", want: "feature-x-" + strings.Repeat("ab", 20)},
+		{format: "{{.Tag", wantErr: "invalid image tag format"},
+		{format: "{{.Version}}", wantErr: "invalid image tag format"},
+		{format: "-{{.ShortSHA}}", wantErr: "is not a valid docker tag"},
+		{format: "{{.Tag}}/{{.ShortSHA}}", wantErr: "is not a valid docker tag"},
+		{format: "{{.SHA}}{{.SHA}}{{.SHA}}{{.SHA}}", wantErr: "is not a valid docker tag"},
+	}
+	for _, test := range tests {
+		got, err := FormatVersion(test.format, version)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("FormatVersion(%s) = %q, %v, want error %q", test.format, got, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("FormatVersion(%s) = %q, %v, want %q", test.format, got, err, test.want)
+		}
+	}
+
+	// version without tag renders empty tag, which isn't valid alone
+	if _, err := FormatVersion("{{.Tag}}", GitVersion{ShortSHA: "abababa"}); err == nil {
+		t.Errorf("FormatVersion of empty tag succeeded")
+	}
+}
@@ -0,0 +1,70 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Image is an image built (or reused from registry) for an action, with digest of its manifest if known
+type Image struct {
+	Image  string `json:"image"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// ImageMap is images by image (and action) name, written by `fabric build --images-file` and read by `fabric deploy --images`,
+// so build and deploy can run in separate CI stages
+type ImageMap map[string]Image
+
+// Pinned returns image referenced by digest like `<registry>/<namespace>/<name>@sha256:..`, or image tag if digest isn't known
+func (i Image) Pinned() string {
+	if i.Digest == "" {
+		return i.Image
+	}
+	name := strings.Split(i.Image, "@")[0]
+	if colon := strings.LastIndex(name, ":"); colon > strings.LastIndex(name, "/") {
+		name = name[:colon]
+	}
+	return name + "@" + i.Digest
+}
+
+// Mapping returns image by name, as used for substituting images of actions. With pin, images are referenced by digest if known,
+// so deployed actions run the image built even if its tag is pushed again
+func (m ImageMap) Mapping(pin bool) map[string]string {
+	mapping := map[string]string{}
+	for name, image := range m {
+		mapping[name] = image.Image
+		if pin {
+			mapping[name] = image.Pinned()
+		}
+	}
+	return mapping
+}
+
+// WriteImageMap saves images as JSON file
+func WriteImageMap(path string, images ImageMap) error {
+	content, err := json.MarshalIndent(images, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(content, '\n'), 0644)
+}
+
+// ReadImageMap reads images from JSON file written by WriteImageMap
+func ReadImageMap(path string) (ImageMap, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	images := ImageMap{}
+	if err := json.Unmarshal(content, &images); err != nil {
+		return nil, fmt.Errorf("failed to parse images file %s: %w", path, err)
+	}
+	for name, image := range images {
+		if image.Image == "" {
+			return nil, fmt.Errorf("invalid images file %s: image of %s is not set", path, name)
+		}
+	}
+	return images, nil
+}
@@ -0,0 +1,235 @@
+package config
+
+import (
+	"errors"
+	"fabric-ops/cmd/secret"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Settings are named after environment variables used to configure them
+const (
+	CORTEX_URL                = "CORTEX_URL"
+	CORTEX_ACCOUNT            = "CORTEX_ACCOUNT"
+	CORTEX_PROJECT            = "CORTEX_PROJECT"
+	CORTEX_TOKEN              = "CORTEX_TOKEN"
+	CORTEX_USER               = "CORTEX_USER"
+	CORTEX_PASSWORD           = "CORTEX_PASSWORD"
+	CORTEX_ACCESS_TOKEN_PATH  = "CORTEX_ACCESS_TOKEN_PATH"
+	CORTEX_ACCESS_TOKEN_VALUE = "CORTEX_ACCESS_TOKEN_VALUE"
+	DOCKER_PREGISTRY_URL      = "DOCKER_PREGISTRY_URL"
+	DOCKER_PREGISTRY_PREFIX   = "DOCKER_PREGISTRY_PREFIX"
+	DOCKER_BUILD_CONTEXT      = "DOCKER_BUILD_CONTEXT"
+	DOCKER_IMAGE_TAG_FORMAT   = "DOCKER_IMAGE_TAG_FORMAT"
+	DOCKERFILE_INCLUDE        = "DOCKERFILE_INCLUDE"
+	DOCKERFILE_EXCLUDE        = "DOCKERFILE_EXCLUDE"
+	FABRIC_BUILDER            = "FABRIC_BUILDER"
+
+	// FABRIC_ENV selects environment, if --env is not used
+	FABRIC_ENV = "FABRIC_ENV"
+)
+
+// USER_CONFIG_FILE is relative to home directory, REPO_CONFIG_FILE is relative to repo directory
+var (
+	USER_CONFIG_FILE = filepath.Join(".fabric", "config.yaml")
+	REPO_CONFIG_FILE = filepath.Join(".fabric", "environments.yaml")
+)
+
+// Environment is a named target (like dev, stage, prod) in config file. Any value can be a secret reference like `secret://vault/..#token`
+type Environment struct {
+	CortexURL         string      `yaml:"cortexUrl,omitempty"`
+	Account           string      `yaml:"account,omitempty"`
+	Project           string      `yaml:"project,omitempty"`
+	Credentials       Credentials `yaml:"credentials,omitempty"`
+	DockerRegistry    string      `yaml:"dockerRegistry,omitempty"`
+	DockerPrefix      string      `yaml:"dockerPrefix,omitempty"`
+	BuildContext      string      `yaml:"buildContext,omitempty"`
+	ImageTagFormat    string      `yaml:"imageTagFormat,omitempty"`    // like {{.Tag}}-{{.Distance}}-g{{.ShortSHA}}
+	DockerfileInclude string      `yaml:"dockerfileInclude,omitempty"` // comma separated globs of Dockerfiles, like actions/**/Dockerfile
+	DockerfileExclude string      `yaml:"dockerfileExclude,omitempty"` // comma separated globs excluded from Dockerfile search
+	Builder           string      `yaml:"builder,omitempty"`           // docker, podman, buildah or kaniko
+}
+
+// Credentials of Cortex. Either token, user and password (v5) or Personal Access Token (v6) file or content
+type Credentials struct {
+	Token            string `yaml:"token,omitempty"`
+	User             string `yaml:"user,omitempty"`
+	Password         string `yaml:"password,omitempty"`
+	AccessTokenPath  string `yaml:"accessTokenPath,omitempty"`
+	AccessTokenValue string `yaml:"accessTokenValue,omitempty"`
+}
+
+// File is format of config files, `default` environment is used if environment is not selected
+type File struct {
+	Default      string                 `yaml:"default,omitempty"`
+	Environments map[string]Environment `yaml:"environments"`
+}
+
+func (e Environment) settings() map[string]string {
+	return map[string]string{
+		CORTEX_URL:                e.CortexURL,
+		CORTEX_ACCOUNT:            e.Account,
+		CORTEX_PROJECT:            e.Project,
+		CORTEX_TOKEN:              e.Credentials.Token,
+		CORTEX_USER:               e.Credentials.User,
+		CORTEX_PASSWORD:           e.Credentials.Password,
+		CORTEX_ACCESS_TOKEN_PATH:  e.Credentials.AccessTokenPath,
+		CORTEX_ACCESS_TOKEN_VALUE: e.Credentials.AccessTokenValue,
+		DOCKER_PREGISTRY_URL:      e.DockerRegistry,
+		DOCKER_PREGISTRY_PREFIX:   e.DockerPrefix,
+		DOCKER_BUILD_CONTEXT:      e.BuildContext,
+		DOCKER_IMAGE_TAG_FORMAT:   e.ImageTagFormat,
+		DOCKERFILE_INCLUDE:        e.DockerfileInclude,
+		DOCKERFILE_EXCLUDE:        e.DockerfileExclude,
+		FABRIC_BUILDER:            e.Builder,
+	}
+}
+
+var (
+	// environments by name, with settings merged from user and repo config files
+	environments = map[string]map[string]string{}
+	defaultEnv   string
+	selectedEnv  string
+	flags        = map[string]string{}
+	mutex        sync.RWMutex
+)
+
+// Load reads user config `~/.fabric/config.yaml` and repo config `.fabric/environments.yaml` (overriding user config) and selects environment.
+// Environment is selected by name (--env), or FABRIC_ENV env var, or `default` in config files. Missing config files are ignored
+func Load(repoDir string, env string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	environments = map[string]map[string]string{}
+	defaultEnv = ""
+	var files []string
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, USER_CONFIG_FILE))
+	}
+	if repoDir != "" {
+		files = append(files, filepath.Join(repoDir, REPO_CONFIG_FILE))
+	}
+	for _, file := range files {
+		if err := loadFile(file); err != nil {
+			return err
+		}
+	}
+
+	selectedEnv = env
+	if selectedEnv == "" {
+		selectedEnv = os.Getenv(FABRIC_ENV)
+	}
+	if selectedEnv == "" {
+		selectedEnv = defaultEnv
+	}
+	if _, ok := environments[selectedEnv]; selectedEnv != "" && !ok {
+		return errors.New(fmt.Sprint("Environment ", selectedEnv, " is not defined in ", strings.Join(files, " or "), ". Defined environments: ", strings.Join(names(), ", ")))
+	}
+	return nil
+}
+
+func loadFile(file string) error {
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read config file %s: %w", file, err)
+	}
+	var config File
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", file, err)
+	}
+	if config.Default != "" {
+		defaultEnv = config.Default
+	}
+	for name, environment := range config.Environments {
+		settings, ok := environments[name]
+		if !ok {
+			settings = map[string]string{}
+			environments[name] = settings
+		}
+		for key, value := range environment.settings() {
+			if value != "" {
+				settings[key] = value
+			}
+		}
+	}
+	return nil
+}
+
+func names() []string {
+	var list []string
+	for name := range environments {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// SetFlag overrides setting with value of command line flag. Empty values are ignored
+func SetFlag(key string, value string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if value != "" {
+		flags[key] = value
+	}
+}
+
+// Selected returns name of selected environment, empty if environment is not selected
+func Selected() string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return selectedEnv
+}
+
+// Get returns setting from command line flag, or env var, or selected environment in config files (in the order of precedence).
+// Secret references in values are resolved
+func Get(key string) string {
+	mutex.RLock()
+	value := flags[key]
+	mutex.RUnlock()
+	if value == "" {
+		value = os.Getenv(key)
+	}
+	if value == "" {
+		value = environmentValue(Selected(), key)
+	}
+	return resolve(key, value)
+}
+
+// GetFromEnvironment returns setting of named environment from config files only, ignoring flags and env vars. Used for commands working with multiple environments
+func GetFromEnvironment(env string, key string) string {
+	return resolve(key, environmentValue(env, key))
+}
+
+// environmentValue returns setting of named environment as in config files, without resolving secret references
+func environmentValue(env string, key string) string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return environments[env][key]
+}
+
+// Exists checks whether named environment is defined in config files
+func Exists(env string) bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	_, ok := environments[env]
+	return ok
+}
+
+func resolve(key string, value string) string {
+	if !secret.IsReference(value) {
+		return value
+	}
+	resolved, err := secret.Resolve(value)
+	if err != nil {
+		log.Fatalln("Failed to resolve ", key, ". Error: ", err)
+	}
+	return resolved
+}
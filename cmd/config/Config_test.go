@@ -0,0 +1,127 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupConfig writes user and repo config files in temporary home and repo directories, returning repo directory. Flags are reset after test
+func setupConfig(t *testing.T, userConfig string, repoConfig string) string {
+	home := t.TempDir()
+	repo := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(FABRIC_ENV, "")
+	for file, content := range map[string]string{filepath.Join(home, USER_CONFIG_FILE): userConfig, filepath.Join(repo, REPO_CONFIG_FILE): repoConfig} {
+		if content == "" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		mutex.Lock()
+		flags = map[string]string{}
+		mutex.Unlock()
+	})
+	return repo
+}
+
+func TestGetPrecedence(t *testing.T) {
+	userConfig := `
+default: dev
+environments:
+  dev:
+    cortexUrl: https://user.dev
+    project: user-project
+    dockerPrefix: user-prefix
+    builder: podman
+  prod:
+    cortexUrl: https://user.prod
+`
+	repoConfig := `
+environments:
+  dev:
+    cortexUrl: https://repo.dev
+    project: repo-project
+    dockerPrefix: repo-prefix
+`
+	repo := setupConfig(t, userConfig, repoConfig)
+	if err := Load(repo, ""); err != nil {
+		t.Fatal(err)
+	}
+	SetFlag(CORTEX_URL, "https://flag")
+	SetFlag(CORTEX_PROJECT, "")
+	t.Setenv(CORTEX_URL, "https://env")
+	t.Setenv(CORTEX_PROJECT, "env-project")
+	t.Setenv(DOCKER_PREGISTRY_PREFIX, "")
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: CORTEX_URL, want: "https://flag"},             // flag over env var
+		{key: CORTEX_PROJECT, want: "env-project"},          // env var over config, empty flag is ignored
+		{key: DOCKER_PREGISTRY_PREFIX, want: "repo-prefix"}, // repo config over user config
+		{key: FABRIC_BUILDER, want: "podman"},               // user config
+		{key: DOCKER_BUILD_CONTEXT, want: ""},
+	}
+	for _, test := range tests {
+		if got := Get(test.key); got != test.want {
+			t.Errorf("Get(%s) = %q, want %q", test.key, got, test.want)
+		}
+	}
+	if Selected() != "dev" {
+		t.Errorf("selected environment = %q, want default dev", Selected())
+	}
+	// flags and env vars are not settings of other environments
+	if got := GetFromEnvironment("prod", CORTEX_URL); got != "https://user.prod" {
+		t.Errorf("GetFromEnvironment(prod) = %q", got)
+	}
+}
+
+func TestLoadSelectsEnvironment(t *testing.T) {
+	repo := setupConfig(t, "default: dev\nenvironments:\n  dev:\n    project: dev\n  stage:\n    project: stage\n  prod:\n    project: prod\n", "")
+	t.Setenv(CORTEX_PROJECT, "")
+
+	t.Setenv(FABRIC_ENV, "stage")
+	if err := Load(repo, "prod"); err != nil || Get(CORTEX_PROJECT) != "prod" {
+		t.Errorf("project = %q, %v, want --env over FABRIC_ENV", Get(CORTEX_PROJECT), err)
+	}
+	if err := Load(repo, ""); err != nil || Get(CORTEX_PROJECT) != "stage" {
+		t.Errorf("project = %q, %v, want FABRIC_ENV over default", Get(CORTEX_PROJECT), err)
+	}
+	if err := Load(repo, "qa"); err == nil {
+		t.Errorf("Load of undefined environment succeeded")
+	}
+}
+
+func TestGetResolvesSecretsOnce(t *testing.T) {
+	repo := setupConfig(t, "environments:\n  dev:\n    credentials:\n      token: secret://env/FABRIC_TEST_CONFIG_TOKEN\n", "")
+	if err := Load(repo, "dev"); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(CORTEX_TOKEN, "")
+	// resolved value looks like a reference, but it is the value
+	t.Setenv("FABRIC_TEST_CONFIG_TOKEN", "secret://env/FABRIC_TEST_CONFIG_OTHER")
+	t.Setenv("FABRIC_TEST_CONFIG_OTHER", "other-token")
+	for name, get := range map[string]func() string{
+		"Get":                func() string { return Get(CORTEX_TOKEN) },
+		"GetFromEnvironment": func() string { return GetFromEnvironment("dev", CORTEX_TOKEN) },
+	} {
+		if got := get(); got != "secret://env/FABRIC_TEST_CONFIG_OTHER" {
+			t.Errorf("%s = %q, want secret reference resolved once", name, got)
+		}
+	}
+
+	// references in flags and env vars are resolved too
+	t.Setenv(CORTEX_TOKEN, "secret://env/FABRIC_TEST_CONFIG_OTHER")
+	if got := Get(CORTEX_TOKEN); got != "other-token" {
+		t.Errorf("Get = %q, want env var reference resolved", got)
+	}
+}
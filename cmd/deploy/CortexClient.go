@@ -6,10 +6,10 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"fabric-ops/cmd/secret"
 	"fmt"
 	"github.com/ghodss/yaml"
 	"github.com/tidwall/gjson"
-	"github.com/tidwall/sjson"
 	"gopkg.in/square/go-jose.v2"
 	"gopkg.in/square/go-jose.v2/jwt"
 	"io"
@@ -22,6 +22,8 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -48,18 +50,75 @@ type CortexAPI interface {
 	GetURL() string
 	GetToken() string
 	GetAccount() string
-	GetDockerRegistry() string
-	DeployAction(filepath string) string
-	DeployActionJson(actionType string, content []byte) string
-	DeploySkill(filepath string) string
-	DeploySkillJson(content []byte) string
-	DeployAgent(filepath string) string
-	DeployAgentJson(content []byte) string
-	DeployDatasetJson(content []byte) string
-	DeployTypes(filepath string) string
-	DeployTypesJson(content []byte) string
-	DeployConnection(filepath string) string
-	DeployConnectionJson(content []byte) string
+	GetDockerRegistry() (string, error)
+	DeployAction(filepath string) (*Response, error)
+	DeployActionJson(actionType string, content []byte) (*Response, error)
+	DeploySkill(filepath string) (*Response, error)
+	DeploySkillJson(content []byte) (*Response, error)
+	DeployAgent(filepath string) (*Response, error)
+	DeployAgentJson(content []byte) (*Response, error)
+	DeployDatasetJson(content []byte) (*Response, error)
+	DeployTypes(filepath string) (*Response, error)
+	DeployTypesJson(content []byte) (*Response, error)
+	DeployConnection(filepath string) (*Response, error)
+	DeployConnectionJson(content []byte) (*Response, error)
+	GetResourceJson(kind string, name string) ([]byte, error)
+	DeleteResource(kind string, name string) (*Response, error)
+	ListResources(kind string) ([]string, error)
+}
+
+// Response is a successful Cortex API response
+type Response struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (r *Response) String() string {
+	return string(r.Body)
+}
+
+// ResponseError is returned for Cortex API calls failed with HTTP status other than 200 or 201
+type ResponseError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Message    string // error message parsed from Cortex error response
+	Body       []byte
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprint(e.Method, " ", e.URL, " failed with status ", e.StatusCode, " Error: ", e.Message)
+}
+
+// parseErrorMessage gets error message from Cortex error response, which can be like {"message": ".."}, {"error": ".."} or {"errors": [{"message": ".."}]}
+func parseErrorMessage(body []byte) string {
+	response := gjson.ParseBytes(body)
+	if !response.IsObject() {
+		return strings.TrimSpace(string(body))
+	}
+	for _, path := range []string{"message", "error.message", "error", "details"} {
+		if message := response.Get(path); message.Type == gjson.String && message.String() != "" {
+			return message.String()
+		}
+	}
+	if errs := response.Get("errors"); errs.IsArray() {
+		var messages []string
+		for _, e := range errs.Array() {
+			if e.IsObject() {
+				messages = append(messages, e.Get("message").String())
+			} else {
+				messages = append(messages, e.String())
+			}
+		}
+		return strings.Join(messages, "; ")
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// IsNotFound checks whether err is a Cortex API response with status 404
+func IsNotFound(err error) bool {
+	var responseError *ResponseError
+	return errors.As(err, &responseError) && responseError.StatusCode == http.StatusNotFound
 }
 
 func NewCortexClient(url string, account string, user string, password string) CortexAPI {
@@ -73,7 +132,7 @@ func NewCortexClient(url string, account string, user string, password string) C
 	if err != nil {
 		log.Fatalln(err)
 	}
-	client.Token = gjson.Get(string(result), "jwt").String()
+	client.Token = gjson.Get(result.String(), "jwt").String()
 	return client
 }
 
@@ -154,104 +213,118 @@ func (c *CortexClientV5) GetAccount() string {
 	return c.Account
 }
 
-func (c *CortexClientV5) GetDockerRegistry() string {
+func (c *CortexClientV5) GetDockerRegistry() (string, error) {
 	var result, err = httpGet(c, "/v3/actions/_config")
 	if err != nil {
-		log.Fatalln(err)
+		return "", err
 	}
-	value := gjson.Get(string(result), "config.dockerPrivateRegistryUrl").String()
-	return fmt.Sprint(value, "/", c.Account)
+	value := gjson.Get(result.String(), "config.dockerPrivateRegistryUrl").String()
+	return fmt.Sprint(value, "/", c.Account), nil
 }
 
-func (c *CortexClientV5) DeployAction(filepath string) string {
+func (c *CortexClientV5) DeployAction(filepath string) (*Response, error) {
 	content, err := GetJsonContent(filepath)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 	actionType := gjson.Get(string(content), "actionType").String()
 	return c.DeployActionJson(actionType, content)
 }
 
-func (c *CortexClientV5) DeployActionJson(actionType string, content []byte) string {
-	var result, err = httpPost(c, "/v3/actions?actionType="+actionType, bytes.NewReader(content))
-	if err != nil {
-		log.Fatalln(err)
-	}
-	return string(result)
+func (c *CortexClientV5) DeployActionJson(actionType string, content []byte) (*Response, error) {
+	return httpPost(c, "/v3/actions?actionType="+actionType, bytes.NewReader(content))
 }
 
 //https://github.com/CognitiveScale/cortex-cli/blob/6c91a3e94442f690c0de054545b9b214a17b6929/src/client/catalog.js#L42
-func (c *CortexClientV5) DeploySkill(filepath string) string {
+func (c *CortexClientV5) DeploySkill(filepath string) (*Response, error) {
 	content, err := GetJsonContent(filepath)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 	return c.DeploySkillJson(content)
 }
 
-func (c *CortexClientV5) DeploySkillJson(content []byte) string {
-	var result, err = httpPost(c, "/v3/catalog/skills", bytes.NewReader(content))
-	if err != nil {
-		log.Fatalln(err)
-	}
-	return string(result)
+func (c *CortexClientV5) DeploySkillJson(content []byte) (*Response, error) {
+	return httpPost(c, "/v3/catalog/skills", bytes.NewReader(content))
 }
 
 //https://github.com/CognitiveScale/cortex-cli/blob/6c91a3e94442f690c0de054545b9b214a17b6929/src/client/catalog.js#L139
-func (c *CortexClientV5) DeployAgent(filepath string) string {
+func (c *CortexClientV5) DeployAgent(filepath string) (*Response, error) {
 	content, err := GetJsonContent(filepath)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 	return c.DeployAgentJson(content)
 }
 
-func (c *CortexClientV5) DeployAgentJson(content []byte) string {
-	var result, err = httpPost(c, "/v3/catalog/agents", bytes.NewReader(content))
-	if err != nil {
-		log.Fatalln(err)
-	}
-	return string(result)
+func (c *CortexClientV5) DeployAgentJson(content []byte) (*Response, error) {
+	return httpPost(c, "/v3/catalog/agents", bytes.NewReader(content))
 }
 
-func (c *CortexClientV5) DeployDatasetJson(content []byte) string {
-	var result, err = httpPost(c, "/v3/datasets", bytes.NewReader(content))
-	if err != nil {
-		log.Fatalln(err)
-	}
-	return string(result)
+func (c *CortexClientV5) DeployDatasetJson(content []byte) (*Response, error) {
+	return httpPost(c, "/v3/datasets", bytes.NewReader(content))
 }
 
-func (c *CortexClientV5) DeployTypes(filepath string) string {
+func (c *CortexClientV5) DeployTypes(filepath string) (*Response, error) {
 	content, err := GetJsonContent(filepath)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 	return c.DeployTypesJson(content)
 }
 
-func (c *CortexClientV5) DeployTypesJson(content []byte) string {
-	var result, err = httpPost(c, "/v3/catalog/types", bytes.NewReader(content))
-	if err != nil {
-		log.Fatalln(err)
-	}
-	return string(result)
+func (c *CortexClientV5) DeployTypesJson(content []byte) (*Response, error) {
+	return httpPost(c, "/v3/catalog/types", bytes.NewReader(content))
 }
 
-func (c *CortexClientV5) DeployConnection(filepath string) string {
+func (c *CortexClientV5) DeployConnection(filepath string) (*Response, error) {
 	content, err := GetJsonContent(filepath)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
+	}
+	if content, err = secret.ResolveJson(content); err != nil {
+		return nil, err
 	}
 	return c.DeployConnectionJson(content)
 }
 
-func (c *CortexClientV5) DeployConnectionJson(content []byte) string {
-	var result, err = httpPost(c, "/v2/connections", bytes.NewReader(content))
-	if err != nil {
-		log.Fatalln(err)
+func (c *CortexClientV5) DeployConnectionJson(content []byte) (*Response, error) {
+	return httpPost(c, "/v2/connections", bytes.NewReader(content))
+}
+
+// Cortex v5 API paths of resources by kind, for fetching resource by name
+var v5ResourcePaths = map[string]string{
+	KIND_ACTION:     "/v3/actions",
+	KIND_SKILL:      "/v3/catalog/skills",
+	KIND_AGENT:      "/v3/catalog/agents",
+	KIND_TYPE:       "/v3/catalog/types",
+	KIND_DATASET:    "/v3/datasets",
+	KIND_CONNECTION: "/v2/connections",
+}
+
+func (c *CortexClientV5) GetResourceJson(kind string, name string) ([]byte, error) {
+	basePath, ok := v5ResourcePaths[kind]
+	if !ok {
+		return nil, errors.New(fmt.Sprint("Fetching resource of kind ", kind, " is not supported in Cortex v5"))
 	}
-	return string(result)
+	return getResource(c, basePath+"/"+url.PathEscape(name))
+}
+
+func (c *CortexClientV5) DeleteResource(kind string, name string) (*Response, error) {
+	basePath, ok := v5ResourcePaths[kind]
+	if !ok {
+		return nil, errors.New(fmt.Sprint("Deleting resource of kind ", kind, " is not supported in Cortex v5"))
+	}
+	return httpDelete(c, basePath+"/"+url.PathEscape(name))
+}
+
+// ListResources returns names of all resources of given kind
+func (c *CortexClientV5) ListResources(kind string) ([]string, error) {
+	basePath, ok := v5ResourcePaths[kind]
+	if !ok {
+		return nil, errors.New(fmt.Sprint("Listing resources of kind ", kind, " is not supported in Cortex v5"))
+	}
+	return listResources(c, basePath)
 }
 
 //V6
@@ -268,104 +341,186 @@ func (c *CortexClientV6) GetAccount() string {
 }
 
 // TODO update V6 Docker registry logic as per updated Action deployment (when ready)
-func (c *CortexClientV6) GetDockerRegistry() string {
+func (c *CortexClientV6) GetDockerRegistry() (string, error) {
 	var result, err = httpGet(c, "/v3/actions/_config")
 	if err != nil {
-		log.Fatalln(err)
+		return "", err
 	}
-	value := gjson.Get(string(result), "config.dockerPrivateRegistryUrl").String()
-	return fmt.Sprint(value, "/", c.Project)
+	value := gjson.Get(result.String(), "config.dockerPrivateRegistryUrl").String()
+	return fmt.Sprint(value, "/", c.Project), nil
 }
 
-func (c *CortexClientV6) DeployAction(filepath string) string {
+func (c *CortexClientV6) DeployAction(filepath string) (*Response, error) {
 	content, err := GetJsonContent(filepath)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 	actionType := gjson.Get(string(content), "actionType").String()
 	return c.DeployActionJson(actionType, content)
 }
 
-func (c *CortexClientV6) DeployActionJson(actionType string, content []byte) string {
-	var result, err = httpPost(c, V6_BASE_URI+c.Project+"/actions?actionType="+actionType, bytes.NewReader(content))
-	if err != nil {
-		log.Fatalln(err)
-	}
-	return string(result)
+func (c *CortexClientV6) DeployActionJson(actionType string, content []byte) (*Response, error) {
+	return httpPost(c, V6_BASE_URI+c.Project+"/actions?actionType="+actionType, bytes.NewReader(content))
 }
 
 //https://github.com/CognitiveScale/cortex-cli/blob/6c91a3e94442f690c0de054545b9b214a17b6929/src/client/catalog.js#L42
-func (c *CortexClientV6) DeploySkill(filepath string) string {
+func (c *CortexClientV6) DeploySkill(filepath string) (*Response, error) {
 	content, err := GetJsonContent(filepath)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 	return c.DeploySkillJson(content)
 }
 
-func (c *CortexClientV6) DeploySkillJson(content []byte) string {
-	var result, err = httpPost(c, V6_BASE_URI+c.Project+"/skills", bytes.NewReader(content))
-	if err != nil {
-		log.Fatalln(err)
-	}
-	return string(result)
+func (c *CortexClientV6) DeploySkillJson(content []byte) (*Response, error) {
+	return httpPost(c, V6_BASE_URI+c.Project+"/skills", bytes.NewReader(content))
 }
 
 //https://github.com/CognitiveScale/cortex-cli/blob/6c91a3e94442f690c0de054545b9b214a17b6929/src/client/catalog.js#L139
-func (c *CortexClientV6) DeployAgent(filepath string) string {
+func (c *CortexClientV6) DeployAgent(filepath string) (*Response, error) {
 	content, err := GetJsonContent(filepath)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 	return c.DeployAgentJson(content)
 }
 
-func (c *CortexClientV6) DeployAgentJson(content []byte) string {
-	var result, err = httpPost(c, V6_BASE_URI+c.Project+"/agents", bytes.NewReader(content))
-	if err != nil {
-		log.Fatalln(err)
-	}
-	return string(result)
+func (c *CortexClientV6) DeployAgentJson(content []byte) (*Response, error) {
+	return httpPost(c, V6_BASE_URI+c.Project+"/agents", bytes.NewReader(content))
 }
 
-func (c *CortexClientV6) DeployDatasetJson(content []byte) string {
-	var result, err = httpPost(c, V6_BASE_URI+c.Project+"/datasets", bytes.NewReader(content))
+func (c *CortexClientV6) DeployDatasetJson(content []byte) (*Response, error) {
+	return httpPost(c, V6_BASE_URI+c.Project+"/datasets", bytes.NewReader(content))
+}
+
+func (c *CortexClientV6) DeployTypes(filepath string) (*Response, error) {
+	content, err := GetJsonContent(filepath)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
-	return string(result)
+	return c.DeployTypesJson(content)
 }
 
-func (c *CortexClientV6) DeployTypes(filepath string) string {
+func (c *CortexClientV6) DeployTypesJson(content []byte) (*Response, error) {
+	return httpPost(c, V6_BASE_URI+c.Project+"/types", bytes.NewReader(content))
+}
+
+func (c *CortexClientV6) DeployConnection(filepath string) (*Response, error) {
 	content, err := GetJsonContent(filepath)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
-	return c.DeployTypesJson(content)
+	if content, err = secret.ResolveJson(content); err != nil {
+		return nil, err
+	}
+	return c.DeployConnectionJson(content)
+}
+
+func (c *CortexClientV6) DeployConnectionJson(content []byte) (*Response, error) {
+	return httpPost(c, V6_BASE_URI+c.Project+"/connections", bytes.NewReader(content))
+}
+
+// Cortex v6 API paths of resources by kind (relative to project), for fetching resource by name
+var v6ResourcePaths = map[string]string{
+	KIND_ACTION:     "actions",
+	KIND_SKILL:      "skills",
+	KIND_AGENT:      "agents",
+	KIND_TYPE:       "types",
+	KIND_DATASET:    "datasets",
+	KIND_CONNECTION: "connections",
+	KIND_MODEL:      "models",
+	KIND_EXPERIMENT: "experiments",
+	KIND_CAMPAIGN:   "campaigns",
 }
 
-func (c *CortexClientV6) DeployTypesJson(content []byte) string {
-	var result, err = httpPost(c, V6_BASE_URI+c.Project+"/types", bytes.NewReader(content))
+// GetResourceJson fetches resource of given kind by name. Experiment run name is `<experiment name>/<run id>`
+func (c *CortexClientV6) GetResourceJson(kind string, name string) ([]byte, error) {
+	path, err := c.resourcePath(kind, name)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, fmt.Errorf("fetching %w", err)
 	}
-	return string(result)
+	return getResource(c, path)
 }
 
-func (c *CortexClientV6) DeployConnection(filepath string) string {
-	content, err := GetJsonContent(filepath)
+// DeleteResource deletes resource of given kind by name. Experiment run name is `<experiment name>/<run id>`
+func (c *CortexClientV6) DeleteResource(kind string, name string) (*Response, error) {
+	path, err := c.resourcePath(kind, name)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, fmt.Errorf("deleting %w", err)
 	}
-	return c.DeployConnectionJson(content)
+	return httpDelete(c, path)
 }
 
-func (c *CortexClientV6) DeployConnectionJson(content []byte) string {
-	var result, err = httpPost(c, V6_BASE_URI+c.Project+"/connections", bytes.NewReader(content))
+// ListResources returns names of all resources of given kind. Runs are listed per experiment, so listing runs is not supported
+func (c *CortexClientV6) ListResources(kind string) ([]string, error) {
+	basePath, ok := v6ResourcePaths[kind]
+	if !ok {
+		return nil, errors.New(fmt.Sprint("Listing resources of kind ", kind, " is not supported"))
+	}
+	return listResources(c, V6_BASE_URI+c.Project+"/"+basePath)
+}
+
+func (c *CortexClientV6) resourcePath(kind string, name string) (string, error) {
+	if kind == KIND_RUN {
+		experiment, runId := splitRunName(name)
+		return V6_BASE_URI + c.Project + "/experiments/" + url.PathEscape(experiment) + "/runs/" + url.PathEscape(runId), nil
+	}
+	basePath, ok := v6ResourcePaths[kind]
+	if !ok {
+		return "", errors.New(fmt.Sprint("resource of kind ", kind, " is not supported"))
+	}
+	return V6_BASE_URI + c.Project + "/" + basePath + "/" + url.PathEscape(name), nil
+}
+
+// page size for listing resources. APIs not supporting paging return all resources in first page
+const listPageSize = 100
+
+// listResources fetches names of resources page by page. List APIs return resources either as array or in a field of response like {"skills": [..]}
+func listResources(cortex CortexAPI, path string) ([]string, error) {
+	var names []string
+	seen := map[string]bool{}
+	for skip := 0; ; skip += listPageSize {
+		content, err := getResource(cortex, fmt.Sprint(path, "?limit=", listPageSize, "&skip=", skip))
+		if err != nil {
+			return nil, err
+		}
+		page := listItems(gjson.ParseBytes(content))
+		added := 0
+		for _, item := range page {
+			name := item.Get("name").String()
+			if name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+				added++
+			}
+		}
+		if len(page) < listPageSize || added == 0 {
+			return names, nil
+		}
+	}
+}
+
+func listItems(response gjson.Result) []gjson.Result {
+	if response.IsArray() {
+		return response.Array()
+	}
+	var items []gjson.Result
+	response.ForEach(func(key, value gjson.Result) bool {
+		if value.IsArray() && key.String() != "errors" {
+			items = value.Array()
+			return false
+		}
+		return true
+	})
+	return items
+}
+
+func getResource(cortex CortexAPI, path string) ([]byte, error) {
+	res, err := httpGet(cortex, path)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
-	return string(result)
+	return res.Body, nil
 }
 
 func GetJsonContent(filepath string) ([]byte, error) {
@@ -379,7 +534,7 @@ func GetJsonContent(filepath string) ([]byte, error) {
 	return content, err
 }
 
-func DeployCampaign(cortex CortexClientV6, filename string, deployable bool, overwrite bool) error {
+func DeployCampaign(cortex CortexClientV6, filename string, deployable bool, overwrite bool) (*Response, error) {
 	campaignUrl := V6_BASE_URI + cortex.Project + "/campaigns/import?deployable=" + strconv.FormatBool(deployable) + "&overwrite=" + strconv.FormatBool(overwrite)
 	bodyBuf := &bytes.Buffer{}
 	bodyWriter := multipart.NewWriter(bodyBuf)
@@ -387,43 +542,38 @@ func DeployCampaign(cortex CortexClientV6, filename string, deployable bool, ove
 	fileWriter, err := bodyWriter.CreateFormFile("file", filename)
 	if err != nil {
 		log.Println("error creating form data for file upload")
-		return err
+		return nil, err
 	}
 
 	fh, err := os.Open(filename)
 	if err != nil {
 		log.Println("error opening campaign zip file")
-		return err
+		return nil, err
 	}
 	defer fh.Close()
 
 	_, err = io.Copy(fileWriter, fh)
 	if err != nil {
 		log.Println(err)
-		return err
+		return nil, err
 	}
 
 	contentType := bodyWriter.FormDataContentType()
 	bodyWriter.Close()
 
-	resp, err := fileUpload(&cortex, campaignUrl, bodyBuf, contentType, HTTP_POST)
+	resp, err := fileUpload(&cortex, campaignUrl, bytes.NewReader(bodyBuf.Bytes()), contentType, HTTP_POST)
 	if err != nil {
-		log.Println(string(resp))
-		return err
+		return nil, err
 	}
 	var prettyJSON bytes.Buffer
-	err = json.Indent(&prettyJSON, resp, "", "    ")
+	err = json.Indent(&prettyJSON, resp.Body, "", "    ")
 	if err == nil {
 		log.Println("Campaign "+strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))+" deployment status: ", string(prettyJSON.Bytes()))
 	}
-	return err
+	return resp, err
 }
 
-func DeployModel(cortex CortexClientV6, filepath string) string {
-	content, err := GetJsonContent(filepath)
-	if err != nil {
-		log.Fatalln(err)
-	}
+func DeployModelJson(cortex CortexClientV6, content []byte) (*Response, error) {
 	model := gjson.Parse(string(content))
 	status := model.Get("status").String()
 	// models can't be created with Published status, but exported only if published. So creating without status (using default initial status) and saving again with Published status
@@ -431,38 +581,19 @@ func DeployModel(cortex CortexClientV6, filepath string) string {
 		modelBody := model.Value().(map[string]interface{})
 		modelBody["status"] = "In development"
 		initial, _ := json.Marshal(modelBody)
-		res, err := httpPost(&cortex, V6_BASE_URI+cortex.Project+"/models", bytes.NewReader(initial))
+		_, err := httpPost(&cortex, V6_BASE_URI+cortex.Project+"/models", bytes.NewReader(initial))
 		if err != nil {
-			log.Println(string(res))
-			log.Fatalln(err)
+			return nil, err
 		}
 	}
-	res, err := httpPost(&cortex, V6_BASE_URI+cortex.Project+"/models", bytes.NewReader(content))
-	if err != nil {
-		log.Println(string(res))
-		log.Fatalln(err)
-	}
-	return string(res)
+	return httpPost(&cortex, V6_BASE_URI+cortex.Project+"/models", bytes.NewReader(content))
 }
 
-func DeployExperiment(cortex CortexClientV6, filepath string) string {
-	content, err := GetJsonContent(filepath)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	res, err := httpPost(&cortex, V6_BASE_URI+cortex.Project+"/experiments", bytes.NewReader(content))
-	if err != nil {
-		log.Println(string(res))
-		log.Fatalln(err)
-	}
-	return string(res)
+func DeployExperimentJson(cortex CortexClientV6, content []byte) (*Response, error) {
+	return httpPost(&cortex, V6_BASE_URI+cortex.Project+"/experiments", bytes.NewReader(content))
 }
 
-func DeployExperimentRun(cortex CortexClientV6, filename string, repoDir string) string {
-	content, err := GetJsonContent(filename)
-	if err != nil {
-		log.Fatalln(err)
-	}
+func DeployExperimentRunJson(cortex CortexClientV6, content []byte, repoDir string) (*Response, error) {
 	run := gjson.Parse(string(content))
 	expName := run.Get("experimentName").String()
 	runId := run.Get("runId").String()
@@ -470,105 +601,77 @@ func DeployExperimentRun(cortex CortexClientV6, filename string, repoDir string)
 	path := V6_BASE_URI + cortex.Project + "/experiments/" + url.PathEscape(expName) + "/runs"
 	// experiment run is not upsert API, so deleting and inserting
 	httpDelete(&cortex, path+"/"+runId)
-	res, err := httpPost(&cortex, path, bytes.NewReader(content))
+	res, err := httpCreate(&cortex, path, bytes.NewReader(content))
 	if err != nil {
-		log.Println(string(res))
-		log.Fatalln(err)
+		return nil, err
 	}
 	if artifacts.Exists() {
 		for k, v := range artifacts.Value().(map[string]interface{}) {
 			artifactFile := filepath.Join(repoDir, ARTIFACT_DIR, v.(string))
 			body, err := os.Open(artifactFile)
 			if err != nil {
-				log.Fatal("Failed to read Model artifact file ", artifactFile)
+				return nil, fmt.Errorf("failed to read Model artifact file %s: %w", artifactFile, err)
 			}
-			msg, err := fileUpload(&cortex, path+"/"+runId+"/artifacts/"+k, body, "application/octet-stream", HTTP_PUT)
+			_, err = fileUpload(&cortex, path+"/"+runId+"/artifacts/"+k, body, "application/octet-stream", HTTP_PUT)
+			body.Close()
 			if err != nil {
-				log.Fatalln(string(msg), err)
+				return nil, err
 			}
 		}
 	}
-	return string(res)
+	return res, nil
 }
 
-// Common in v5 and v6
-func DeploySnapshot(cortex CortexAPI, filepath string, actionImageMapping map[string]string) {
-	content, err := GetJsonContent(filepath)
-	if err != nil {
-		log.Fatalln("Failed to read Cortex Agent Snapshot file ", filepath, " Error: ", err)
+// Common in v5 and v6. Returns on first failure, resources deployed before failure are reverted only if `atomic`
+func DeploySnapshot(cortex CortexAPI, filepath string, actionImageMapping map[string]string, atomic bool) error {
+	snapshot := NewResource(KIND_SNAPSHOT, filepath, filepath, "")
+	var tx *Transaction
+	if atomic {
+		tx = NewTransaction(cortex)
 	}
-	snapshot := gjson.Parse(string(content))
-	agent := snapshot.Get("agent")
-	skills := snapshot.Get("dependencies.skills")
-	actions := snapshot.Get("dependencies.actions")
-	datasets := snapshot.Get("dependencies.datasets")
-	types := snapshot.Get("dependencies.types")
-
-	types.ForEach(func(key, value gjson.Result) bool {
-		logs := cortex.DeployTypesJson([]byte(value.Raw))
-		log.Println(logs)
-		return true
-	})
-
-	datasets.ForEach(func(key, value gjson.Result) bool {
-		logs := cortex.DeployDatasetJson([]byte(value.Raw))
-		log.Println(logs)
-		return true
-	})
-
-	actions.ForEach(func(key, value gjson.Result) bool {
-		if actionImageMapping != nil {
-			action := value.Map()
-			imageName := DockerImageName(action["image"].String())
-			image := actionImageMapping[imageName]
-			if image != "" {
-				//TODO - [2nd iteration] - evaluate better JSON substitution/templating. Need to support: variable substitution in connections,
-				// support differ action config across env, ex.
-				// 	higher resource limit (or cpu in dev vs gpu in prod) in prod compare to dev (podspec json substitution)
-				//	higher scale count in prod (action config substitution)
-				updated, _ := sjson.Set(value.Raw, "image", image)
-				//parse podspec json into object before setting, for correct formatting
-				podspec := value.Get("podSpec").String()
-				var podspecDef []map[string]interface{}
-				json.Unmarshal([]byte(podspec), &podspecDef)
-				updated, _ = sjson.Set(updated, "podSpec", podspecDef)
-				value = gjson.Parse(updated)
-			} else {
-				log.Println("[IMP] Docker image ", action["image"].String(), " used by action ", action["name"].String(), " is not built in this run, make sure it exists in docker registry")
-			}
+	rollback := func(err error) error {
+		if _, rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return fmt.Errorf("%w, and rollback failed: %v", err, rollbackErr)
+		}
+		return err
+	}
+	for _, resource := range SnapshotResources(snapshot, actionImageMapping) {
+		if err := tx.Capture(resource); err != nil {
+			return rollback(err)
+		}
+		logs, err := DeployResource(cortex, resource, "")
+		if err != nil {
+			return rollback(fmt.Errorf("failed to deploy %s %s: %w", resource.Kind, resource.Name, err))
 		}
-		logs := cortex.DeployActionJson(value.Get("type").String(), []byte(value.Raw))
-		log.Println(logs)
-		return true
-	})
-
-	skills.ForEach(func(key, value gjson.Result) bool {
-		logs := cortex.DeploySkillJson([]byte(value.Raw))
 		log.Println(logs)
-		return true
-	})
+	}
+	return nil
+}
 
-	logs := cortex.DeployAgentJson([]byte(agent.Raw))
-	log.Println(logs)
+func httpGet(cortex CortexAPI, path string) (*Response, error) {
+	return do(cortex, path, HTTP_GET, nil, "application/json", true)
 }
 
-func httpGet(cortex CortexAPI, path string) ([]byte, error) {
-	return do(cortex, path, HTTP_GET, nil, "application/json")
+// httpPost is for Cortex save APIs, these are upsert and safe to retry
+func httpPost(cortex CortexAPI, path string, body io.Reader) (*Response, error) {
+	return do(cortex, path, HTTP_POST, body, "application/json", true)
 }
 
-func httpPost(cortex CortexAPI, path string, body io.Reader) ([]byte, error) {
-	return do(cortex, path, HTTP_POST, body, "application/json")
+// httpCreate is for Cortex APIs creating a new resource on each call, so not retried on gateway or network errors
+func httpCreate(cortex CortexAPI, path string, body io.Reader) (*Response, error) {
+	return do(cortex, path, HTTP_POST, body, "application/json", false)
 }
 
-func httpDelete(cortex CortexAPI, path string) ([]byte, error) {
-	return do(cortex, path, HTTP_DELETE, nil, "application/json")
+func httpDelete(cortex CortexAPI, path string) (*Response, error) {
+	return do(cortex, path, HTTP_DELETE, nil, "application/json", true)
 }
 
-func fileUpload(cortex CortexAPI, path string, body io.Reader, contentType string, method string) ([]byte, error) {
-	return do(cortex, path, method, body, contentType)
+func fileUpload(cortex CortexAPI, path string, body io.Reader, contentType string, method string) (*Response, error) {
+	return do(cortex, path, method, body, contentType, method != HTTP_POST)
 }
 
 var client *http.Client
+var clientOnce sync.Once
 
 func setupHttpClient() *http.Client {
 	config := &tls.Config{}
@@ -610,10 +713,11 @@ func setupHttpClient() *http.Client {
 
 }
 
-func do(cortex CortexAPI, path string, method string, body io.Reader, contentType string) ([]byte, error) {
+// do calls Cortex API, retrying transient failures as per retry policy. Request body must be io.Seeker to be retried
+func do(cortex CortexAPI, path string, method string, body io.Reader, contentType string, idempotent bool) (*Response, error) {
 	serviceUrl, err := url.Parse(cortex.GetURL() + path)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 	request := &http.Request{
 		URL:    serviceUrl,
@@ -623,28 +727,53 @@ func do(cortex CortexAPI, path string, method string, body io.Reader, contentTyp
 			"Authorization": {fmt.Sprint("Bearer ", cortex.GetToken())},
 		},
 	}
-	if body != nil {
-		request.Body = ioutil.NopCloser(body)
-	}
-	//lazy initialize
-	if client == nil {
+	bodySeeker, seekable := body.(io.Seeker)
+	//lazy initialize, once for concurrent calls
+	clientOnce.Do(func() {
 		client = setupHttpClient()
+	})
+	atomic.AddInt64(&requestCount, 1)
+	for attempt := 0; ; attempt++ {
+		if body != nil {
+			if attempt > 0 {
+				bodySeeker.Seek(0, io.SeekStart)
+			}
+			request.Body = ioutil.NopCloser(body)
+		}
+		response, e := client.Do(request)
+		retry, reason, wait := retryDecision(attempt, idempotent, response, e)
+		retry = retry && (body == nil || seekable)
+		if retry {
+			if response != nil {
+				io.Copy(ioutil.Discard, response.Body)
+				response.Body.Close()
+				log.Println("[RETRY]", method, serviceUrl.String(), "failed with status", response.StatusCode, ". Retrying in", wait.Round(time.Millisecond), "attempt", attempt+1, "of", retryPolicy.MaxRetries)
+			} else {
+				log.Println("[RETRY]", method, serviceUrl.String(), "failed with", e, ". Retrying in", wait.Round(time.Millisecond), "attempt", attempt+1, "of", retryPolicy.MaxRetries)
+			}
+			recordRetry(attempt, reason)
+			time.Sleep(wait)
+			continue
+		}
+		if e != nil {
+			//errors like connection refused, address not found etc
+			recordAttempts(attempt, false)
+			return nil, e
+		}
+		defer response.Body.Close()
+		var data, _ = ioutil.ReadAll(response.Body)
+		if response.StatusCode > 201 {
+			recordAttempts(attempt, false)
+			return nil, &ResponseError{Method: method, URL: serviceUrl.String(), StatusCode: response.StatusCode, Message: parseErrorMessage(data), Body: data}
+		}
+		recordAttempts(attempt, true)
+		return &Response{StatusCode: response.StatusCode, Body: data}, nil
 	}
-	response, e := client.Do(request)
-	if e != nil {
-		//errors like connection refused, address not found etc
-		return nil, e
-	}
-	var data, _ = ioutil.ReadAll(response.Body)
-	if response.StatusCode > 201 {
-		e = errors.New(fmt.Sprint("URL ", serviceUrl.String(), " failed with status ", response.StatusCode, " Error: ", string(data)))
-	}
-	defer response.Body.Close()
-	return data, e
 }
 
+// DockerImageName returns name of image without registry, namespace, tag and digest
 func DockerImageName(dockerTag string) string {
-	splits := strings.Split(dockerTag, "/")
+	splits := strings.Split(strings.Split(dockerTag, "@")[0], "/")
 	return strings.Split(splits[len(splits)-1], ":")[0]
 }
 
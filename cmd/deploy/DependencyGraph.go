@@ -0,0 +1,343 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"log"
+	"sort"
+	"strings"
+)
+
+// DependencyGraph of resources in manifest, from `_dependencies` in manifest and references in resources (agent -> skills -> actions & connections, run -> experiment -> model)
+type DependencyGraph struct {
+	Resources    []Resource
+	Dependencies [][]int // indexes of resources each resource depends on
+	Missing      []MissingDependency
+}
+
+// MissingDependency is a reference to resource not in manifest. Declared dependency (in `_dependencies`) must be in manifest,
+// others are expected to exist in Cortex project
+type MissingDependency struct {
+	Resource  Resource
+	Reference string
+	Declared  bool
+}
+
+func (m MissingDependency) String() string {
+	if m.Resource.Kind == "" {
+		return m.Reference
+	}
+	return fmt.Sprint(m.Resource.Kind, " ", m.Resource.Name, " (", m.Resource.Source, ") depends on ", m.Reference)
+}
+
+// NewDependencyGraph builds graph from declared dependencies as map of resource reference to list of references.
+// Reference is either resource file path as in manifest, `<kind>/<name>` or name of resource
+func NewDependencyGraph(resources []Resource, declared map[string]interface{}) *DependencyGraph {
+	graph := &DependencyGraph{Resources: resources, Dependencies: make([][]int, len(resources))}
+	campaigns := map[string]int{}
+	for i, resource := range resources {
+		if resource.Kind == KIND_CAMPAIGN {
+			campaigns[resource.Name] = i
+		}
+	}
+
+	for i, resource := range resources {
+		// resources in campaign are deployed by campaign import
+		if resource.Campaign != "" {
+			if campaign, ok := campaigns[resource.Campaign]; ok {
+				graph.addDependency(i, campaign)
+			}
+		}
+		for _, reference := range ResourceReferences(resource) {
+			dependencies := graph.resolve(reference)
+			if len(dependencies) == 0 {
+				graph.Missing = append(graph.Missing, MissingDependency{Resource: resource, Reference: reference})
+			}
+			for _, dependency := range dependencies {
+				graph.addDependency(i, dependency)
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(declared))
+	for key := range declared {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		dependents := graph.resolve(key)
+		references := declaredReferences(declared[key])
+		if len(dependents) == 0 {
+			graph.Missing = append(graph.Missing, MissingDependency{Reference: key, Declared: true})
+			continue
+		}
+		for _, reference := range references {
+			dependencies := graph.resolve(reference)
+			for _, dependent := range dependents {
+				if len(dependencies) == 0 {
+					graph.Missing = append(graph.Missing, MissingDependency{Resource: resources[dependent], Reference: reference, Declared: true})
+				}
+				for _, dependency := range dependencies {
+					graph.addDependency(dependent, dependency)
+				}
+			}
+		}
+	}
+	return graph
+}
+
+// ResourceReferences returns `<kind>/<name>` of resources referenced in resource definition
+func ResourceReferences(resource Resource) []string {
+	content := gjson.ParseBytes(resource.Content)
+	var references []string
+	switch resource.Kind {
+	case KIND_AGENT:
+		content.Get("skills").ForEach(func(_, skill gjson.Result) bool {
+			if name := skill.Get("skillName").String(); name != "" {
+				references = append(references, KIND_SKILL+"/"+name)
+			}
+			return true
+		})
+	case KIND_SKILL:
+		content.Get("actions").ForEach(func(_, action gjson.Result) bool {
+			if name := action.Get("name").String(); name != "" {
+				references = append(references, KIND_ACTION+"/"+name)
+			}
+			return true
+		})
+		content.Get("properties").ForEach(func(_, property gjson.Result) bool {
+			if strings.EqualFold(property.Get("type").String(), "connection") && property.Get("defaultValue").String() != "" {
+				references = append(references, KIND_CONNECTION+"/"+property.Get("defaultValue").String())
+			}
+			return true
+		})
+	case KIND_EXPERIMENT:
+		if model := content.Get("modelId").String(); model != "" {
+			references = append(references, KIND_MODEL+"/"+model)
+		}
+	case KIND_RUN:
+		if experiment := content.Get("experimentName").String(); experiment != "" {
+			references = append(references, KIND_EXPERIMENT+"/"+experiment)
+		}
+	}
+	return references
+}
+
+func declaredReferences(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var references []string
+		for _, item := range v {
+			references = append(references, declaredReferences(item)...)
+		}
+		return references
+	case map[interface{}]interface{}:
+		// kind to list of names
+		var references []string
+		for kind, names := range v {
+			for _, name := range declaredReferences(names) {
+				references = append(references, fmt.Sprint(kind, "/", name))
+			}
+		}
+		sort.Strings(references)
+		return references
+	}
+	return nil
+}
+
+// resolve returns indexes of resources matching reference by path, `<kind>/<name>` or name
+func (g *DependencyGraph) resolve(reference string) []int {
+	normalized := strings.ReplaceAll(reference, "\\", "/")
+	var byPath, byKindName, byName []int
+	for i, resource := range g.Resources {
+		switch {
+		case strings.ReplaceAll(resource.Source, "\\", "/") == normalized:
+			byPath = append(byPath, i)
+		case resource.Kind+"/"+resource.Name == reference || resource.Kind == KIND_TYPE && hasTypeName(resource, reference):
+			byKindName = append(byKindName, i)
+		case resource.Name == reference:
+			byName = append(byName, i)
+		}
+	}
+	if len(byPath) > 0 {
+		return byPath
+	}
+	if len(byKindName) > 0 {
+		return byKindName
+	}
+	return byName
+}
+
+func hasTypeName(resource Resource, reference string) bool {
+	for _, name := range strings.Split(resource.Name, ",") {
+		if KIND_TYPE+"/"+name == reference {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *DependencyGraph) addDependency(dependent int, dependency int) {
+	if dependent == dependency {
+		return
+	}
+	for _, existing := range g.Dependencies[dependent] {
+		if existing == dependency {
+			return
+		}
+	}
+	g.Dependencies[dependent] = append(g.Dependencies[dependent], dependency)
+}
+
+// Sort returns graph with resources in topological order. Independent resources keep their order in manifest (kind order of deployment).
+// Returns error listing resources in a cycle, if any
+func (g *DependencyGraph) Sort() (*DependencyGraph, error) {
+	remaining := make([]int, len(g.Resources))
+	for i, dependencies := range g.Dependencies {
+		remaining[i] = len(dependencies)
+	}
+	dependents := g.dependents()
+
+	order := make([]int, 0, len(g.Resources))
+	position := make([]int, len(g.Resources))
+	done := make([]bool, len(g.Resources))
+	for len(order) < len(g.Resources) {
+		next := -1
+		for i := range g.Resources {
+			if !done[i] && remaining[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			return nil, errors.New("Dependency cycle: " + g.describeCycle(done))
+		}
+		done[next] = true
+		position[next] = len(order)
+		order = append(order, next)
+		for _, dependent := range dependents[next] {
+			remaining[dependent]--
+		}
+	}
+
+	sorted := &DependencyGraph{Resources: make([]Resource, len(order)), Dependencies: make([][]int, len(order)), Missing: g.Missing}
+	for i, index := range order {
+		sorted.Resources[i] = g.Resources[index]
+		for _, dependency := range g.Dependencies[index] {
+			sorted.Dependencies[i] = append(sorted.Dependencies[i], position[dependency])
+		}
+	}
+	return sorted, nil
+}
+
+func (g *DependencyGraph) dependents() [][]int {
+	dependents := make([][]int, len(g.Resources))
+	for i, dependencies := range g.Dependencies {
+		for _, dependency := range dependencies {
+			dependents[dependency] = append(dependents[dependency], i)
+		}
+	}
+	return dependents
+}
+
+// Walk calls visit for each resource, after all its dependencies are visited successfully, running up to `concurrency` visits at the same time.
+// Resources depending on a failed resource are not visited. Unless keepGoing, no more resources are visited after a failure.
+// Returns which resources were visited
+func (g *DependencyGraph) Walk(concurrency int, keepGoing bool, visit func(index int) error) []bool {
+	type outcome struct {
+		index int
+		err   error
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	remaining := make([]int, len(g.Resources))
+	var ready []int
+	for i, dependencies := range g.Dependencies {
+		remaining[i] = len(dependencies)
+		if remaining[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+	dependents := g.dependents()
+	visited := make([]bool, len(g.Resources))
+	outcomes := make(chan outcome)
+	running := 0
+	stopped := false
+	for {
+		for running < concurrency && len(ready) > 0 && !stopped {
+			next := ready[0]
+			ready = ready[1:]
+			visited[next] = true
+			running++
+			go func(index int) {
+				outcomes <- outcome{index: index, err: visit(index)}
+			}(next)
+		}
+		if running == 0 {
+			return visited
+		}
+		result := <-outcomes
+		running--
+		if result.err != nil {
+			stopped = !keepGoing
+			continue
+		}
+		for _, dependent := range dependents[result.index] {
+			remaining[dependent]--
+			if remaining[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+		// keep manifest order among ready resources
+		sort.Ints(ready)
+	}
+}
+
+// describeCycle follows dependencies from a resource not yet sorted until a resource repeats
+func (g *DependencyGraph) describeCycle(done []bool) string {
+	start := 0
+	for done[start] {
+		start++
+	}
+	visited := map[int]int{}
+	var path []int
+	for current := start; ; {
+		if position, ok := visited[current]; ok {
+			path = append(path[position:], current)
+			break
+		}
+		visited[current] = len(path)
+		path = append(path, current)
+		for _, dependency := range g.Dependencies[current] {
+			if !done[dependency] {
+				current = dependency
+				break
+			}
+		}
+	}
+	names := make([]string, len(path))
+	for i, index := range path {
+		names[i] = g.Resources[index].Kind + "/" + g.Resources[index].Name
+	}
+	return strings.Join(names, " -> ")
+}
+
+// LogMissing logs missing dependencies and returns error if any declared dependency is missing
+func (g *DependencyGraph) LogMissing() error {
+	var declared []string
+	for _, missing := range g.Missing {
+		if missing.Declared {
+			declared = append(declared, missing.String())
+		} else {
+			log.Println("[WARN]", missing, "not in manifest, make sure it exists in Cortex project")
+		}
+	}
+	if len(declared) > 0 {
+		return errors.New("Dependencies declared in manifest not found: " + strings.Join(declared, "; "))
+	}
+	return nil
+}
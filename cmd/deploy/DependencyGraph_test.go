@@ -0,0 +1,261 @@
+package deploy
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testResource(kind string, source string, content string) Resource {
+	return Resource{Kind: kind, Source: source, Path: source, Content: []byte(content), Name: ResourceName(kind, []byte(content))}
+}
+
+func resourceNames(graph *DependencyGraph) []string {
+	names := make([]string, len(graph.Resources))
+	for i, resource := range graph.Resources {
+		names[i] = resource.Kind + "/" + resource.Name
+	}
+	return names
+}
+
+func TestSortSnapshotDependencies(t *testing.T) {
+	snapshot := testResource(KIND_SNAPSHOT, "snapshots/agent.json", `{
+		"agent": {"name": "agent", "skills": [{"skillName": "listed"}, {"skillName": "bundled"}]},
+		"dependencies": {
+			"types": [{"name": "profile"}],
+			"actions": [{"name": "scorer", "image": "scorer:1"}],
+			"skills": [{"name": "bundled", "actions": [{"name": "scorer"}]}]
+		}
+	}`)
+	// skill listed in manifest before snapshot uses action and connection in snapshot or later in manifest
+	resources := []Resource{
+		testResource(KIND_SKILL, "skills/listed.json", `{"name": "listed", "actions": [{"name": "scorer"}], "properties": [{"name": "db", "type": "Connection", "defaultValue": "mongo"}]}`),
+	}
+	resources = append(resources, SnapshotResources(snapshot, nil)...)
+	resources = append(resources, testResource(KIND_CONNECTION, "connections/mongo.json", `{"name": "mongo"}`))
+
+	graph := NewDependencyGraph(resources, nil)
+	if len(graph.Missing) != 0 {
+		t.Fatalf("missing dependencies = %v", graph.Missing)
+	}
+	sorted, err := graph.Sort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"type/profile", "action/scorer", "skill/bundled", "connection/mongo", "skill/listed", "agent/agent"}
+	if got := resourceNames(sorted); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("sorted = %v, want %v", got, want)
+	}
+	// dependencies are indexes in sorted graph
+	for i, dependencies := range sorted.Dependencies {
+		for _, dependency := range dependencies {
+			if dependency >= i {
+				t.Errorf("%s depends on %s sorted after it", want[i], want[dependency])
+			}
+		}
+	}
+}
+
+func TestSortDeclaredDependencies(t *testing.T) {
+	resources := []Resource{
+		testResource(KIND_ACTION, "actions/loader.json", `{"name": "loader"}`),
+		testResource(KIND_SKILL, "skills/report.json", `{"name": "report"}`),
+		testResource(KIND_TYPE, "types/all.json", `{"types": [{"name": "customer"}, {"name": "order"}]}`),
+		testResource(KIND_CONNECTION, "connections/db.json", `{"name": "db"}`),
+	}
+	// manifest dependencies by path, name and kind to names, referring type in multi-type file
+	declared := map[string]interface{}{
+		"actions/loader.json": "connection/db",
+		"report":              map[interface{}]interface{}{"type": []interface{}{"order"}, "action": "loader"},
+	}
+	graph := NewDependencyGraph(resources, declared)
+	if err := graph.LogMissing(); err != nil {
+		t.Fatal(err)
+	}
+	sorted, err := graph.Sort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"type/customer,order", "connection/db", "action/loader", "skill/report"}
+	if got := resourceNames(sorted); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("sorted = %v, want %v", got, want)
+	}
+}
+
+func TestLogMissing(t *testing.T) {
+	resources := []Resource{
+		testResource(KIND_SKILL, "skills/report.json", `{"name": "report", "actions": [{"name": "existing"}]}`),
+		testResource(KIND_ACTION, "actions/loader.json", `{"name": "loader"}`),
+	}
+
+	// referenced resource may exist in Cortex project, so it is only logged
+	graph := NewDependencyGraph(resources, nil)
+	if len(graph.Missing) != 1 || graph.Missing[0].Reference != "action/existing" || graph.Missing[0].Declared {
+		t.Fatalf("missing = %v, want undeclared action/existing", graph.Missing)
+	}
+	if err := graph.LogMissing(); err != nil {
+		t.Fatalf("LogMissing = %v, want no error for undeclared dependency", err)
+	}
+	if _, err := graph.Sort(); err != nil {
+		t.Fatal(err)
+	}
+
+	graph = NewDependencyGraph(resources, map[string]interface{}{
+		"action/loader":    "connection/db",
+		"skills/none.json": "loader",
+	})
+	err := graph.LogMissing()
+	if err == nil {
+		t.Fatal("LogMissing of missing declared dependency succeeded")
+	}
+	for _, want := range []string{"action loader (actions/loader.json) depends on connection/db", "skills/none.json"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("LogMissing = %v, want %q", err, want)
+		}
+	}
+}
+
+func TestSortCycle(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources []Resource
+		declared  map[string]interface{}
+		wantCycle string
+	}{
+		{
+			name: "2 resources",
+			resources: []Resource{
+				testResource(KIND_ACTION, "actions/a.json", `{"name": "a"}`),
+				testResource(KIND_ACTION, "actions/b.json", `{"name": "b"}`),
+			},
+			declared:  map[string]interface{}{"action/a": "action/b", "action/b": "action/a"},
+			wantCycle: "action/a -> action/b -> action/a",
+		},
+		{
+			// agent depends on cycle but is not part of it
+			name: "3 resources",
+			resources: []Resource{
+				testResource(KIND_AGENT, "agents/agent.json", `{"name": "agent", "skills": [{"skillName": "s"}]}`),
+				testResource(KIND_CONNECTION, "connections/c.json", `{"name": "c"}`),
+				testResource(KIND_SKILL, "skills/s.json", `{"name": "s", "actions": [{"name": "a"}]}`),
+				testResource(KIND_ACTION, "actions/a.json", `{"name": "a"}`),
+				testResource(KIND_TYPE, "types/t.json", `{"name": "t"}`),
+			},
+			declared:  map[string]interface{}{"action/a": "connection/c", "connection/c": "skill/s"},
+			wantCycle: "skill/s -> action/a -> connection/c -> skill/s",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			graph := NewDependencyGraph(test.resources, test.declared)
+			if err := graph.LogMissing(); err != nil {
+				t.Fatal(err)
+			}
+			_, err := graph.Sort()
+			if err == nil || err.Error() != "Dependency cycle: "+test.wantCycle {
+				t.Fatalf("Sort error = %v, want cycle %s", err, test.wantCycle)
+			}
+		})
+	}
+}
+
+// walkGraph returns graph of resources a..f, where d depends on a and b, e on d and f on c
+func walkGraph() *DependencyGraph {
+	var resources []Resource
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		resources = append(resources, testResource(KIND_ACTION, "actions/"+name+".json", `{"name": "`+name+`"}`))
+	}
+	return &DependencyGraph{Resources: resources, Dependencies: [][]int{nil, nil, nil, {0, 1}, {3}, {2}}}
+}
+
+func TestWalkConcurrently(t *testing.T) {
+	graph := walkGraph()
+	var mutex sync.Mutex
+	done := make([]bool, len(graph.Resources))
+	running, maxRunning := 0, 0
+	// a and b wait for each other, so they must run at the same time
+	started := map[int]chan struct{}{0: make(chan struct{}), 1: make(chan struct{})}
+	visited := graph.Walk(3, false, func(index int) error {
+		mutex.Lock()
+		for _, dependency := range graph.Dependencies[index] {
+			if !done[dependency] {
+				t.Errorf("%s visited before its dependency %s", graph.Resources[index].Name, graph.Resources[dependency].Name)
+			}
+		}
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+
+		if own, ok := started[index]; ok {
+			close(own)
+			select {
+			case <-started[1-index]:
+			case <-time.After(5 * time.Second):
+				t.Errorf("%s not visited at the same time as independent resource", graph.Resources[index].Name)
+			}
+		}
+
+		mutex.Lock()
+		running--
+		done[index] = true
+		mutex.Unlock()
+		return nil
+	})
+	for i, ok := range visited {
+		if !ok || !done[i] {
+			t.Errorf("%s not visited", graph.Resources[i].Name)
+		}
+	}
+	if maxRunning < 2 || maxRunning > 3 {
+		t.Errorf("max visits at the same time = %d, want 2 to 3", maxRunning)
+	}
+}
+
+func TestWalkSkipsDependentsOfFailure(t *testing.T) {
+	tests := []struct {
+		name        string
+		concurrency int
+		keepGoing   bool
+		wantVisited string
+	}{
+		// dependents of a (d, e) are skipped, others are visited
+		{name: "keep going", concurrency: 1, keepGoing: true, wantVisited: "a b c f"},
+		{name: "keep going concurrently", concurrency: 4, keepGoing: true, wantVisited: "a b c f"},
+		// nothing is visited after failure of a, which is visited first
+		{name: "stop", concurrency: 1, keepGoing: false, wantVisited: "a"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			graph := walkGraph()
+			var mutex sync.Mutex
+			var calls []string
+			visited := graph.Walk(test.concurrency, test.keepGoing, func(index int) error {
+				mutex.Lock()
+				defer mutex.Unlock()
+				calls = append(calls, graph.Resources[index].Name)
+				if index == 0 {
+					return errors.New("failed")
+				}
+				return nil
+			})
+			var got []string
+			for i, ok := range visited {
+				if ok {
+					got = append(got, graph.Resources[i].Name)
+				}
+			}
+			if strings.Join(got, " ") != test.wantVisited {
+				t.Errorf("visited = %v, want %s", got, test.wantVisited)
+			}
+			sort.Strings(calls)
+			if strings.Join(calls, " ") != test.wantVisited {
+				t.Errorf("visit called for %v, want %s", calls, test.wantVisited)
+			}
+		})
+	}
+}
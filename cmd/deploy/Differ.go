@@ -0,0 +1,184 @@
+package deploy
+
+import (
+	"encoding/json"
+	"fabric-ops/cmd/secret"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"reflect"
+	"sort"
+)
+
+const (
+	DIFF_ADDED   = "+" // only in repo
+	DIFF_REMOVED = "-" // only in Cortex
+	DIFF_CHANGED = "~"
+)
+
+// Difference is a field having different value in repo and in Cortex
+type Difference struct {
+	Op    string
+	Path  string
+	Local interface{}
+	Live  interface{}
+}
+
+// ResourceDiff is difference between resource definition in repo and live resource in Cortex project
+type ResourceDiff struct {
+	Kind        string
+	Name        string
+	Source      string
+	Missing     bool // resource doesn't exist in Cortex project
+	Differences []Difference
+}
+
+// DiffResource fetches live definitions of resource from Cortex and compares ignoring server managed fields.
+// Types file may have multiple types, so a diff is returned for each definition in resource
+func DiffResource(cortex CortexAPI, resource Resource) ([]ResourceDiff, error) {
+	definitions := []gjson.Result{gjson.ParseBytes(resource.Content)}
+	if resource.Kind == KIND_TYPE {
+		definitions = TypeDefinitions(resource.Content)
+	}
+	var diffs []ResourceDiff
+	for _, definition := range definitions {
+		diff := ResourceDiff{Kind: resource.Kind, Name: ResourceName(resource.Kind, []byte(definition.Raw)), Source: resource.Source}
+		live, err := cortex.GetResourceJson(resource.Kind, diff.Name)
+		if IsNotFound(err) {
+			diff.Missing = true
+		} else if err != nil {
+			return diffs, err
+		} else {
+			diff.Differences = DiffJson(NormalizeJson([]byte(definition.Raw)), NormalizeJson(UnwrapResource(resource.Kind, live)), "")
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs, nil
+}
+
+// DiffJson returns structural differences of parsed JSON values. Arrays of objects with unique `name` are matched by name, other arrays by index
+func DiffJson(local interface{}, live interface{}, path string) []Difference {
+	switch localValue := local.(type) {
+	case map[string]interface{}:
+		if liveValue, ok := live.(map[string]interface{}); ok {
+			return diffObjects(localValue, liveValue, path)
+		}
+	case []interface{}:
+		if liveValue, ok := live.([]interface{}); ok {
+			return diffArrays(localValue, liveValue, path)
+		}
+	}
+	if reflect.DeepEqual(local, live) {
+		return nil
+	}
+	// secret values are resolved only on deployment, so can't be compared
+	if localValue, ok := local.(string); ok && secret.IsReference(localValue) {
+		return nil
+	}
+	return []Difference{{Op: DIFF_CHANGED, Path: pathOrRoot(path), Local: local, Live: live}}
+}
+
+func diffObjects(local map[string]interface{}, live map[string]interface{}, path string) []Difference {
+	keys := map[string]bool{}
+	for key := range local {
+		keys[key] = true
+	}
+	for key := range live {
+		keys[key] = true
+	}
+	sortedKeys := make([]string, 0, len(keys))
+	for key := range keys {
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Strings(sortedKeys)
+
+	var diffs []Difference
+	for _, key := range sortedKeys {
+		localValue, inLocal := local[key]
+		liveValue, inLive := live[key]
+		fieldPath := joinPath(path, key)
+		if !inLive {
+			diffs = append(diffs, Difference{Op: DIFF_ADDED, Path: fieldPath, Local: localValue})
+		} else if !inLocal {
+			diffs = append(diffs, Difference{Op: DIFF_REMOVED, Path: fieldPath, Live: liveValue})
+		} else {
+			diffs = append(diffs, DiffJson(localValue, liveValue, fieldPath)...)
+		}
+	}
+	return diffs
+}
+
+func diffArrays(local []interface{}, live []interface{}, path string) []Difference {
+	localByName, localNames := namedItems(local)
+	liveByName, liveNames := namedItems(live)
+	if localByName == nil || liveByName == nil {
+		var diffs []Difference
+		for i := 0; i < len(local) || i < len(live); i++ {
+			itemPath := fmt.Sprint(path, "[", i, "]")
+			if i >= len(live) {
+				diffs = append(diffs, Difference{Op: DIFF_ADDED, Path: itemPath, Local: local[i]})
+			} else if i >= len(local) {
+				diffs = append(diffs, Difference{Op: DIFF_REMOVED, Path: itemPath, Live: live[i]})
+			} else {
+				diffs = append(diffs, DiffJson(local[i], live[i], itemPath)...)
+			}
+		}
+		return diffs
+	}
+
+	var diffs []Difference
+	for _, name := range localNames {
+		itemPath := fmt.Sprint(path, "[name=", name, "]")
+		if liveItem, ok := liveByName[name]; ok {
+			diffs = append(diffs, DiffJson(localByName[name], liveItem, itemPath)...)
+		} else {
+			diffs = append(diffs, Difference{Op: DIFF_ADDED, Path: itemPath, Local: localByName[name]})
+		}
+	}
+	for _, name := range liveNames {
+		if _, ok := localByName[name]; !ok {
+			diffs = append(diffs, Difference{Op: DIFF_REMOVED, Path: fmt.Sprint(path, "[name=", name, "]"), Live: liveByName[name]})
+		}
+	}
+	return diffs
+}
+
+// namedItems indexes array items by `name`, only if all items are objects with unique name
+func namedItems(items []interface{}) (map[string]interface{}, []string) {
+	if len(items) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	byName := map[string]interface{}{}
+	var names []string
+	for _, item := range items {
+		object, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		name, ok := object["name"].(string)
+		if !ok || byName[name] != nil {
+			return nil, nil
+		}
+		byName[name] = item
+		names = append(names, name)
+	}
+	return byName, names
+}
+
+func (d Difference) String() string {
+	switch d.Op {
+	case DIFF_ADDED:
+		return fmt.Sprint(d.Op, " ", d.Path, ": ", jsonString(d.Local))
+	case DIFF_REMOVED:
+		return fmt.Sprint(d.Op, " ", d.Path, ": ", jsonString(d.Live))
+	default:
+		return fmt.Sprint(d.Op, " ", d.Path, ": ", jsonString(d.Live), " => ", jsonString(d.Local))
+	}
+}
+
+func jsonString(value interface{}) string {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(content)
+}
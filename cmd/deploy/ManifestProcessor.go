@@ -1,30 +1,61 @@
 package deploy
 
 import (
+	"errors"
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"log"
+	"os"
+	"regexp"
+	"strings"
 )
 
 type Manifest struct {
 	Cortex struct {
-		Agent     []string
-		Skill     []string
-		Action    []string
-		Snapshots []string
-		Type      []string
+		Agent     []string `yaml:"agent,omitempty"`
+		Skill     []string `yaml:"skill,omitempty"`
+		Action    []string `yaml:"action,omitempty"`
+		Snapshots []string `yaml:"snapshots,omitempty"`
+		Type      []string `yaml:"type,omitempty"`
 
-		Experiment []string
-		Model      []string
-		Run        []string
+		Experiment []string `yaml:"experiment,omitempty"`
+		Model      []string `yaml:"model,omitempty"`
+		Run        []string `yaml:"run,omitempty"`
 
-		Connection []string
-		Campaign   []string
+		Connection []string `yaml:"connection,omitempty"`
+		Campaign   []string `yaml:"campaign,omitempty"`
 
-		Dependencies map[string]interface{} `yaml:"_dependencies"`
-	} `yaml: "cortex"`
+		Dependencies map[string]interface{} `yaml:"_dependencies,omitempty"`
+	} `yaml:"cortex"`
+	added []manifestEntry // entries added since manifest was read, written by Save
 }
 
+// manifestEntry is path of resource under key (like `snapshots`) of `cortex` in manifest
+type manifestEntry struct {
+	Key  string
+	Path string
+}
+
+// manifest keys of resource kinds, as in yaml tags of Manifest
+var manifestKeys = map[string]string{
+	KIND_AGENT:      "agent",
+	KIND_SKILL:      "skill",
+	KIND_ACTION:     "action",
+	KIND_SNAPSHOT:   "snapshots",
+	KIND_TYPE:       "type",
+	KIND_EXPERIMENT: "experiment",
+	KIND_MODEL:      "model",
+	KIND_RUN:        "run",
+	KIND_CONNECTION: "connection",
+	KIND_CAMPAIGN:   "campaign",
+}
+
+var (
+	yamlKeyRegex      = regexp.MustCompile(`^(\s*)([A-Za-z0-9_]+)\s*:\s*(.*?)\s*$`)
+	yamlListItemRegex = regexp.MustCompile(`^(\s*)-(\s|$)`)
+)
+
 func NewManifest(configPath string) Manifest {
 	yamlFile, err := ioutil.ReadFile(configPath)
 	if err != nil {
@@ -38,3 +69,165 @@ func NewManifest(configPath string) Manifest {
 	}
 	return manifest
 }
+
+// Add adds path of resource to manifest, if not already added
+func (m *Manifest) Add(kind string, path string) {
+	var paths *[]string
+	switch kind {
+	case KIND_AGENT:
+		paths = &m.Cortex.Agent
+	case KIND_SKILL:
+		paths = &m.Cortex.Skill
+	case KIND_ACTION:
+		paths = &m.Cortex.Action
+	case KIND_SNAPSHOT:
+		paths = &m.Cortex.Snapshots
+	case KIND_TYPE:
+		paths = &m.Cortex.Type
+	case KIND_EXPERIMENT:
+		paths = &m.Cortex.Experiment
+	case KIND_MODEL:
+		paths = &m.Cortex.Model
+	case KIND_RUN:
+		paths = &m.Cortex.Run
+	case KIND_CONNECTION:
+		paths = &m.Cortex.Connection
+	case KIND_CAMPAIGN:
+		paths = &m.Cortex.Campaign
+	default:
+		log.Fatalln("Resource kind ", kind, " is not supported in manifest")
+	}
+	for _, existing := range *paths {
+		if existing == path {
+			return
+		}
+	}
+	*paths = append(*paths, path)
+	m.added = append(m.added, manifestEntry{Key: manifestKeys[kind], Path: path})
+}
+
+// Save writes manifest to file. Existing manifest file is edited in place, adding entries added since it was read under their keys,
+// so comments, formatting and keys not known to fabric are kept
+func (m *Manifest) Save(configPath string) error {
+	existing, err := ioutil.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		content, err := yaml.Marshal(m)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(configPath, content, 0644)
+	} else if err != nil {
+		return err
+	}
+	// keep line endings of manifest, CRLF if edited on Windows
+	newline := "\n"
+	if strings.Contains(string(existing), "\r\n") {
+		newline = "\r\n"
+	}
+	lines := strings.Split(strings.TrimRight(string(existing), "\r\n"), newline)
+	for _, entry := range m.added {
+		if lines, err = addManifestEntry(lines, entry); err != nil {
+			return fmt.Errorf("failed to add %s to manifest %s: %w", entry.Path, configPath, err)
+		}
+	}
+	return ioutil.WriteFile(configPath, []byte(strings.Join(lines, newline)+newline), 0644)
+}
+
+// addManifestEntry adds path to list under key of `cortex` in manifest lines, after its last item. Key (and `cortex`) is added if missing
+func addManifestEntry(lines []string, entry manifestEntry) ([]string, error) {
+	value, err := yaml.Marshal(entry.Path)
+	if err != nil {
+		return nil, err
+	}
+	item := "- " + strings.TrimSpace(string(value))
+	insert := func(at int, added ...string) []string {
+		return append(lines[:at], append(added, lines[at:]...)...)
+	}
+
+	cortex, cortexEnd := yamlBlock(lines, -1, "cortex")
+	if cortex < 0 {
+		return append(lines, "cortex:", "  "+entry.Key+":", "    "+item), nil
+	}
+	if rest := yamlKeyRegex.FindStringSubmatch(lines[cortex])[3]; rest != "" && !strings.HasPrefix(rest, "#") {
+		return nil, errors.New("cortex is not in block style")
+	}
+	key, keyEnd := yamlBlock(lines[:cortexEnd], cortex, entry.Key)
+	if key < 0 {
+		indent := "  "
+		for _, line := range lines[cortex+1 : cortexEnd] {
+			if match := yamlKeyRegex.FindStringSubmatch(line); match != nil {
+				indent = match[1]
+				break
+			}
+		}
+		return insert(lastContentLine(lines, cortex, cortexEnd)+1, indent+entry.Key+":", indent+"  "+item), nil
+	}
+	keyIndent := yamlKeyRegex.FindStringSubmatch(lines[key])[1]
+	switch rest := yamlKeyRegex.FindStringSubmatch(lines[key])[3]; {
+	case rest == "[]":
+		lines[key] = keyIndent + entry.Key + ":"
+	case rest != "" && !strings.HasPrefix(rest, "#"):
+		return nil, errors.New(fmt.Sprint("list ", entry.Key, " is not in block style"))
+	}
+	indent := keyIndent + "  "
+	for _, line := range lines[key+1 : keyEnd] {
+		if match := yamlListItemRegex.FindStringSubmatch(line); match != nil {
+			indent = match[1]
+			break
+		}
+	}
+	return insert(lastContentLine(lines, key, keyEnd)+1, indent+item), nil
+}
+
+// yamlBlock finds key in block of parent line (-1 for top level), returning index of key line and end of its block (or of parent block if key isn't found).
+// Index is -1 if key isn't found. List items may be at same indentation as their key
+func yamlBlock(lines []string, parent int, key string) (int, int) {
+	parentIndent := -1
+	if parent >= 0 {
+		parentIndent = indentation(lines[parent])
+	}
+	childIndent := -1
+	start := -1
+	for i := parent + 1; i < len(lines); i++ {
+		if isBlankOrComment(lines[i]) {
+			continue
+		}
+		indent := indentation(lines[i])
+		if indent <= parentIndent {
+			return start, i
+		}
+		if childIndent < 0 {
+			childIndent = indent
+		}
+		if indent != childIndent || yamlListItemRegex.MatchString(lines[i]) {
+			continue
+		}
+		if start >= 0 {
+			return start, i
+		}
+		if match := yamlKeyRegex.FindStringSubmatch(lines[i]); match != nil && match[2] == key {
+			start = i
+		}
+	}
+	return start, len(lines)
+}
+
+// lastContentLine returns index of last line of block which isn't blank or comment, so entries are added before comments following the block
+func lastContentLine(lines []string, start int, end int) int {
+	last := start
+	for i := start + 1; i < end; i++ {
+		if !isBlankOrComment(lines[i]) {
+			last = i
+		}
+	}
+	return last
+}
+
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+func isBlankOrComment(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed == "" || strings.HasPrefix(trimmed, "#")
+}
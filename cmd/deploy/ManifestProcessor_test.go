@@ -0,0 +1,127 @@
+package deploy
+
+import (
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManifestSaveAddsEntries(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		kind     string
+		path     string
+		want     string
+	}{
+		{
+			name:     "missing cortex",
+			manifest: "version: 1\n",
+			kind:     KIND_SNAPSHOT,
+			path:     "snapshots/b.json",
+			want:     "version: 1\ncortex:\n  snapshots:\n    - snapshots/b.json\n",
+		},
+		{
+			name:     "missing list key",
+			manifest: "cortex:\n  # agents of project\n  agent:\n    - agents/a.json\n\n# kept at end\nversion: 1\n",
+			kind:     KIND_SNAPSHOT,
+			path:     "snapshots/b.json",
+			want:     "cortex:\n  # agents of project\n  agent:\n    - agents/a.json\n  snapshots:\n    - snapshots/b.json\n\n# kept at end\nversion: 1\n",
+		},
+		{
+			name:     "flow style empty list",
+			manifest: "cortex:\n  snapshots: []\n  agent:\n    - agents/a.json\n",
+			kind:     KIND_SNAPSHOT,
+			path:     "snapshots/b.json",
+			want:     "cortex:\n  snapshots:\n    - snapshots/b.json\n  agent:\n    - agents/a.json\n",
+		},
+		{
+			name:     "comments",
+			manifest: "cortex: # resources\n  snapshots: # exported\n    - snapshots/a.json # first\n    # - snapshots/old.json\n  agent:\n    - agents/a.json\n",
+			kind:     KIND_SNAPSHOT,
+			path:     "snapshots/b.json",
+			want:     "cortex: # resources\n  snapshots: # exported\n    - snapshots/a.json # first\n    - snapshots/b.json\n    # - snapshots/old.json\n  agent:\n    - agents/a.json\n",
+		},
+		{
+			name:     "list items at column of key",
+			manifest: "cortex:\n  snapshots:\n  - snapshots/a.json\n  agent:\n  - agents/a.json\n",
+			kind:     KIND_SNAPSHOT,
+			path:     "snapshots/b.json",
+			want:     "cortex:\n  snapshots:\n  - snapshots/a.json\n  - snapshots/b.json\n  agent:\n  - agents/a.json\n",
+		},
+		{
+			name:     "key indented like other keys",
+			manifest: "cortex:\n    agent:\n        - agents/a.json\n",
+			kind:     KIND_TYPE,
+			path:     "types/t.json",
+			want:     "cortex:\n    agent:\n        - agents/a.json\n    type:\n      - types/t.json\n",
+		},
+		{
+			name:     "CRLF line endings",
+			manifest: "cortex:\r\n  snapshots: # exported\r\n    - snapshots/a.json\r\n  agent:\r\n    - agents/a.json\r\n",
+			kind:     KIND_SNAPSHOT,
+			path:     "snapshots/b.json",
+			want:     "cortex:\r\n  snapshots: # exported\r\n    - snapshots/a.json\r\n    - snapshots/b.json\r\n  agent:\r\n    - agents/a.json\r\n",
+		},
+		{
+			name:     "path quoted",
+			manifest: "cortex:\n  snapshots:\n    - snapshots/a.json\n",
+			kind:     KIND_SNAPSHOT,
+			path:     "snapshots/#b: c.json",
+			want:     "cortex:\n  snapshots:\n    - snapshots/a.json\n    - 'snapshots/#b: c.json'\n",
+		},
+		{
+			name:     "already in manifest",
+			manifest: "cortex:\n  snapshots:\n    - snapshots/a.json\n",
+			kind:     KIND_SNAPSHOT,
+			path:     "snapshots/a.json",
+			want:     "cortex:\n  snapshots:\n    - snapshots/a.json\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "fabric.yaml")
+			if err := ioutil.WriteFile(path, []byte(test.manifest), 0644); err != nil {
+				t.Fatal(err)
+			}
+			manifest := NewManifest(path)
+			manifest.Add(test.kind, test.path)
+			if err := manifest.Save(path); err != nil {
+				t.Fatal(err)
+			}
+			saved, _ := ioutil.ReadFile(path)
+			if string(saved) != test.want {
+				t.Fatalf("saved manifest:\n%q\nwant:\n%q", saved, test.want)
+			}
+			// saved manifest has same entries as edited one
+			var parsed Manifest
+			if err := yaml.Unmarshal(saved, &parsed); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(parsed.Cortex.Snapshots, ",") != strings.Join(manifest.Cortex.Snapshots, ",") || strings.Join(parsed.Cortex.Type, ",") != strings.Join(manifest.Cortex.Type, ",") {
+				t.Errorf("saved manifest has %v, want %v", parsed.Cortex, manifest.Cortex)
+			}
+		})
+	}
+}
+
+func TestAddManifestEntryFlowStyle(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		wantErr  string
+	}{
+		{name: "cortex", manifest: "cortex: {snapshots: [snapshots/a.json]}", wantErr: "cortex is not in block style"},
+		{name: "list", manifest: "cortex:\n  snapshots: [snapshots/a.json]", wantErr: "list snapshots is not in block style"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := addManifestEntry(strings.Split(test.manifest, "\n"), manifestEntry{Key: "snapshots", Path: "snapshots/b.json"})
+			if err == nil || err.Error() != test.wantErr {
+				t.Fatalf("addManifestEntry error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
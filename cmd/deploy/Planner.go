@@ -0,0 +1,141 @@
+package deploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"strings"
+)
+
+const (
+	PLAN_CREATE    = "create"
+	PLAN_UPDATE    = "update"
+	PLAN_UNCHANGED = "unchanged"
+)
+
+// fields set by Cortex on saving resources, these are never part of exported resources
+var serverManagedFields = map[string]bool{
+	"_id":               true,
+	"_version":          true,
+	"_createdAt":        true,
+	"_updatedAt":        true,
+	"_createdBy":        true,
+	"_updatedBy":        true,
+	"_tenantId":         true,
+	"_projectId":        true,
+	"_environmentId":    true,
+	"_isTenantResource": true,
+	"createdAt":         true,
+	"updatedAt":         true,
+	"createdBy":         true,
+	"updatedBy":         true,
+}
+
+// PlanResult is the change deploying a resource would make in Cortex project
+type PlanResult struct {
+	Kind    string
+	Name    string
+	Source  string
+	Verdict string
+	Changes []string // paths of fields to be updated
+}
+
+// PlanResource compares resource with its live definition in Cortex and returns whether deployment will create, update or not change it
+func PlanResource(cortex CortexAPI, resource Resource) (PlanResult, error) {
+	result := PlanResult{Kind: resource.Kind, Name: resource.Name, Source: resource.Source, Verdict: PLAN_UNCHANGED}
+	if resource.Kind == KIND_CAMPAIGN {
+		// campaign is imported as zip with all its dependencies, so only checking whether it exists
+		_, err := cortex.GetResourceJson(resource.Kind, resource.Name)
+		if IsNotFound(err) {
+			result.Verdict = PLAN_CREATE
+			return result, nil
+		} else if err == nil {
+			result.Verdict = PLAN_UPDATE
+		}
+		return result, err
+	}
+
+	diffs, err := DiffResource(cortex, resource)
+	if err != nil {
+		return result, err
+	}
+	for _, diff := range diffs {
+		if diff.Missing {
+			result.Verdict = PLAN_CREATE
+			continue
+		}
+		for _, difference := range diff.Differences {
+			// fields only in live resource are defaults set by Cortex, deploying doesn't change those
+			if difference.Op == DIFF_REMOVED {
+				continue
+			}
+			if len(diffs) > 1 {
+				result.Changes = append(result.Changes, diff.Name+":"+difference.Path)
+			} else {
+				result.Changes = append(result.Changes, difference.Path)
+			}
+		}
+	}
+	if len(result.Changes) > 0 && result.Verdict == PLAN_UNCHANGED {
+		result.Verdict = PLAN_UPDATE
+	}
+	return result, nil
+}
+
+// UnwrapResource returns resource from API response, which can be either resource itself or wrapped like {"success": true, "<kind>": {..}}
+func UnwrapResource(kind string, content []byte) []byte {
+	wrapped := gjson.GetBytes(content, kind)
+	if wrapped.IsObject() {
+		return []byte(wrapped.Raw)
+	}
+	return content
+}
+
+// NormalizeJson parses JSON removing server managed fields, so resources exported and fetched from Cortex can be compared
+func NormalizeJson(content []byte) interface{} {
+	var value interface{}
+	if err := json.Unmarshal(content, &value); err != nil {
+		return nil
+	}
+	return removeServerManagedFields(value)
+}
+
+func removeServerManagedFields(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if serverManagedFields[key] {
+				delete(v, key)
+			} else {
+				v[key] = removeServerManagedFields(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = removeServerManagedFields(item)
+		}
+	}
+	return value
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func pathOrRoot(path string) string {
+	if path == "" {
+		return "."
+	}
+	return path
+}
+
+func (p PlanResult) String() string {
+	line := fmt.Sprint("[", strings.ToUpper(p.Verdict), "] ", p.Kind, " ", p.Name, " (", p.Source, ")")
+	if len(p.Changes) > 0 {
+		line += " changed: " + strings.Join(p.Changes, ", ")
+	}
+	return line
+}
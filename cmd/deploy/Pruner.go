@@ -0,0 +1,142 @@
+package deploy
+
+import (
+	"fmt"
+	"github.com/tidwall/gjson"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// kinds in order of pruning, resources are deleted before resources they depend on. Runs are deleted with their experiment
+var pruneOrder = []string{KIND_AGENT, KIND_SKILL, KIND_ACTION, KIND_CAMPAIGN, KIND_EXPERIMENT, KIND_MODEL, KIND_DATASET, KIND_CONNECTION, KIND_TYPE}
+
+// PruneCandidate is a resource in Cortex project not in manifest
+type PruneCandidate struct {
+	Kind string
+	Name string
+}
+
+func (p PruneCandidate) String() string {
+	return p.Kind + " " + p.Name
+}
+
+// PruneCandidates lists resources in Cortex project which are not in manifest resources, in order to be deleted.
+// Only kinds of resources listed in manifest itself are listed, so kinds not managed by manifest (or only deployed as dependencies of snapshots) are never pruned.
+// Resources of campaigns may not be in manifest, so resources in files of campaign directory are kept
+func PruneCandidates(cortex CortexAPI, resources []Resource) ([]PruneCandidate, error) {
+	keep := map[string]bool{}
+	for _, resource := range resources {
+		keep[resource.Kind+"/"+resource.Name] = true
+		if resource.Kind == KIND_TYPE {
+			for _, definition := range TypeDefinitions(resource.Content) {
+				keep[KIND_TYPE+"/"+ResourceName(KIND_TYPE, []byte(definition.Raw))] = true
+			}
+		}
+		if resource.Kind == KIND_CAMPAIGN {
+			campaignResources, err := campaignResources(resource.Path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read campaign %s: %w", resource.Name, err)
+			}
+			for _, key := range campaignResources {
+				keep[key] = true
+			}
+		}
+	}
+
+	var candidates []PruneCandidate
+	for _, kind := range pruneOrder {
+		if !managesKind(resources, kind) {
+			continue
+		}
+		names, err := cortex.ListResources(kind)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s resources: %w", kind, err)
+		}
+		for _, name := range names {
+			if !keep[kind+"/"+name] {
+				candidates = append(candidates, PruneCandidate{Kind: kind, Name: name})
+			}
+		}
+	}
+	return candidates, nil
+}
+
+// managesKind checks whether manifest lists resources of kind. A dataset in a snapshot doesn't make all datasets of project managed by manifest
+func managesKind(resources []Resource, kind string) bool {
+	for _, resource := range resources {
+		if resource.Kind == kind && !resource.Snapshot {
+			return true
+		}
+	}
+	return false
+}
+
+// SnapshotOnlyKinds returns kinds of resources deployed only as dependencies of snapshots, which are not pruned
+func SnapshotOnlyKinds(resources []Resource) []string {
+	var kinds []string
+	for _, kind := range pruneOrder {
+		if managesKind(resources, kind) {
+			continue
+		}
+		for _, resource := range resources {
+			if resource.Kind == kind {
+				kinds = append(kinds, kind)
+				break
+			}
+		}
+	}
+	return kinds
+}
+
+// campaignResources returns `<kind>/<name>` of resources in JSON and YAML files of campaign directory. Kind of file is the directory it is in, like `connections`.
+// Files not in a directory of a kind (like definition of campaign itself) are skipped
+func campaignResources(campaignDir string) ([]string, error) {
+	var resources []string
+	err := filepath.Walk(campaignDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if ext != ".json" && ext != ".yaml" && ext != ".yml" {
+			return nil
+		}
+		relPath, err := filepath.Rel(campaignDir, path)
+		if err != nil {
+			return err
+		}
+		kind := campaignFileKind(relPath)
+		if kind == "" {
+			return nil
+		}
+		content, err := GetJsonContent(path)
+		if err != nil {
+			return err
+		}
+		definitions := []gjson.Result{gjson.ParseBytes(content)}
+		if kind == KIND_TYPE {
+			definitions = TypeDefinitions(content)
+		}
+		for _, definition := range definitions {
+			if name := ResourceName(kind, []byte(definition.Raw)); name != "" {
+				resources = append(resources, kind+"/"+name)
+			}
+		}
+		return nil
+	})
+	return resources, err
+}
+
+// campaignFileKind returns kind of resource file by nearest directory named after a kind (singular or plural), or empty if there is none
+func campaignFileKind(relPath string) string {
+	dirs := strings.Split(filepath.ToSlash(filepath.Dir(relPath)), "/")
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dir := strings.ToLower(dirs[i])
+		for _, kind := range append([]string{KIND_RUN}, pruneOrder...) {
+			if dir == kind || dir == kind+"s" {
+				return kind
+			}
+		}
+	}
+	return ""
+}
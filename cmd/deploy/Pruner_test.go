@@ -0,0 +1,102 @@
+package deploy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeCampaignFiles(t *testing.T, files map[string]string) string {
+	dir := filepath.Join(t.TempDir(), "offers")
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestPruneCandidates(t *testing.T) {
+	campaignDir := writeCampaignFiles(t, map[string]string{
+		"campaign.json":              `{"name": "offers"}`,
+		"connections/crm.json":       `{"name": "crm"}`,
+		"models/churn.yaml":          "name: churn\n",
+		"Agents/offers-agent.json":   `{"name": "offers-agent"}`,
+		"experiments/churn/run.json": `{"name": "ignored", "experimentName": "churn", "runId": "1"}`,
+		"README.md":                  "# offers",
+	})
+	cortex := newFakeCortex(map[string]string{
+		"agent/listed":        `{}`,
+		"agent/offers-agent":  `{}`,
+		"agent/old":           `{}`,
+		"agent/crm":           `{}`, // has name of campaign connection, but isn't in campaign
+		"connection/crm":      `{}`,
+		"connection/legacy":   `{}`,
+		"model/churn":         `{}`,
+		"model/old-model":     `{}`,
+		"type/customer":       `{}`,
+		"type/order":          `{}`,
+		"type/old-type":       `{}`,
+		"dataset/snapshot-ds": `{}`,
+		"dataset/other":       `{}`,
+		"skill/snapshot":      `{}`,
+		"skill/other":         `{}`,
+		"campaign/offers":     `{}`,
+		"campaign/old":        `{}`,
+	})
+	snapshot := testResource(KIND_SNAPSHOT, "snapshots/listed.json", `{
+		"agent": {"name": "listed"},
+		"dependencies": {"datasets": [{"name": "snapshot-ds"}], "skills": [{"name": "snapshot"}]}
+	}`)
+	resources := []Resource{
+		testResource(KIND_TYPE, "types/all.json", `{"types": [{"name": "customer"}, {"name": "order"}]}`),
+		testResource(KIND_CONNECTION, "connections/db.json", `{"name": "db"}`),
+		testResource(KIND_MODEL, "models/score.json", `{"name": "score"}`),
+		{Kind: KIND_CAMPAIGN, Name: "offers", Source: ".fabric/offers", Path: campaignDir},
+	}
+	resources = append(resources, SnapshotResources(snapshot, nil)...)
+
+	candidates, err := PruneCandidates(cortex, resources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// in order of pruning. Datasets and skills are only in snapshot, so they are not pruned
+	want := []PruneCandidate{
+		{Kind: KIND_AGENT, Name: "crm"},
+		{Kind: KIND_AGENT, Name: "old"},
+		{Kind: KIND_CAMPAIGN, Name: "old"},
+		{Kind: KIND_MODEL, Name: "old-model"},
+		{Kind: KIND_CONNECTION, Name: "legacy"},
+		{Kind: KIND_TYPE, Name: "old-type"},
+	}
+	if !reflect.DeepEqual(candidates, want) {
+		t.Fatalf("candidates = %v, want %v", candidates, want)
+	}
+	if kinds := SnapshotOnlyKinds(resources); !reflect.DeepEqual(kinds, []string{KIND_SKILL, KIND_DATASET}) {
+		t.Errorf("snapshot only kinds = %v", kinds)
+	}
+}
+
+func TestCampaignResources(t *testing.T) {
+	campaignDir := writeCampaignFiles(t, map[string]string{
+		"campaign.json":                `{"name": "offers"}`,
+		"connections/crm.json":         `{"name": "crm"}`,
+		"runs/churn/1.json":            `{"experimentName": "churn", "runId": "1"}`,
+		"experiment/churn.json":        `{"name": "churn"}`,
+		"resources/types/profile.json": `{"types": [{"name": "a"}, {"name": "b"}]}`,
+	})
+	resources, err := campaignResources(campaignDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"connection/crm", "experiment/churn", "type/a", "type/b", "run/churn/1"}
+	if !reflect.DeepEqual(resources, want) {
+		t.Fatalf("campaign resources = %v, want %v", resources, want)
+	}
+}
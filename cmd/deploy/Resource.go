@@ -0,0 +1,213 @@
+package deploy
+
+import (
+	"encoding/json"
+	"errors"
+	"fabric-ops/cmd/secret"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	KIND_CAMPAIGN   = "campaign"
+	KIND_TYPE       = "type"
+	KIND_CONNECTION = "connection"
+	KIND_MODEL      = "model"
+	KIND_EXPERIMENT = "experiment"
+	KIND_RUN        = "run"
+	KIND_DATASET    = "dataset"
+	KIND_ACTION     = "action"
+	KIND_SKILL      = "skill"
+	KIND_AGENT      = "agent"
+	KIND_SNAPSHOT   = "snapshot"
+)
+
+// Resource is a single Cortex resource to deploy, either listed in manifest or a dependency in Agent snapshot
+type Resource struct {
+	Kind        string
+	Name        string
+	Source      string // resource file as listed in manifest
+	Transformer string // jsonnet script applied on Source, if any
+	Path        string // file deployed, transformed output or Source
+	Content     []byte
+	Campaign    string // name of campaign deploying this resource, if any. These are not deployed individually
+	Snapshot    bool   // resource is a dependency of agent snapshot, not listed in manifest itself
+}
+
+// DeployedWithCampaign tells if resources of kind in campaign directory are deployed as part of campaign, rather than individually
+func DeployedWithCampaign(kind string) bool {
+	switch kind {
+	case KIND_CONNECTION, KIND_MODEL, KIND_EXPERIMENT, KIND_RUN, KIND_AGENT:
+		return true
+	}
+	return false
+}
+
+// NewResource reads resource file (json or yaml) as JSON. Campaign is a directory, so it's content is not read
+func NewResource(kind string, source string, path string, transformer string) Resource {
+	resource := Resource{Kind: kind, Source: source, Path: path, Transformer: transformer}
+	if kind == KIND_CAMPAIGN {
+		resource.Name = filepath.Base(path)
+		return resource
+	}
+	content, err := GetJsonContent(path)
+	if err != nil {
+		log.Fatalln("Failed to read Cortex ", kind, " file ", path, " Error: ", err)
+	}
+	resource.Content = content
+	resource.Name = ResourceName(kind, content)
+	return resource
+}
+
+// ResourceName returns name of resource used in Cortex API. Experiment run is identified as `<experiment name>/<run id>`
+func ResourceName(kind string, content []byte) string {
+	switch kind {
+	case KIND_RUN:
+		return gjson.GetBytes(content, "experimentName").String() + "/" + gjson.GetBytes(content, "runId").String()
+	case KIND_SNAPSHOT:
+		return gjson.GetBytes(content, "agent.name").String()
+	case KIND_TYPE:
+		names := []string{}
+		for _, typ := range TypeDefinitions(content) {
+			names = append(names, typ.Get("name").String())
+		}
+		return strings.Join(names, ",")
+	default:
+		return gjson.GetBytes(content, "name").String()
+	}
+}
+
+// TypeDefinitions returns types in file, which can be either a single type or list of types in `types`
+func TypeDefinitions(content []byte) []gjson.Result {
+	types := gjson.GetBytes(content, "types")
+	if types.IsArray() {
+		return types.Array()
+	}
+	return []gjson.Result{gjson.ParseBytes(content)}
+}
+
+func splitRunName(name string) (string, string) {
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		return name, ""
+	}
+	return name[:i], name[i+1:]
+}
+
+// SnapshotResources returns dependencies of Agent snapshot followed by the Agent, in order to be deployed.
+// Docker images of actions are substituted using `actionImageMapping`
+func SnapshotResources(snapshot Resource, actionImageMapping map[string]string) []Resource {
+	content := gjson.ParseBytes(snapshot.Content)
+	resources := []Resource{}
+	add := func(kind string, value gjson.Result) {
+		resources = append(resources, Resource{
+			Kind:        kind,
+			Name:        ResourceName(kind, []byte(value.Raw)),
+			Source:      snapshot.Source,
+			Transformer: snapshot.Transformer,
+			Path:        snapshot.Path,
+			Content:     []byte(value.Raw),
+			Snapshot:    kind != KIND_AGENT, // agent is listed in manifest by its snapshot
+		})
+	}
+
+	content.Get("dependencies.types").ForEach(func(key, value gjson.Result) bool {
+		add(KIND_TYPE, value)
+		return true
+	})
+	content.Get("dependencies.datasets").ForEach(func(key, value gjson.Result) bool {
+		add(KIND_DATASET, value)
+		return true
+	})
+	content.Get("dependencies.actions").ForEach(func(key, value gjson.Result) bool {
+		add(KIND_ACTION, SubstituteActionImage(value, actionImageMapping))
+		return true
+	})
+	content.Get("dependencies.skills").ForEach(func(key, value gjson.Result) bool {
+		add(KIND_SKILL, value)
+		return true
+	})
+	add(KIND_AGENT, content.Get("agent"))
+	return resources
+}
+
+// SubstituteResourceImage replaces docker image of action resource listed in manifest, like actions of snapshots. Actions deployed by campaigns are not changed
+func SubstituteResourceImage(action Resource, actionImageMapping map[string]string) Resource {
+	if action.Campaign != "" {
+		return action
+	}
+	action.Content = []byte(SubstituteActionImage(gjson.ParseBytes(action.Content), actionImageMapping).Raw)
+	return action
+}
+
+// SubstituteActionImage replaces docker image of action with image built in this run, having same image name
+func SubstituteActionImage(action gjson.Result, actionImageMapping map[string]string) gjson.Result {
+	if actionImageMapping == nil {
+		return action
+	}
+	imageName := DockerImageName(action.Get("image").String())
+	image := actionImageMapping[imageName]
+	if image == "" {
+		log.Println("[IMP] Docker image ", action.Get("image").String(), " used by action ", action.Get("name").String(), " is not built in this run, make sure it exists in docker registry")
+		return action
+	}
+	//TODO - [2nd iteration] - evaluate better JSON substitution/templating. Need to support: variable substitution in connections,
+	// support differ action config across env, ex.
+	// 	higher resource limit (or cpu in dev vs gpu in prod) in prod compare to dev (podspec json substitution)
+	//	higher scale count in prod (action config substitution)
+	updated, _ := sjson.Set(action.Raw, "image", image)
+	//parse podspec json into object before setting, for correct formatting. Action definitions may have it as object already
+	if podspec := action.Get("podSpec"); podspec.Type == gjson.String {
+		var podspecDef []map[string]interface{}
+		json.Unmarshal([]byte(podspec.String()), &podspecDef)
+		updated, _ = sjson.Set(updated, "podSpec", podspecDef)
+	}
+	return gjson.Parse(updated)
+}
+
+// DeployResource deploys resource using API for its kind and returns API response. Campaigns are deployed using DeployCampaign
+func DeployResource(cortex CortexAPI, resource Resource, repoDir string) (*Response, error) {
+	// secrets are resolved only in memory, so resolved values are never written to files
+	content, err := secret.ResolveJson(resource.Content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve secrets of %s %s: %w", resource.Kind, resource.Name, err)
+	}
+	resource.Content = content
+	switch resource.Kind {
+	case KIND_TYPE:
+		return cortex.DeployTypesJson(resource.Content)
+	case KIND_DATASET:
+		return cortex.DeployDatasetJson(resource.Content)
+	case KIND_CONNECTION:
+		return cortex.DeployConnectionJson(resource.Content)
+	case KIND_ACTION:
+		actionType := gjson.GetBytes(resource.Content, "actionType").String()
+		if actionType == "" {
+			// actions in snapshot have action type in `type`
+			actionType = gjson.GetBytes(resource.Content, "type").String()
+		}
+		return cortex.DeployActionJson(actionType, resource.Content)
+	case KIND_SKILL:
+		return cortex.DeploySkillJson(resource.Content)
+	case KIND_AGENT:
+		return cortex.DeployAgentJson(resource.Content)
+	case KIND_MODEL, KIND_EXPERIMENT, KIND_RUN:
+		v6Client, ok := cortex.(*CortexClientV6)
+		if !ok {
+			return nil, errors.New(fmt.Sprint("Deployment of ", resource.Kind, " is supported for Cortex v6 onwards"))
+		}
+		switch resource.Kind {
+		case KIND_MODEL:
+			return DeployModelJson(*v6Client, resource.Content)
+		case KIND_EXPERIMENT:
+			return DeployExperimentJson(*v6Client, resource.Content)
+		default:
+			return DeployExperimentRunJson(*v6Client, resource.Content, repoDir)
+		}
+	}
+	return nil, errors.New(fmt.Sprint("Deployment of resource kind ", resource.Kind, " is not supported"))
+}
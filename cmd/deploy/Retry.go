@@ -0,0 +1,175 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RetryPolicy for transient Cortex API failures, like gateway errors (502, 504), rate limiting (429) and network errors
+type RetryPolicy struct {
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration // also limits wait requested by Retry-After header
+}
+
+var retryPolicy = RetryPolicy{MaxRetries: 3, InitialBackoff: time.Second, MaxBackoff: 30 * time.Second}
+
+func SetRetryPolicy(policy RetryPolicy) {
+	retryPolicy = policy
+}
+
+// RetryStats are counts of Cortex API calls retried in this run
+type RetryStats struct {
+	Requests        int64 // API calls, excluding retries
+	RetriedRequests int64 // API calls retried at least once
+	Retries         int64 // total retry attempts
+	Recovered       int64 // API calls succeeded after retry
+	Exhausted       int64 // API calls failed after all retries
+	ByReason        map[string]int64
+}
+
+var (
+	requestCount        int64
+	retriedRequestCount int64
+	retryCount          int64
+	recoveredCount      int64
+	exhaustedCount      int64
+	retryReasons        = map[string]int64{}
+	retryReasonsMutex   sync.Mutex
+	jitter              = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterMutex         sync.Mutex
+)
+
+func GetRetryStats() RetryStats {
+	retryReasonsMutex.Lock()
+	defer retryReasonsMutex.Unlock()
+	byReason := map[string]int64{}
+	for reason, count := range retryReasons {
+		byReason[reason] = count
+	}
+	return RetryStats{
+		Requests:        atomic.LoadInt64(&requestCount),
+		RetriedRequests: atomic.LoadInt64(&retriedRequestCount),
+		Retries:         atomic.LoadInt64(&retryCount),
+		Recovered:       atomic.LoadInt64(&recoveredCount),
+		Exhausted:       atomic.LoadInt64(&exhaustedCount),
+		ByReason:        byReason,
+	}
+}
+
+func (s RetryStats) String() string {
+	reasons := make([]string, 0, len(s.ByReason))
+	for reason, count := range s.ByReason {
+		reasons = append(reasons, fmt.Sprint(reason, ": ", count))
+	}
+	sort.Strings(reasons)
+	line := fmt.Sprint("Cortex API calls: ", s.Requests, ", retried: ", s.RetriedRequests, " (", s.Retries, " retries), recovered: ", s.Recovered, ", failed after retries: ", s.Exhausted)
+	if len(reasons) > 0 {
+		line += ". Retried on " + strings.Join(reasons, ", ")
+	}
+	return line
+}
+
+// retryDecision returns whether a failed attempt can be retried, reason of retry and wait before next attempt.
+// Failed idempotent requests are retried on 429, 503, gateway errors (502, 504) and network errors. Other requests (like creating resources)
+// might have been processed, so they are retried only if not sent (connection refused), or on 429 and 503 with Retry-After header,
+// with which server tells request was rejected and when to send it again
+func retryDecision(attempt int, idempotent bool, response *http.Response, err error) (bool, string, time.Duration) {
+	if attempt >= retryPolicy.MaxRetries {
+		return false, "", 0
+	}
+	if err != nil {
+		var opError *net.OpError
+		notSent := errors.As(err, &opError) && opError.Op == "dial"
+		if idempotent || notSent {
+			return true, "network error", backoff(attempt)
+		}
+		return false, "", 0
+	}
+	switch response.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		if wait, ok := retryAfter(response.Header.Get("Retry-After")); ok {
+			return true, strconv.Itoa(response.StatusCode), wait
+		}
+		if idempotent {
+			return true, strconv.Itoa(response.StatusCode), backoff(attempt)
+		}
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		if idempotent {
+			return true, strconv.Itoa(response.StatusCode), backoff(attempt)
+		}
+	}
+	return false, "", 0
+}
+
+// backoff is exponential with jitter, random wait between half and full of InitialBackoff * 2^attempt, up to MaxBackoff.
+// InitialBackoff 0 retries without waiting
+func backoff(attempt int) time.Duration {
+	if retryPolicy.InitialBackoff <= 0 {
+		return 0
+	}
+	wait := retryPolicy.InitialBackoff << uint(attempt)
+	if wait > retryPolicy.MaxBackoff || wait <= 0 {
+		// wait <= 0 if shift overflowed
+		wait = retryPolicy.MaxBackoff
+	}
+	if wait <= 1 {
+		return wait
+	}
+	jitterMutex.Lock()
+	defer jitterMutex.Unlock()
+	return wait/2 + time.Duration(jitter.Int63n(int64(wait/2)))
+}
+
+// retryAfter parses Retry-After header, either seconds or HTTP date
+func retryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(header); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		wait = time.Until(date)
+	} else {
+		return 0, false
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > retryPolicy.MaxBackoff {
+		wait = retryPolicy.MaxBackoff
+	}
+	return wait, true
+}
+
+// recordAttempts counts outcome of API call retried `retries` times
+func recordAttempts(retries int, success bool) {
+	if retries == 0 {
+		return
+	}
+	if success {
+		atomic.AddInt64(&recoveredCount, 1)
+	} else {
+		atomic.AddInt64(&exhaustedCount, 1)
+	}
+}
+
+func recordRetry(attempt int, reason string) {
+	if attempt == 0 {
+		atomic.AddInt64(&retriedRequestCount, 1)
+	}
+	atomic.AddInt64(&retryCount, 1)
+	retryReasonsMutex.Lock()
+	retryReasons[reason]++
+	retryReasonsMutex.Unlock()
+}
@@ -0,0 +1,255 @@
+package deploy
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setRetryPolicy sets retry policy for test, restoring previous policy after it
+func setRetryPolicy(t *testing.T, policy RetryPolicy) {
+	previous := retryPolicy
+	SetRetryPolicy(policy)
+	t.Cleanup(func() { SetRetryPolicy(previous) })
+}
+
+// scriptedServer replies to each request with next status (and Retry-After header, if any) of script, then with 200.
+// It records bodies of requests, so resent bodies can be checked
+type scriptedServer struct {
+	*httptest.Server
+	mutex  sync.Mutex
+	script []scriptedResponse
+	bodies []string
+}
+
+type scriptedResponse struct {
+	status     int
+	retryAfter string
+}
+
+func newScriptedServer(t *testing.T, script ...scriptedResponse) *scriptedServer {
+	server := &scriptedServer{script: script}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		server.bodies = append(server.bodies, string(body))
+		if len(server.script) == 0 {
+			w.Write([]byte(`{"success":true}`))
+			return
+		}
+		response := server.script[0]
+		server.script = server.script[1:]
+		if response.retryAfter != "" {
+			w.Header().Set("Retry-After", response.retryAfter)
+		}
+		w.WriteHeader(response.status)
+		w.Write([]byte(`{"message":"failed"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *scriptedServer) attempts() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.bodies)
+}
+
+func TestRetryStatusCodes(t *testing.T) {
+	setRetryPolicy(t, RetryPolicy{MaxRetries: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+	tests := []struct {
+		status     int
+		idempotent bool
+		retried    bool
+	}{
+		{status: http.StatusTooManyRequests, idempotent: true, retried: true},
+		{status: http.StatusServiceUnavailable, idempotent: true, retried: true},
+		{status: http.StatusBadGateway, idempotent: true, retried: true},
+		{status: http.StatusGatewayTimeout, idempotent: true, retried: true},
+		{status: http.StatusInternalServerError, idempotent: true, retried: false},
+		{status: http.StatusBadRequest, idempotent: true, retried: false},
+		{status: http.StatusNotFound, idempotent: true, retried: false},
+		// creating request might have been processed, so it is retried only if server tells when to retry with Retry-After
+		{status: http.StatusTooManyRequests, idempotent: false, retried: false},
+		{status: http.StatusServiceUnavailable, idempotent: false, retried: false},
+		{status: http.StatusBadGateway, idempotent: false, retried: false},
+		{status: http.StatusGatewayTimeout, idempotent: false, retried: false},
+	}
+	for _, test := range tests {
+		t.Run(strconv.Itoa(test.status)+"/idempotent="+strconv.FormatBool(test.idempotent), func(t *testing.T) {
+			server := newScriptedServer(t, scriptedResponse{status: test.status})
+			cortex := &CortexClientV6{Url: server.URL, Project: "test", Token: "token"}
+			var err error
+			if test.idempotent {
+				_, err = httpPost(cortex, "/resources", bytes.NewReader([]byte(`{"name":"a"}`)))
+			} else {
+				_, err = httpCreate(cortex, "/resources", bytes.NewReader([]byte(`{"name":"a"}`)))
+			}
+			wantAttempts := 1
+			if test.retried {
+				wantAttempts = 2
+			}
+			if server.attempts() != wantAttempts {
+				t.Fatalf("attempts = %d, want %d", server.attempts(), wantAttempts)
+			}
+			var responseError *ResponseError
+			if test.retried && err != nil {
+				t.Fatalf("retried request failed: %v", err)
+			}
+			if !test.retried && (!errors.As(err, &responseError) || responseError.StatusCode != test.status) {
+				t.Fatalf("error = %v, want ResponseError with status %d", err, test.status)
+			}
+			for _, body := range server.bodies {
+				if body != `{"name":"a"}` {
+					t.Errorf("request body = %q, want body resent on retry", body)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryNonIdempotentWithRetryAfter(t *testing.T) {
+	setRetryPolicy(t, RetryPolicy{MaxRetries: 3, InitialBackoff: time.Hour, MaxBackoff: time.Hour})
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		server := newScriptedServer(t, scriptedResponse{status: status, retryAfter: "0"})
+		cortex := &CortexClientV6{Url: server.URL, Project: "test", Token: "token"}
+		// Retry-After 0 is waited, not backoff of an hour
+		if _, err := httpCreate(cortex, "/runs", bytes.NewReader([]byte(`{}`))); err != nil {
+			t.Fatalf("status %d: %v", status, err)
+		}
+		if server.attempts() != 2 {
+			t.Errorf("status %d: attempts = %d, want retry after Retry-After", status, server.attempts())
+		}
+	}
+
+	// gateway errors don't tell whether request was processed, so Retry-After doesn't make them safe to retry
+	server := newScriptedServer(t, scriptedResponse{status: http.StatusBadGateway, retryAfter: "0"})
+	cortex := &CortexClientV6{Url: server.URL, Project: "test", Token: "token"}
+	if _, err := httpCreate(cortex, "/runs", bytes.NewReader([]byte(`{}`))); err == nil || server.attempts() != 1 {
+		t.Errorf("502 of creating request: attempts = %d, error %v, want not retried", server.attempts(), err)
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	setRetryPolicy(t, RetryPolicy{MaxRetries: 2, InitialBackoff: 0, MaxBackoff: time.Second})
+	server := newScriptedServer(t, scriptedResponse{status: 503}, scriptedResponse{status: 503}, scriptedResponse{status: 503}, scriptedResponse{status: 503})
+	cortex := &CortexClientV6{Url: server.URL, Project: "test", Token: "token"}
+	before := GetRetryStats()
+	start := time.Now()
+	_, err := httpGet(cortex, "/resources")
+	var responseError *ResponseError
+	if !errors.As(err, &responseError) || responseError.StatusCode != 503 {
+		t.Fatalf("error = %v, want 503 after retries", err)
+	}
+	if server.attempts() != 3 {
+		t.Errorf("attempts = %d, want 1 + MaxRetries", server.attempts())
+	}
+	// --retry-backoff 0 retries without waiting
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("retries with 0 backoff took %v", elapsed)
+	}
+	after := GetRetryStats()
+	if after.Retries-before.Retries != 2 || after.Exhausted-before.Exhausted != 1 || after.ByReason["503"]-before.ByReason["503"] != 2 {
+		t.Errorf("retry stats = %+v, before %+v", after, before)
+	}
+}
+
+func TestRetryNetworkErrors(t *testing.T) {
+	setRetryPolicy(t, RetryPolicy{MaxRetries: 2, InitialBackoff: 0, MaxBackoff: time.Second})
+	// address not listening, so requests are refused before being sent
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	cortex := &CortexClientV6{Url: "http://" + address, Project: "test", Token: "token"}
+
+	before := GetRetryStats()
+	if _, err := httpCreate(cortex, "/runs", bytes.NewReader([]byte(`{}`))); err == nil {
+		t.Fatal("request to closed port succeeded")
+	}
+	after := GetRetryStats()
+	if after.Retries-before.Retries != 2 {
+		t.Errorf("retries of refused connection = %d, want 2, as request wasn't sent", after.Retries-before.Retries)
+	}
+
+	_, sentErr := http.Get("http://" + address)
+	if retry, _, _ := retryDecision(0, false, nil, sentErr); !retry {
+		t.Errorf("refused connection of creating request not retried")
+	}
+	if retry, _, _ := retryDecision(0, false, nil, errors.New("connection reset by peer")); retry {
+		t.Errorf("creating request failed after sending is retried")
+	}
+	if retry, reason, _ := retryDecision(0, true, nil, errors.New("connection reset by peer")); !retry || reason != "network error" {
+		t.Errorf("idempotent request failed with network error not retried")
+	}
+	if retry, _, _ := retryDecision(2, true, nil, errors.New("connection reset by peer")); retry {
+		t.Errorf("request retried more than MaxRetries")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	setRetryPolicy(t, RetryPolicy{MaxRetries: 3, InitialBackoff: time.Second, MaxBackoff: 30 * time.Second})
+	tests := []struct {
+		header string
+		min    time.Duration
+		max    time.Duration
+		ok     bool
+	}{
+		{header: "", ok: false},
+		{header: "soon", ok: false},
+		{header: "0", min: 0, max: 0, ok: true},
+		{header: "5", min: 5 * time.Second, max: 5 * time.Second, ok: true},
+		{header: "120", min: 30 * time.Second, max: 30 * time.Second, ok: true},
+		{header: "-3", min: 0, max: 0, ok: true},
+		{header: time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat), min: 8 * time.Second, max: 10 * time.Second, ok: true},
+		{header: time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), min: 30 * time.Second, max: 30 * time.Second, ok: true},
+		{header: time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), min: 0, max: 0, ok: true},
+	}
+	for _, test := range tests {
+		wait, ok := retryAfter(test.header)
+		if ok != test.ok || wait < test.min || wait > test.max {
+			t.Errorf("retryAfter(%q) = %v, %v, want %v between %v and %v", test.header, wait, ok, test.ok, test.min, test.max)
+		}
+	}
+
+	response := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"7"}}}
+	if retry, reason, wait := retryDecision(0, true, response, nil); !retry || reason != "429" || wait != 7*time.Second {
+		t.Errorf("retryDecision = %v, %s, %v, want wait of Retry-After", retry, reason, wait)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	setRetryPolicy(t, RetryPolicy{MaxRetries: 10, InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second})
+	for attempt, wait := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		wait *= time.Millisecond
+		if attempt == 5 {
+			wait = time.Second
+		}
+		for i := 0; i < 200; i++ {
+			if got := backoff(attempt); got < wait/2 || got >= wait {
+				t.Fatalf("backoff(%d) = %v, want between %v and %v", attempt, got, wait/2, wait)
+			}
+		}
+	}
+	// shift overflow is limited to MaxBackoff
+	if got := backoff(100); got < 500*time.Millisecond || got >= time.Second {
+		t.Errorf("backoff(100) = %v, want up to MaxBackoff", got)
+	}
+
+	setRetryPolicy(t, RetryPolicy{MaxRetries: 10, InitialBackoff: 0, MaxBackoff: time.Second})
+	for attempt := 0; attempt < 5; attempt++ {
+		if got := backoff(attempt); got != 0 {
+			t.Errorf("backoff(%d) with InitialBackoff 0 = %v, want no wait", attempt, got)
+		}
+	}
+}
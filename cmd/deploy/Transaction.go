@@ -0,0 +1,129 @@
+package deploy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Transaction records live definitions of resources before they are overwritten, so a failed deployment can be rolled back.
+// Methods are safe for concurrent use and no-op on nil Transaction, so deployment code doesn't need to check whether it is atomic
+type Transaction struct {
+	cortex  CortexAPI
+	journal []journalEntry
+	mutex   sync.Mutex
+}
+
+// journalEntry is a resource definition as it was in Cortex project before deployment
+type journalEntry struct {
+	Kind     string
+	Name     string
+	Previous []byte // live definition without server managed fields, nil if resource didn't exist
+}
+
+func NewTransaction(cortex CortexAPI) *Transaction {
+	return &Transaction{cortex: cortex}
+}
+
+// Reverted is set of resources (by kind and name) reverted by rollback
+type Reverted map[string]bool
+
+// Contains checks whether resource is reverted, all types of a types file
+func (r Reverted) Contains(resource Resource) bool {
+	for _, name := range journalNames(resource) {
+		if !r[resource.Kind+"/"+name] {
+			return false
+		}
+	}
+	return true
+}
+
+// journalNames returns names of resource as captured. Types file may have multiple types, each is captured separately
+func journalNames(resource Resource) []string {
+	if resource.Kind != KIND_TYPE {
+		return []string{resource.Name}
+	}
+	var names []string
+	for _, definition := range TypeDefinitions(resource.Content) {
+		names = append(names, ResourceName(KIND_TYPE, []byte(definition.Raw)))
+	}
+	return names
+}
+
+// Capture fetches current definition of resource from Cortex before deploying it
+func (t *Transaction) Capture(resource Resource) error {
+	if t == nil {
+		return nil
+	}
+	for _, name := range journalNames(resource) {
+		entry := journalEntry{Kind: resource.Kind, Name: name}
+		live, err := t.cortex.GetResourceJson(resource.Kind, name)
+		if err != nil && !IsNotFound(err) {
+			return fmt.Errorf("failed to capture current definition of %s %s: %w", resource.Kind, name, err)
+		}
+		if err == nil {
+			entry.Previous, err = json.Marshal(NormalizeJson(UnwrapResource(resource.Kind, live)))
+			if err != nil {
+				return fmt.Errorf("failed to capture current definition of %s %s: %w", resource.Kind, name, err)
+			}
+		}
+		t.mutex.Lock()
+		t.journal = append(t.journal, entry)
+		t.mutex.Unlock()
+	}
+	return nil
+}
+
+// Rollback restores captured definitions and deletes resources created, in reverse order of capture so dependents are reverted before their dependencies.
+// Rollback continues on failure and returns resources reverted and all errors. Existing campaigns and runs can't be restored, so they aren't reverted
+func (t *Transaction) Rollback() (Reverted, error) {
+	reverted := Reverted{}
+	if t == nil {
+		return reverted, nil
+	}
+	t.mutex.Lock()
+	journal := t.journal
+	t.journal = nil
+	t.mutex.Unlock()
+	if len(journal) == 0 {
+		return reverted, nil
+	}
+
+	log.Println("Rolling back", len(journal), "resources")
+	var errs []string
+	for i := len(journal) - 1; i >= 0; i-- {
+		entry := journal[i]
+		var err error
+		switch {
+		case entry.Previous == nil:
+			_, err = t.cortex.DeleteResource(entry.Kind, entry.Name)
+			if IsNotFound(err) {
+				// failed before creating it
+				err = nil
+			} else if err == nil {
+				log.Println("[ROLLBACK] Deleted", entry.Kind, entry.Name)
+			}
+		case entry.Kind == KIND_CAMPAIGN || entry.Kind == KIND_RUN:
+			// campaigns are imported from zip and runs are created on each save, so previous definitions can't be saved back
+			log.Println("[WARN] Can't restore previous definition of", entry.Kind, entry.Name)
+		default:
+			_, err = DeployResource(t.cortex, Resource{Kind: entry.Kind, Name: entry.Name, Content: entry.Previous}, "")
+			if err == nil {
+				log.Println("[ROLLBACK] Restored", entry.Kind, entry.Name)
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprint(entry.Kind, " ", entry.Name, ": ", err))
+			log.Println("[ROLLBACK] Failed to revert", entry.Kind, entry.Name, ". Error:", err)
+		} else if entry.Previous == nil || (entry.Kind != KIND_CAMPAIGN && entry.Kind != KIND_RUN) {
+			reverted[entry.Kind+"/"+entry.Name] = true
+		}
+	}
+	if len(errs) > 0 {
+		return reverted, errors.New("failed to roll back " + strings.Join(errs, "; "))
+	}
+	return reverted, nil
+}
@@ -0,0 +1,322 @@
+package deploy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeCortex keeps resources in memory by `<kind>/<name>`, failing deploy or delete of resources in `fail`
+type fakeCortex struct {
+	mutex     sync.Mutex
+	resources map[string][]byte
+	fail      map[string]bool // by `<kind>/<name>`, or `get <kind>/<name>` to fail fetching it
+	calls     []string        // `<method> <kind>/<name>` of changes made
+}
+
+func newFakeCortex(resources map[string]string) *fakeCortex {
+	cortex := &fakeCortex{resources: map[string][]byte{}, fail: map[string]bool{}}
+	for key, content := range resources {
+		cortex.resources[key] = []byte(content)
+	}
+	return cortex
+}
+
+func (c *fakeCortex) deploy(kind string, content []byte) (*Response, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := kind + "/" + ResourceName(kind, content)
+	c.calls = append(c.calls, "deploy "+key)
+	if c.fail[key] {
+		return nil, &ResponseError{Method: "POST", URL: key, StatusCode: http.StatusInternalServerError, Message: "failed"}
+	}
+	c.resources[key] = content
+	return &Response{StatusCode: http.StatusOK, Body: []byte(`{"success":true}`)}, nil
+}
+
+func (c *fakeCortex) GetURL() string                     { return "http://cortex.local" }
+func (c *fakeCortex) GetToken() string                   { return "token" }
+func (c *fakeCortex) GetAccount() string                 { return "test" }
+func (c *fakeCortex) GetDockerRegistry() (string, error) { return "registry.local", nil }
+
+func (c *fakeCortex) DeployAction(filepath string) (*Response, error) {
+	content, _ := GetJsonContent(filepath)
+	return c.deploy(KIND_ACTION, content)
+}
+func (c *fakeCortex) DeployActionJson(actionType string, content []byte) (*Response, error) {
+	return c.deploy(KIND_ACTION, content)
+}
+func (c *fakeCortex) DeploySkill(filepath string) (*Response, error) {
+	content, _ := GetJsonContent(filepath)
+	return c.deploy(KIND_SKILL, content)
+}
+func (c *fakeCortex) DeploySkillJson(content []byte) (*Response, error) {
+	return c.deploy(KIND_SKILL, content)
+}
+func (c *fakeCortex) DeployAgent(filepath string) (*Response, error) {
+	content, _ := GetJsonContent(filepath)
+	return c.deploy(KIND_AGENT, content)
+}
+func (c *fakeCortex) DeployAgentJson(content []byte) (*Response, error) {
+	return c.deploy(KIND_AGENT, content)
+}
+func (c *fakeCortex) DeployDatasetJson(content []byte) (*Response, error) {
+	return c.deploy(KIND_DATASET, content)
+}
+func (c *fakeCortex) DeployTypes(filepath string) (*Response, error) {
+	content, _ := GetJsonContent(filepath)
+	return c.DeployTypesJson(content)
+}
+func (c *fakeCortex) DeployTypesJson(content []byte) (*Response, error) {
+	var response *Response
+	for _, definition := range TypeDefinitions(content) {
+		var err error
+		if response, err = c.deploy(KIND_TYPE, []byte(definition.Raw)); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+func (c *fakeCortex) DeployConnection(filepath string) (*Response, error) {
+	content, _ := GetJsonContent(filepath)
+	return c.deploy(KIND_CONNECTION, content)
+}
+func (c *fakeCortex) DeployConnectionJson(content []byte) (*Response, error) {
+	return c.deploy(KIND_CONNECTION, content)
+}
+
+func (c *fakeCortex) GetResourceJson(kind string, name string) ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.fail["get "+kind+"/"+name] {
+		return nil, &ResponseError{Method: "GET", URL: kind + "/" + name, StatusCode: http.StatusInternalServerError, Message: "failed"}
+	}
+	content, ok := c.resources[kind+"/"+name]
+	if !ok {
+		return nil, &ResponseError{Method: "GET", URL: kind + "/" + name, StatusCode: http.StatusNotFound, Message: "not found"}
+	}
+	// Cortex returns resource with server managed fields, wrapped in its kind
+	var value map[string]interface{}
+	json.Unmarshal(content, &value)
+	value["_version"] = 3
+	value["_updatedAt"] = "2026-01-01T00:00:00Z"
+	return json.Marshal(map[string]interface{}{kind: value})
+}
+
+func (c *fakeCortex) DeleteResource(kind string, name string) (*Response, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := kind + "/" + name
+	c.calls = append(c.calls, "delete "+key)
+	if c.fail[key] {
+		return nil, &ResponseError{Method: "DELETE", URL: key, StatusCode: http.StatusInternalServerError, Message: "failed"}
+	}
+	if _, ok := c.resources[key]; !ok {
+		return nil, &ResponseError{Method: "DELETE", URL: key, StatusCode: http.StatusNotFound, Message: "not found"}
+	}
+	delete(c.resources, key)
+	return &Response{StatusCode: http.StatusOK}, nil
+}
+
+func (c *fakeCortex) ListResources(kind string) ([]string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var names []string
+	for key := range c.resources {
+		if strings.HasPrefix(key, kind+"/") {
+			names = append(names, strings.TrimPrefix(key, kind+"/"))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// captureAndDeploy captures resources in transaction and deploys them, as atomic deployment does
+func captureAndDeploy(t *testing.T, tx *Transaction, cortex CortexAPI, resources ...Resource) {
+	for _, resource := range resources {
+		if err := tx.Capture(resource); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DeployResource(cortex, resource, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func assertJsonEqual(t *testing.T, name string, got []byte, want string) {
+	t.Helper()
+	var gotValue, wantValue interface{}
+	json.Unmarshal(got, &gotValue)
+	json.Unmarshal([]byte(want), &wantValue)
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		t.Errorf("%s = %s, want %s", name, got, want)
+	}
+}
+
+func TestRollbackRestoresUpdatedAndDeletesCreated(t *testing.T) {
+	cortex := newFakeCortex(map[string]string{
+		"action/loader": `{"name": "loader", "image": "loader:1"}`,
+		"type/customer": `{"name": "customer", "fields": ["id"]}`,
+	})
+	tx := NewTransaction(cortex)
+	action := testResource(KIND_ACTION, "actions/loader.json", `{"name": "loader", "image": "loader:2"}`)
+	skill := testResource(KIND_SKILL, "skills/report.json", `{"name": "report"}`)
+	types := testResource(KIND_TYPE, "types/all.json", `{"types": [{"name": "customer", "fields": ["id", "email"]}, {"name": "order"}]}`)
+	captureAndDeploy(t, tx, cortex, action, skill, types)
+	cortex.calls = nil
+
+	reverted, err := tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// server managed fields of captured definition are not deployed back
+	assertJsonEqual(t, "restored action", cortex.resources["action/loader"], `{"name": "loader", "image": "loader:1"}`)
+	assertJsonEqual(t, "restored type", cortex.resources["type/customer"], `{"name": "customer", "fields": ["id"]}`)
+	for _, key := range []string{"skill/report", "type/order"} {
+		if _, ok := cortex.resources[key]; ok {
+			t.Errorf("created %s not deleted", key)
+		}
+	}
+	// reverted in reverse order of capture
+	wantCalls := []string{"delete type/order", "deploy type/customer", "delete skill/report", "deploy action/loader"}
+	if !reflect.DeepEqual(cortex.calls, wantCalls) {
+		t.Errorf("rollback calls = %v, want %v", cortex.calls, wantCalls)
+	}
+	for _, resource := range []Resource{action, skill, types} {
+		if !reverted.Contains(resource) {
+			t.Errorf("%s %s not reported as reverted", resource.Kind, resource.Name)
+		}
+	}
+
+	// journal is cleared by rollback
+	if reverted, err := tx.Rollback(); err != nil || len(reverted) != 0 {
+		t.Errorf("second Rollback = %v, %v, want nothing to roll back", reverted, err)
+	}
+}
+
+func TestRollbackReportsPartialFailure(t *testing.T) {
+	cortex := newFakeCortex(map[string]string{
+		"action/loader": `{"name": "loader", "image": "loader:1"}`,
+		"type/customer": `{"name": "customer"}`,
+	})
+	tx := NewTransaction(cortex)
+	action := testResource(KIND_ACTION, "actions/loader.json", `{"name": "loader", "image": "loader:2"}`)
+	skill := testResource(KIND_SKILL, "skills/report.json", `{"name": "report"}`)
+	types := testResource(KIND_TYPE, "types/all.json", `{"types": [{"name": "customer"}, {"name": "order"}]}`)
+	captureAndDeploy(t, tx, cortex, action, skill, types)
+	cortex.fail["skill/report"] = true
+	cortex.fail["type/order"] = true
+
+	reverted, err := tx.Rollback()
+	if err == nil || !strings.Contains(err.Error(), "skill report") || !strings.Contains(err.Error(), "type order") {
+		t.Fatalf("Rollback error = %v, want failures of skill report and type order", err)
+	}
+	// rollback continues after failures
+	assertJsonEqual(t, "restored action", cortex.resources["action/loader"], `{"name": "loader", "image": "loader:1"}`)
+	if !reverted.Contains(action) {
+		t.Errorf("restored action not reported as reverted")
+	}
+	if reverted.Contains(skill) {
+		t.Errorf("skill failed to be deleted reported as reverted")
+	}
+	// types file is reverted only if all its types are
+	if !reverted["type/customer"] || reverted.Contains(types) {
+		t.Errorf("reverted = %v, want types file with a type failed to revert not reverted", reverted)
+	}
+}
+
+func TestRollbackDoesNotRestoreCampaignsAndRuns(t *testing.T) {
+	cortex := newFakeCortex(map[string]string{
+		"campaign/offers": `{"name": "offers"}`,
+		"run/churn/1":     `{"experimentName": "churn", "runId": "1", "meta": "old"}`,
+	})
+	tx := NewTransaction(cortex)
+	campaign := Resource{Kind: KIND_CAMPAIGN, Name: "offers"}
+	existingRun := testResource(KIND_RUN, "runs/1.json", `{"experimentName": "churn", "runId": "1", "meta": "new"}`)
+	createdRun := testResource(KIND_RUN, "runs/2.json", `{"experimentName": "churn", "runId": "2"}`)
+	for _, resource := range []Resource{campaign, existingRun, createdRun} {
+		if err := tx.Capture(resource); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cortex.resources["run/churn/2"] = createdRun.Content
+
+	reverted, err := tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reverted.Contains(campaign) || reverted.Contains(existingRun) {
+		t.Errorf("reverted = %v, want existing campaign and run not reported as reverted", reverted)
+	}
+	// created run can be deleted
+	if !reverted.Contains(createdRun) {
+		t.Errorf("created run not reported as reverted")
+	}
+	if want := []string{"delete run/churn/2"}; !reflect.DeepEqual(cortex.calls, want) {
+		t.Errorf("rollback calls = %v, want %v", cortex.calls, want)
+	}
+}
+
+func TestCaptureFailure(t *testing.T) {
+	cortex := newFakeCortex(map[string]string{"skill/report": `{"name": "report"}`})
+	cortex.fail["get skill/report"] = true
+	tx := NewTransaction(cortex)
+	err := tx.Capture(Resource{Kind: KIND_SKILL, Name: "report"})
+	if err == nil || !strings.Contains(err.Error(), "failed to capture current definition of skill report") {
+		t.Fatalf("Capture error = %v, want failure to fetch skill", err)
+	}
+	// resource not captured isn't reverted
+	if reverted, err := tx.Rollback(); err != nil || len(reverted) != 0 || len(cortex.calls) != 0 {
+		t.Errorf("Rollback = %v, %v with calls %v, want nothing to roll back", reverted, err, cortex.calls)
+	}
+
+	var nilTx *Transaction
+	if err := nilTx.Capture(Resource{Kind: KIND_SKILL, Name: "report"}); err != nil {
+		t.Errorf("Capture of nil transaction = %v", err)
+	}
+	if reverted, err := nilTx.Rollback(); err != nil || len(reverted) != 0 {
+		t.Errorf("Rollback of nil transaction = %v, %v", reverted, err)
+	}
+}
+
+func TestDeploySnapshotRollsBackAtomically(t *testing.T) {
+	snapshot := filepath.Join(t.TempDir(), "snapshot.json")
+	content := `{
+		"agent": {"name": "agent", "skills": [{"skillName": "report"}]},
+		"dependencies": {
+			"actions": [{"name": "loader", "image": "loader:2", "type": "job"}],
+			"skills": [{"name": "report", "actions": [{"name": "loader"}]}]
+		}
+	}`
+	if err := ioutil.WriteFile(snapshot, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cortex := newFakeCortex(map[string]string{"action/loader": `{"name": "loader", "image": "loader:1", "type": "job"}`})
+	cortex.fail["agent/agent"] = true
+	err := DeploySnapshot(cortex, snapshot, nil, true)
+	if err == nil || !strings.Contains(err.Error(), "failed to deploy agent agent") {
+		t.Fatalf("DeploySnapshot error = %v, want failure of agent", err)
+	}
+	assertJsonEqual(t, "restored action", cortex.resources["action/loader"], `{"name": "loader", "image": "loader:1", "type": "job"}`)
+	if _, ok := cortex.resources["skill/report"]; ok {
+		t.Errorf("skill created by snapshot not deleted")
+	}
+
+	// without atomic, deployed resources are left as deployed
+	cortex = newFakeCortex(map[string]string{"action/loader": `{"name": "loader", "image": "loader:1", "type": "job"}`})
+	cortex.fail["agent/agent"] = true
+	if err := DeploySnapshot(cortex, snapshot, nil, false); err == nil {
+		t.Fatal("DeploySnapshot with failed agent succeeded")
+	}
+	assertJsonEqual(t, "deployed action", cortex.resources["action/loader"], `{"name": "loader", "image": "loader:2", "type": "job"}`)
+	if _, ok := cortex.resources["skill/report"]; !ok {
+		t.Errorf("skill deployed without atomic is deleted")
+	}
+}
@@ -22,9 +22,9 @@ var ScriptGenerator = template.Must(template.New("jsonnet").Parse(`
 // Transform
 //Apply transformation on exported cortex resources in json/yaml as:
 //	Add the json files to be transformed as import in the jsonnet provided in variable names `object`. Convert yaml to json
-//	Add all env var, project, kind, artifactsDir and manifestFile as ext var and can be read in script by `std.extVar`
+//	Add all env var, project, kind, artifactsDir and manifestFile as ext var and can be read in script by `std.extVar`. `vars` override env vars
 //	Return output JSON to be imported to target env
-func Transform(resourceFile string, scriptPath string, kind string, artifactsDir string, manifestFile string) (string, error) {
+func Transform(resourceFile string, scriptPath string, kind string, artifactsDir string, manifestFile string, vars map[string]string) (string, error) {
 	vm := jsonnet.MakeVM()
 	vm.ErrorFormatter.SetColorFormatter(color.New(color.FgRed).Fprintf)
 
@@ -32,6 +32,9 @@ func Transform(resourceFile string, scriptPath string, kind string, artifactsDir
 		variable := strings.Split(element, "=")
 		vm.ExtVar(variable[0], variable[1])
 	}
+	for name, value := range vars {
+		vm.ExtVar(name, value)
+	}
 	vm.ExtVar("kind", kind)
 	vm.ExtVar("artifactsDir", artifactsDir)
 	vm.ExtVar("manifestFile", manifestFile)
@@ -54,14 +57,25 @@ func Transform(resourceFile string, scriptPath string, kind string, artifactsDir
 	return vm.EvaluateAnonymousSnippet(scriptPath, script)
 }
 
+// GetResourceAsJson writes resource as JSON to a new temp file in `_tmp` of artifactsDir, so concurrent transformations never share a file
 func GetResourceAsJson(resourceFile string, artifactsDir string) string {
 	resource, err := GetJsonContent(resourceFile)
 	if err != nil {
 		log.Fatal(err)
 	}
-	resourcePath := filepath.Join(artifactsDir, "_tmp", strings.Replace(resourceFile, artifactsDir, "", 1)) + ".json"
-	WriteToPath(resourcePath, resource)
-	return resourcePath
+	tmpDir := filepath.Join(artifactsDir, "_tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		log.Fatalln("Failed to write resource", resourceFile, "as JSON", err)
+	}
+	file, err := ioutil.TempFile(tmpDir, strings.TrimSuffix(filepath.Base(resourceFile), filepath.Ext(resourceFile))+"-*.json")
+	if err != nil {
+		log.Fatalln("Failed to write resource", resourceFile, "as JSON", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(resource); err != nil {
+		log.Fatalln("Failed to write resource", resourceFile, "as JSON", err)
+	}
+	return file.Name()
 }
 
 func WriteToPath(resourcePath string, content []byte) {
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fabric-ops/cmd/deploy"
+	"fmt"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+)
+
+var diffCmd = &cobra.Command{
+	Use:                   "diff  <RepoRootDir>  [-m <manifest file>]",
+	Args:                  validateArgs,
+	DisableFlagsInUseLine: true,
+	Short:                 "Compare Cortex resources in manifest file <fabric.yaml> with resources in Cortex project",
+	Long: `Compare Cortex resources in manifest file <fabric.yaml>, after applying transformers, with resources in Cortex project.
+Server managed fields (like _id, _version, _createdAt) are ignored. Differences are shown as:
+	+ <field>: <value in repo>                       field only in repo
+	- <field>: <value in Cortex>                     field only in Cortex
+	~ <field>: <value in Cortex> => <value in repo>  field changed`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var repoDir = args[0]
+		manifestFile := cmd.Flag("manifest").Value.String()
+		if manifestFile == "" {
+			manifestFile = defaultManifestFile
+		}
+		ignoreCortexOnly, _ := cmd.Flags().GetBool("ignore-cortex-only")
+		exitCode, _ := cmd.Flags().GetBool("exit-code")
+
+		log.Println("Comparing Cortex resources from manifest ", manifestFile, " in repo ", repoDir)
+		if diffCortexManifest(repoDir, manifestFile, ignoreCortexOnly) && exitCode {
+			os.Exit(1)
+		}
+	},
+}
+
+// diffCortexManifest prints differences of each resource in manifest with Cortex project, returns true if there are any differences
+func diffCortexManifest(repoDir string, manifestFilePath string, ignoreCortexOnly bool) bool {
+	var cortex = createCortexClientFromConfig()
+	workDir, removeWorkDir := newWorkDir(repoDir)
+	defer removeWorkDir()
+	resources := manifestResources(cortex, repoDir, workDir, manifestFilePath, nil).Resources
+
+	changed := 0
+	for _, resource := range resources {
+		if resource.Kind == deploy.KIND_CAMPAIGN {
+			log.Println("Skipping campaign ", resource.Name, ". Comparing campaigns is not supported")
+			continue
+		}
+		diffs, err := deploy.DiffResource(cortex, resource)
+		if err != nil {
+			log.Fatalln("Failed to fetch ", resource.Kind, " ", resource.Name, " from Cortex. Error: ", err)
+		}
+		for _, diff := range diffs {
+			var differences []deploy.Difference
+			for _, difference := range diff.Differences {
+				if !ignoreCortexOnly || difference.Op != deploy.DIFF_REMOVED {
+					differences = append(differences, difference)
+				}
+			}
+			if !diff.Missing && len(differences) == 0 {
+				continue
+			}
+			changed++
+			fmt.Println("===", diff.Kind, diff.Name, "(", diff.Source, ")")
+			if diff.Missing {
+				fmt.Println("  not found in Cortex project")
+			}
+			for _, difference := range differences {
+				fmt.Println(" ", difference)
+			}
+		}
+	}
+	log.Println(changed, "of", len(resources), "resources differ from Cortex project")
+	return changed > 0
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+	diffCmd.Flags().StringP("manifest", "m", defaultManifestFile, "Relative path of Manifest file <fabric.yaml>")
+	diffCmd.Flags().Bool("ignore-cortex-only", false, "Ignore fields only in Cortex resources (like defaults set by Cortex)")
+	diffCmd.Flags().Bool("exit-code", false, "Exit with code 1 if there are differences")
+}
@@ -0,0 +1,271 @@
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fabric-ops/cmd/deploy"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/tidwall/gjson"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var exportCmd = &cobra.Command{
+	Use:                   "export  <RepoRootDir>  [--agent <name>]... [--campaign <name>]... [--model <name>]... [--experiment <name>]... [--type <name>]... [--connection <name>]... [-m <manifest file>]",
+	Args:                  validateArgs,
+	DisableFlagsInUseLine: true,
+	Short:                 "Export Cortex resources from Cortex project (v6) into `.fabric` folder and manifest file <fabric.yaml> of repo",
+	Long: `Export Cortex resources from Cortex project (v6) into ` + "`.fabric`" + ` folder of repo and add them to manifest file <fabric.yaml>, for deploying using ` + "`fabric deploy`" + `.
+Agents are snapshot with their dependencies (types, datasets, actions and skills) and the snapshots are exported. Campaigns are exported with their dependencies.
+Experiments are exported with all runs and artifacts of runs. Existing files and manifest entries are overwritten.
+	.fabric/snapshots/<agent>.json
+	.fabric/<campaign>/
+	.fabric/models/<model>.json
+	.fabric/experiments/<experiment>.json
+	.fabric/runs/<experiment>/<run id>.json
+	.fabric/artifacts/<experiment>/<run id>/<artifact>
+	.fabric/types/<type>.json
+	.fabric/connections/<connection>.json
+Credentials of connections are not exported, they are replaced with secret references secret://env/<CONNECTION>_<PARAMETER>`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var repoDir = args[0]
+		manifestFile := cmd.Flag("manifest").Value.String()
+		if manifestFile == "" {
+			manifestFile = defaultManifestFile
+		}
+		var request exportRequest
+		request.Agents, _ = cmd.Flags().GetStringArray("agent")
+		request.Campaigns, _ = cmd.Flags().GetStringArray("campaign")
+		request.Models, _ = cmd.Flags().GetStringArray("model")
+		request.Experiments, _ = cmd.Flags().GetStringArray("experiment")
+		request.Types, _ = cmd.Flags().GetStringArray("type")
+		request.Connections, _ = cmd.Flags().GetStringArray("connection")
+		request.SnapshotTitle = cmd.Flag("snapshot-title").Value.String()
+
+		log.Println("Exporting Cortex resources to manifest ", manifestFile, " in repo ", repoDir)
+		if err := exportCortexResources(repoDir, manifestFile, request); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("Exported Cortex resources to manifest", manifestFile)
+	},
+}
+
+// exportRequest is names of resources to export, by kind
+type exportRequest struct {
+	Agents        []string
+	Campaigns     []string
+	Models        []string
+	Experiments   []string
+	Types         []string
+	Connections   []string
+	SnapshotTitle string
+}
+
+// exportCortexResources fetches resources from Cortex project, writes them in `.fabric` folder and adds them to manifest. Manifest is created if it doesn't exist
+func exportCortexResources(repoDir string, manifestFilePath string, request exportRequest) error {
+	cortexClient, ok := createCortexClientFromConfig().(*deploy.CortexClientV6)
+	if !ok {
+		return fmt.Errorf("configured Cortex URL and token are not of v6. Export is supported in v6 onwards")
+	}
+	cortex := *cortexClient
+
+	manifestPath := filepath.Join(repoDir, manifestFilePath)
+	var manifest deploy.Manifest
+	if _, err := os.Stat(manifestPath); err == nil {
+		manifest = deploy.NewManifest(manifestPath)
+	}
+	exporter := resourceExporter{repoDir: repoDir, manifest: &manifest}
+
+	for _, agent := range request.Agents {
+		snapshotId, err := deploy.CreateAgentSnapshot(cortex, agent, request.SnapshotTitle)
+		if err != nil {
+			return fmt.Errorf("failed to snapshot agent %s: %w", agent, err)
+		}
+		log.Println("Created snapshot", snapshotId, "of agent", agent)
+		snapshot, err := deploy.GetAgentSnapshot(cortex, agent, snapshotId)
+		if err != nil {
+			return fmt.Errorf("failed to export snapshot %s of agent %s: %w", snapshotId, agent, err)
+		}
+		if err := exporter.writeJson(deploy.KIND_SNAPSHOT, path.Join("snapshots", agent+".json"), snapshot); err != nil {
+			return err
+		}
+	}
+	for _, campaign := range request.Campaigns {
+		archive, err := deploy.ExportCampaign(cortex, campaign)
+		if err != nil {
+			return fmt.Errorf("failed to export campaign %s: %w", campaign, err)
+		}
+		campaignDir := filepath.Join(repoDir, deploy.ARTIFACT_DIR, campaign)
+		os.RemoveAll(campaignDir)
+		if err := unzipArchive(archive, campaignDir); err != nil {
+			return fmt.Errorf("failed to extract campaign %s: %w", campaign, err)
+		}
+		manifest.Add(deploy.KIND_CAMPAIGN, path.Join(deploy.ARTIFACT_DIR, campaign))
+		log.Println("Exported campaign", campaign, "to", campaignDir)
+	}
+	for _, model := range request.Models {
+		if err := exporter.exportResource(cortex, deploy.KIND_MODEL, model, "models"); err != nil {
+			return err
+		}
+	}
+	for _, experiment := range request.Experiments {
+		if err := exporter.exportResource(cortex, deploy.KIND_EXPERIMENT, experiment, "experiments"); err != nil {
+			return err
+		}
+		if err := exporter.exportRuns(cortex, experiment); err != nil {
+			return err
+		}
+	}
+	for _, typ := range request.Types {
+		if err := exporter.exportResource(cortex, deploy.KIND_TYPE, typ, "types"); err != nil {
+			return err
+		}
+	}
+	for _, connection := range request.Connections {
+		if err := exporter.exportConnection(cortex, connection); err != nil {
+			return err
+		}
+	}
+	return manifest.Save(manifestPath)
+}
+
+// resourceExporter writes exported resources in `.fabric` folder of repo and adds them to manifest
+type resourceExporter struct {
+	repoDir  string
+	manifest *deploy.Manifest
+}
+
+func (e resourceExporter) exportResource(cortex deploy.CortexClientV6, kind string, name string, dir string) error {
+	content, err := cortex.GetResourceJson(kind, name)
+	if err != nil {
+		return fmt.Errorf("failed to export %s %s: %w", kind, name, err)
+	}
+	return e.writeJson(kind, path.Join(dir, name+".json"), deploy.UnwrapResource(kind, content))
+}
+
+// exportConnection exports connection with its credentials replaced by secret references of env vars, so credentials aren't committed to repo
+func (e resourceExporter) exportConnection(cortex deploy.CortexClientV6, name string) error {
+	content, err := cortex.GetResourceJson(deploy.KIND_CONNECTION, name)
+	if err != nil {
+		return fmt.Errorf("failed to export %s %s: %w", deploy.KIND_CONNECTION, name, err)
+	}
+	content, envVars, err := deploy.ReplaceConnectionSecrets(name, deploy.UnwrapResource(deploy.KIND_CONNECTION, content))
+	if err != nil {
+		return fmt.Errorf("failed to export %s %s: %w", deploy.KIND_CONNECTION, name, err)
+	}
+	for _, envVar := range envVars {
+		log.Println("[WARN] Credential of connection", name, "is not exported, it is replaced with reference secret://env/"+envVar+". Set env var", envVar, "(or change reference to a secret file or Vault) before deploying")
+	}
+	return e.writeJson(deploy.KIND_CONNECTION, path.Join("connections", name+".json"), content)
+}
+
+// exportRuns exports all runs of experiment with artifacts. Artifact paths in run are replaced with path of downloaded artifacts (relative to `.fabric`), as expected by DeployExperimentRun
+func (e resourceExporter) exportRuns(cortex deploy.CortexClientV6, experiment string) error {
+	runs, err := deploy.ListExperimentRuns(cortex, experiment)
+	if err != nil {
+		return fmt.Errorf("failed to export runs of experiment %s: %w", experiment, err)
+	}
+	for _, run := range runs {
+		runId := run.Get("runId").String()
+		content := map[string]interface{}{}
+		json.Unmarshal([]byte(run.Raw), &content)
+		content["experimentName"] = experiment
+		artifacts := map[string]interface{}{}
+		var artifactErr error
+		run.Get("artifacts").ForEach(func(key, value gjson.Result) bool {
+			artifactPath := path.Join("artifacts", experiment, runId, key.String())
+			artifact, err := deploy.DownloadRunArtifact(cortex, experiment, runId, key.String())
+			if err == nil {
+				err = writeFile(filepath.Join(e.repoDir, deploy.ARTIFACT_DIR, filepath.FromSlash(artifactPath)), artifact)
+			}
+			if err != nil {
+				artifactErr = fmt.Errorf("failed to export artifact %s of run %s/%s: %w", key.String(), experiment, runId, err)
+				return false
+			}
+			artifacts[key.String()] = artifactPath
+			return true
+		})
+		if artifactErr != nil {
+			return artifactErr
+		}
+		if len(artifacts) > 0 {
+			content["artifacts"] = artifacts
+		}
+		runJson, _ := json.Marshal(content)
+		if err := e.writeJson(deploy.KIND_RUN, path.Join("runs", experiment, runId+".json"), runJson); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeJson writes resource without server managed fields to `.fabric/<relPath>` and adds it to manifest
+func (e resourceExporter) writeJson(kind string, relPath string, content []byte) error {
+	formatted, err := json.MarshalIndent(deploy.NormalizeJson(content), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to export %s %s: %w", kind, relPath, err)
+	}
+	manifestPath := path.Join(deploy.ARTIFACT_DIR, relPath)
+	if err := writeFile(filepath.Join(e.repoDir, filepath.FromSlash(manifestPath)), formatted); err != nil {
+		return fmt.Errorf("failed to export %s %s: %w", kind, relPath, err)
+	}
+	e.manifest.Add(kind, manifestPath)
+	log.Println("Exported", kind, "to", manifestPath)
+	return nil
+}
+
+func writeFile(filename string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, content, 0644)
+}
+
+// unzipArchive extracts zip archive to directory. Entries outside of the directory are rejected
+func unzipArchive(archive []byte, dir string) error {
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return err
+	}
+	for _, file := range reader.File {
+		target := filepath.Join(dir, filepath.FromSlash(file.Name))
+		if !strings.HasPrefix(target, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return fmt.Errorf("invalid file path %s in archive", file.Name)
+		}
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		entry, err := file.Open()
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadAll(io.LimitReader(entry, int64(file.UncompressedSize64)))
+		entry.Close()
+		if err != nil {
+			return err
+		}
+		if err := writeFile(target, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().StringP("manifest", "m", defaultManifestFile, "Relative path of Manifest file <fabric.yaml>")
+	exportCmd.Flags().StringArray("agent", nil, "Name of agent to snapshot and export. Can be repeated")
+	exportCmd.Flags().StringArray("campaign", nil, "Name of campaign to export. Can be repeated")
+	exportCmd.Flags().StringArray("model", nil, "Name of model to export. Can be repeated")
+	exportCmd.Flags().StringArray("experiment", nil, "Name of experiment to export with its runs. Can be repeated")
+	exportCmd.Flags().StringArray("type", nil, "Name of type to export. Can be repeated")
+	exportCmd.Flags().StringArray("connection", nil, "Name of connection to export. Can be repeated")
+	exportCmd.Flags().String("snapshot-title", "DeploymentSnapshot", "Title of agent snapshots created for export")
+}
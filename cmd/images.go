@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"fabric-ops/cmd/build"
+	"fabric-ops/cmd/config"
+	"fabric-ops/cmd/deploy"
+	"fabric-ops/cmd/registry"
+	"github.com/spf13/cobra"
+	"github.com/tidwall/gjson"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+var imagesCmd = &cobra.Command{
+	Use:   "images",
+	Short: "Manage Docker images of Cortex actions",
+	Long:  `Manage Docker images of Cortex actions in Docker registries`,
+}
+
+var copyImagesCmd = &cobra.Command{
+	Use:                   "copy  <RepoRootDir>  [--from <registry>]  [--to <registry>]  [-m <manifest file>]",
+	Args:                  validateArgs,
+	DisableFlagsInUseLine: true,
+	Short:                 "Copy Docker images of actions in manifest file <fabric.yaml> to other registry",
+	Long: `Copy Docker images used by actions (and actions in agent snapshots) of manifest file <fabric.yaml> to other registry, like registry of other DCI.
+Images are copied blob by blob using registry API without docker daemon, preserving digests. Each registry is authenticated with its own credentials
+from docker config (or Cortex token for DCI registry). Images are copied to <registry>/<DOCKER_PREGISTRY_PREFIX>/<image name> with same tag (or digest).
+Target registry defaults to DOCKER_PREGISTRY_URL, or Docker registry of Cortex DCI`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var repoDir = args[0]
+		manifestFile := cmd.Flag("manifest").Value.String()
+		if manifestFile == "" {
+			manifestFile = defaultManifestFile
+		}
+		from := cmd.Flag("from").Value.String()
+		to := strings.Trim(cmd.Flag("to").Value.String(), "/")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+		namespace := config.Get(config.DOCKER_PREGISTRY_PREFIX)
+		if to == "" {
+			to, namespace = dockerRegistryAndNamespace(namespace)
+		} else if namespace == "" {
+			namespace = createCortexClientFromConfig().GetAccount()
+		}
+		images := manifestImages(repoDir, manifestFile)
+		log.Println("Copying ", len(images), " Docker images of actions in manifest ", manifestFile, " to registry ", to, " and namespace ", namespace)
+		var failed []string
+		for _, image := range images {
+			if from != "" && !registry.IsSameRegistry(image, from) {
+				log.Println("Skipping ", image, ", it is not in registry ", from)
+				continue
+			}
+			target := targetImage(image, namespace, to)
+			if target == image {
+				log.Println("Skipping ", image, ", it is already in registry ", to)
+				continue
+			}
+			if dryRun {
+				log.Println("Would copy ", image, " to ", target)
+				continue
+			}
+			if _, err := registry.CopyImage(image, target, log.Default()); err != nil {
+				log.Println(err)
+				failed = append(failed, image)
+			}
+		}
+		if len(failed) > 0 {
+			log.Fatalln("Failed to copy ", len(failed), " of ", len(images), " Docker images: ", strings.Join(failed, ", "))
+		}
+	},
+}
+
+// manifestImages returns images used by actions in manifest and actions in its snapshots, in order of manifest without duplicates
+func manifestImages(repoDir string, manifestFilePath string) []string {
+	manifest := deploy.NewManifest(filepath.Join(repoDir, manifestFilePath))
+	var images []string
+	seen := map[string]bool{}
+	add := func(action gjson.Result) {
+		if image := action.Get("image").String(); image != "" && !seen[image] {
+			seen[image] = true
+			images = append(images, image)
+		}
+	}
+	read := func(kind string, path string) gjson.Result {
+		content, err := deploy.GetJsonContent(filepath.Join(repoDir, parseManifestResourcePath(path)))
+		if err != nil {
+			log.Fatalln("Failed to read Cortex ", kind, " file ", path, " Error: ", err)
+		}
+		return gjson.ParseBytes(content)
+	}
+	for _, action := range manifest.Cortex.Action {
+		add(read(deploy.KIND_ACTION, action))
+	}
+	for _, snapshot := range manifest.Cortex.Snapshots {
+		read(deploy.KIND_SNAPSHOT, snapshot).Get("dependencies.actions").ForEach(func(key, value gjson.Result) bool {
+			add(value)
+			return true
+		})
+	}
+	return images
+}
+
+// targetImage returns image with same name and tag in registry and namespace. Image referenced only by digest is referenced by digest in registry
+func targetImage(image string, namespace string, dockerRegistry string) string {
+	reference := registry.ParseReference(image)
+	name := deploy.DockerImageName(image)
+	if reference.Tag == "" {
+		return build.Image{Image: build.DockerImageTag(namespace, name, "latest", dockerRegistry), Digest: reference.Digest}.Pinned()
+	}
+	return build.DockerImageTag(namespace, name, reference.Tag, dockerRegistry)
+}
+
+func init() {
+	rootCmd.AddCommand(imagesCmd)
+	imagesCmd.AddCommand(copyImagesCmd)
+	copyImagesCmd.Flags().StringP("manifest", "m", defaultManifestFile, "Relative path of Manifest file <fabric.yaml>")
+	copyImagesCmd.Flags().String("from", "", "Registry to copy images from. Images of actions in other registries are not copied. Defaults to registry of each image")
+	copyImagesCmd.Flags().String("to", "", "Registry to copy images to. Defaults to DOCKER_PREGISTRY_URL, or Docker registry of Cortex DCI")
+	copyImagesCmd.Flags().Bool("dry-run", false, "Show images to be copied without copying")
+}
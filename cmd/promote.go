@@ -0,0 +1,297 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fabric-ops/cmd/config"
+	"fabric-ops/cmd/deploy"
+	"fabric-ops/cmd/registry"
+	"fabric-ops/cmd/report"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var promoteCmd = &cobra.Command{
+	Use:                   "promote  <RepoRootDir>  --from <environment>  --to <environment>  [-m <manifest file>]",
+	Args:                  validateArgs,
+	DisableFlagsInUseLine: true,
+	Short:                 "Deploy resources of manifest file <fabric.yaml> as deployed in one environment to other environment",
+	Long: `Deploy resources of manifest file <fabric.yaml> as deployed in source environment (like dev) to target environment (like prod). Environments are named environments in config files.
+Current definitions of agents, skills, actions, types, models, experiments, snapshots (agent and its dependencies) and campaigns are fetched from source project,
+transformers of target environment are applied and the resources are deployed to target project. Docker images of actions are copied to target Docker registry.
+Connections and experiment runs are environment specific, so those are deployed from repo.
+Source environment is read from config files only. Flags and env vars (like CORTEX_TOKEN) are settings of target environment.`,
+	// errors are logged by Execute, after report is written
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var repoDir = args[0]
+		manifestFile := cmd.Flag("manifest").Value.String()
+		if manifestFile == "" {
+			manifestFile = defaultManifestFile
+		}
+		from := cmd.Flag("from").Value.String()
+		to := cmd.Flag("to").Value.String()
+		copyImages, _ := cmd.Flags().GetBool("copy-images")
+		options := getDeployOptions(cmd, manifestFile)
+
+		log.Println("Promoting Cortex resources from manifest ", manifestFile, " in repo ", repoDir, " from ", from, " to ", to)
+		err := promoteManifest(repoDir, manifestFile, from, to, copyImages, options)
+		writeReport(cmd, options.Report)
+		return err
+	},
+}
+
+// promoteManifest copies repo to a work directory replacing resources with their definitions in source environment, and deploys it to target environment
+func promoteManifest(repoDir string, manifestFilePath string, from string, to string, copyImages bool, options deployOptions) error {
+	for _, env := range []string{from, to} {
+		if !config.Exists(env) {
+			return errors.New(fmt.Sprint("Environment ", env, " is not defined in ~/", config.USER_CONFIG_FILE, " or ", config.REPO_CONFIG_FILE, " of repo"))
+		}
+	}
+	// flags and env vars apply to target environment, which is selected below, so source settings are only from config files.
+	// Otherwise source would use target credentials whenever those are passed as env vars in CI
+	source := createCortexClient(func(key string) string {
+		return config.GetFromEnvironment(from, key)
+	})
+	// target environment is selected, so deployment uses its settings and transformers
+	if err := config.Load(repoDir, to); err != nil {
+		return err
+	}
+
+	promoteDir, removePromoteDir := newWorkDir(repoDir)
+	defer removePromoteDir()
+	if err := copyDir(filepath.Join(repoDir, deploy.ARTIFACT_DIR), filepath.Join(promoteDir, deploy.ARTIFACT_DIR)); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", deploy.ARTIFACT_DIR, err)
+	}
+	if err := copyFile(filepath.Join(repoDir, manifestFilePath), filepath.Join(promoteDir, manifestFilePath)); err != nil {
+		return fmt.Errorf("failed to copy manifest: %w", err)
+	}
+
+	promoter := resourcePromoter{source: source, repoDir: repoDir, promoteDir: promoteDir, copyImages: copyImages && !options.DryRun, images: map[string]string{}, report: options.Report}
+	manifest := deploy.NewManifest(filepath.Join(repoDir, manifestFilePath))
+	var campaigns []string
+	for _, campaign := range manifest.Cortex.Campaign {
+		dir := campaignDir(parseManifestResourcePath(campaign))
+		if err := promoter.promoteCampaign(dir); err != nil {
+			return err
+		}
+		campaigns = append(campaigns, dir)
+	}
+	// resources promoted with campaign, other kinds in campaign directory are promoted individually
+	inCampaign := func(kind string, relPath string) bool {
+		if !deploy.DeployedWithCampaign(kind) {
+			return false
+		}
+		for _, campaign := range campaigns {
+			if strings.HasPrefix(relPath, campaign) {
+				return true
+			}
+		}
+		return false
+	}
+	kinds := []struct {
+		kind  string
+		paths []string
+	}{
+		{deploy.KIND_TYPE, manifest.Cortex.Type},
+		{deploy.KIND_MODEL, manifest.Cortex.Model},
+		{deploy.KIND_EXPERIMENT, manifest.Cortex.Experiment},
+		{deploy.KIND_ACTION, manifest.Cortex.Action},
+		{deploy.KIND_SKILL, manifest.Cortex.Skill},
+		{deploy.KIND_AGENT, manifest.Cortex.Agent},
+		{deploy.KIND_SNAPSHOT, manifest.Cortex.Snapshots},
+	}
+	for _, k := range kinds {
+		for _, path := range k.paths {
+			relPath := parseManifestResourcePath(path)
+			if inCampaign(k.kind, relPath) {
+				continue
+			}
+			if err := promoter.promoteResource(k.kind, relPath); err != nil {
+				return err
+			}
+		}
+	}
+	return deployCortexManifest(promoteDir, manifestFilePath, nil, options)
+}
+
+// resourcePromoter writes resources as defined in source environment to promote directory
+type resourcePromoter struct {
+	source     deploy.CortexAPI
+	repoDir    string
+	promoteDir string
+	copyImages bool
+	images     map[string]string // source image to image in target registry
+	registry   string
+	namespace  string
+	report     *report.Report
+}
+
+func (p *resourcePromoter) promoteResource(kind string, relPath string) error {
+	content, err := deploy.GetJsonContent(filepath.Join(p.repoDir, relPath))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", relPath, err)
+	}
+	var promoted []byte
+	switch kind {
+	case deploy.KIND_SNAPSHOT:
+		promoted, err = p.promoteSnapshot(content)
+	case deploy.KIND_TYPE:
+		var types []interface{}
+		for _, definition := range deploy.TypeDefinitions(content) {
+			live, err := p.liveDefinition(kind, deploy.ResourceName(kind, []byte(definition.Raw)))
+			if err != nil {
+				return err
+			}
+			types = append(types, json.RawMessage(live))
+		}
+		promoted, err = json.Marshal(map[string]interface{}{"types": types})
+	default:
+		promoted, err = p.liveDefinition(kind, deploy.ResourceName(kind, content))
+	}
+	if err != nil {
+		return err
+	}
+	log.Println("Promoting", kind, deploy.ResourceName(kind, promoted), "(", relPath, ")")
+	// JSON is valid YAML, so resources in YAML files are written as JSON in same path
+	deploy.WriteToPath(filepath.Join(p.promoteDir, relPath), promoted)
+	return nil
+}
+
+// promoteSnapshot replaces agent and dependencies of snapshot with their definitions in source environment
+func (p *resourcePromoter) promoteSnapshot(content []byte) ([]byte, error) {
+	snapshot := string(content)
+	agent, err := p.liveDefinition(deploy.KIND_AGENT, gjson.Get(snapshot, "agent.name").String())
+	if err != nil {
+		return nil, err
+	}
+	if snapshot, err = sjson.SetRaw(snapshot, "agent", string(agent)); err != nil {
+		return nil, err
+	}
+	dependencies := map[string]string{"types": deploy.KIND_TYPE, "datasets": deploy.KIND_DATASET, "actions": deploy.KIND_ACTION, "skills": deploy.KIND_SKILL}
+	for group, kind := range dependencies {
+		var promoteErr error
+		gjson.Get(snapshot, "dependencies."+group).ForEach(func(key, value gjson.Result) bool {
+			live, err := p.liveDefinition(kind, deploy.ResourceName(kind, []byte(value.Raw)))
+			if err == nil {
+				snapshot, err = sjson.SetRaw(snapshot, "dependencies."+group+"."+key.String(), string(live))
+			}
+			promoteErr = err
+			return err == nil
+		})
+		if promoteErr != nil {
+			return nil, promoteErr
+		}
+	}
+	return []byte(snapshot), nil
+}
+
+// promoteCampaign replaces campaign directory with campaign exported from source environment
+func (p *resourcePromoter) promoteCampaign(dir string) error {
+	v6Source, ok := p.source.(*deploy.CortexClientV6)
+	if !ok {
+		return errors.New("Campaigns are supported in v6 onwards, source environment is not of v6")
+	}
+	name := filepath.Base(dir)
+	archive, err := deploy.ExportCampaign(*v6Source, name)
+	if err != nil {
+		return fmt.Errorf("failed to export campaign %s from source environment: %w", name, err)
+	}
+	log.Println("Promoting campaign", name, "(", dir, ")")
+	target := filepath.Join(p.promoteDir, dir)
+	os.RemoveAll(target)
+	return unzipArchive(archive, target)
+}
+
+// liveDefinition fetches resource from source environment without server managed fields. Images of actions are replaced with images in target registry
+func (p *resourcePromoter) liveDefinition(kind string, name string) ([]byte, error) {
+	live, err := p.source.GetResourceJson(kind, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s %s from source environment: %w", kind, name, err)
+	}
+	definition, err := json.Marshal(deploy.NormalizeJson(deploy.UnwrapResource(kind, live)))
+	if err != nil || kind != deploy.KIND_ACTION {
+		return definition, err
+	}
+	image := gjson.GetBytes(definition, "image").String()
+	if image == "" {
+		return definition, nil
+	}
+	target, err := p.targetImage(image)
+	if err != nil {
+		return nil, err
+	}
+	return sjson.SetBytes(definition, "image", target)
+}
+
+// targetImage returns image with same name and tag (or digest) in target registry and namespace, copying image if enabled
+func (p *resourcePromoter) targetImage(image string) (string, error) {
+	if target, ok := p.images[image]; ok {
+		return target, nil
+	}
+	if p.registry == "" {
+		p.registry, p.namespace = dockerRegistryAndNamespace(config.Get(config.DOCKER_PREGISTRY_PREFIX))
+		// DCI registry of source environment accepts its Cortex token, used if docker config doesn't have credentials of it
+		if p.copyImages {
+			if sourceRegistry, err := p.source.GetDockerRegistry(); err == nil && registry.NormalizeHost(sourceRegistry) != registry.NormalizeHost(p.registry) {
+				registry.SetDefaultCredentials(sourceRegistry, registry.Credentials{Username: "cli", Password: p.source.GetToken()})
+			}
+		}
+	}
+	target := targetImage(image, p.namespace, p.registry)
+	if target != image && p.copyImages {
+		start := time.Now()
+		digest, err := registry.CopyImage(image, target, log.Default())
+		result := report.ImageResult{Name: image, Image: target, Digest: digest, Duration: time.Since(start).Milliseconds()}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		p.report.AddImage(result)
+		if err != nil {
+			return "", fmt.Errorf("failed to copy image %s to %s: %w", image, target, err)
+		}
+	}
+	p.images[image] = target
+	return target, nil
+}
+
+func copyDir(source string, target string) error {
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relPath, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		return copyFile(path, filepath.Join(target, relPath))
+	})
+}
+
+func copyFile(source string, target string) error {
+	content, err := ioutil.ReadFile(source)
+	if err != nil {
+		return err
+	}
+	return writeFile(target, content)
+}
+
+func init() {
+	rootCmd.AddCommand(promoteCmd)
+	promoteCmd.Flags().StringP("manifest", "m", defaultManifestFile, "Relative path of Manifest file <fabric.yaml>")
+	promoteCmd.Flags().String("from", "", "Source environment in config files")
+	promoteCmd.Flags().String("to", "", "Target environment in config files")
+	promoteCmd.Flags().Bool("copy-images", true, "Copy docker images of actions to target Docker registry. Disable if registry is shared by environments")
+	promoteCmd.Flags().Bool("dry-run", false, "Show resources to be created, updated or unchanged in target environment without copying images or deploying")
+	promoteCmd.MarkFlagRequired("from")
+	promoteCmd.MarkFlagRequired("to")
+}
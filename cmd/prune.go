@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"bufio"
+	"fabric-ops/cmd/deploy"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// planPrune logs resources which will be deleted by --prune
+func planPrune(cortex deploy.CortexAPI, resources []deploy.Resource) {
+	logSnapshotOnlyKinds(resources)
+	candidates, err := deploy.PruneCandidates(cortex, resources)
+	if err != nil {
+		log.Fatalln("Failed to find resources to prune. Error: ", err)
+	}
+	for _, candidate := range candidates {
+		log.Println("[DELETE]", candidate)
+	}
+	log.Println("Prune:", len(candidates), "to delete")
+}
+
+// pruneCortexResources deletes resources in Cortex project not in manifest, after confirmation unless `yes`. Returns error if any resource failed to delete
+func pruneCortexResources(cortex deploy.CortexAPI, resources []deploy.Resource, yes bool) error {
+	logSnapshotOnlyKinds(resources)
+	candidates, err := deploy.PruneCandidates(cortex, resources)
+	if err != nil {
+		return fmt.Errorf("failed to find resources to prune: %w", err)
+	}
+	if len(candidates) == 0 {
+		log.Println("No resources to prune")
+		return nil
+	}
+	log.Println("Resources in Cortex project not in manifest:")
+	for _, candidate := range candidates {
+		log.Println("  ", candidate)
+	}
+	if !yes && !confirm(fmt.Sprint("Delete ", len(candidates), " resources from Cortex project?")) {
+		log.Println("Skipped pruning resources")
+		return nil
+	}
+	var failed []string
+	for _, candidate := range candidates {
+		if _, err := cortex.DeleteResource(candidate.Kind, candidate.Name); err != nil && !deploy.IsNotFound(err) {
+			failed = append(failed, candidate.String())
+			log.Println("Failed to delete", candidate, ". Error:", err)
+			continue
+		}
+		log.Println("Deleted", candidate)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to delete %d of %d pruned resources: %s", len(failed), len(candidates), strings.Join(failed, ", "))
+	}
+	log.Println("Pruned", len(candidates), "resources")
+	return nil
+}
+
+func logSnapshotOnlyKinds(resources []deploy.Resource) {
+	if kinds := deploy.SnapshotOnlyKinds(resources); len(kinds) > 0 {
+		log.Println("Not pruning", strings.Join(kinds, ", "), "resources, as manifest has them only in snapshots. List them in manifest to prune")
+	}
+}
+
+// confirm asks yes/no question on terminal. Returns false if input is not available, like in CI
+func confirm(question string) bool {
+	fmt.Fprint(os.Stderr, question, " [y/N]: ")
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		fmt.Fprintln(os.Stderr)
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
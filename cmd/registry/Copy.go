@@ -0,0 +1,184 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// descriptor is reference to blob or manifest in a manifest
+type descriptor struct {
+	MediaType string   `json:"mediaType"`
+	Digest    string   `json:"digest"`
+	Size      int64    `json:"size"`
+	URLs      []string `json:"urls"` // foreign layers are downloaded from these, so they aren't copied
+}
+
+// imageCopier copies manifests and blobs of a repository to repository in other (or same) registry
+type imageCopier struct {
+	source           *Client
+	target           *Client
+	sourceRepository string
+	targetRepository string
+	logger           *log.Logger
+	copied           int
+	existing         int
+}
+
+// CopyImage copies image from source registry to target registry over registry API, blob by blob, without docker daemon.
+// Manifests are copied as is, so digest of image is preserved. Multi-platform images are copied with images of all platforms.
+// Image referenced only by digest is copied by digest. Each registry is authenticated with its own credentials. Returns digest of image
+func CopyImage(sourceImage string, targetImage string, logger *log.Logger) (string, error) {
+	source := ParseReference(sourceImage)
+	target := ParseReference(targetImage)
+	if target.Tag == "" && target.Digest == "" {
+		target.Digest = source.Digest
+	}
+	sourceClient, err := NewClient(source.Host)
+	if err != nil {
+		return "", err
+	}
+	targetClient := sourceClient
+	if target.Host != source.Host {
+		if targetClient, err = NewClient(target.Host); err != nil {
+			return "", err
+		}
+	}
+	copier := &imageCopier{source: sourceClient, target: targetClient, sourceRepository: source.Repository, targetRepository: target.Repository, logger: logger}
+	digest, err := copier.copyManifest(source.Name(), target.Name())
+	if err != nil {
+		return "", fmt.Errorf("failed to copy %s to %s: %w", sourceImage, targetImage, err)
+	}
+	if source.Digest != "" && source.Digest != digest {
+		return "", errors.New(fmt.Sprint("digest of ", sourceImage, " in registry is ", digest))
+	}
+	logger.Println("Copied ", sourceImage, " to ", targetImage, " with digest ", digest, " (", copier.copied, " blobs copied, ", copier.existing, " existing)")
+	return digest, nil
+}
+
+// copyManifest copies manifest with blobs it refers to (or manifests of platforms, for multi-platform image), and returns its digest
+func (c *imageCopier) copyManifest(sourceReference string, targetReference string) (string, error) {
+	manifest, mediaType, digest, err := c.source.Manifest(c.sourceRepository, sourceReference)
+	if err != nil {
+		return "", err
+	}
+	var fields struct {
+		Config    descriptor   `json:"config"`
+		Layers    []descriptor `json:"layers"`
+		Manifests []descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(manifest, &fields); err != nil {
+		return "", fmt.Errorf("invalid manifest %s:%s: %w", c.sourceRepository, sourceReference, err)
+	}
+	for _, platform := range fields.Manifests {
+		if _, err := c.copyManifest(platform.Digest, platform.Digest); err != nil {
+			return "", err
+		}
+	}
+	blobs := fields.Layers
+	if fields.Config.Digest != "" {
+		blobs = append([]descriptor{fields.Config}, blobs...)
+	}
+	for _, blob := range blobs {
+		if len(blob.URLs) > 0 {
+			continue
+		}
+		if err := c.copyBlob(blob); err != nil {
+			return "", err
+		}
+	}
+
+	header := http.Header{"Content-Type": {mediaType}}
+	response, err := c.target.Do(http.MethodPut, "/v2/"+c.targetRepository+"/manifests/"+targetReference, c.pushScope(), header, bytes.NewReader(manifest))
+	if err != nil {
+		return "", err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		return "", errors.New(fmt.Sprint("failed to push manifest ", c.targetRepository, ":", targetReference, " to registry ", c.target.Host, ", status ", response.StatusCode))
+	}
+	if pushed := response.Header.Get("Docker-Content-Digest"); pushed != "" && pushed != digest {
+		return "", errors.New(fmt.Sprint("digest of manifest ", c.targetRepository, ":", targetReference, " changed from ", digest, " to ", pushed, " in registry ", c.target.Host))
+	}
+	return digest, nil
+}
+
+// copyBlob uploads blob to target repository unless it exists. Blob is mounted from source repository if both are in same registry
+func (c *imageCopier) copyBlob(blob descriptor) error {
+	response, err := c.target.Do(http.MethodHead, "/v2/"+c.targetRepository+"/blobs/"+blob.Digest, c.pushScope(), nil, nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode == http.StatusOK {
+		c.existing++
+		return nil
+	}
+
+	uploadPath := "/v2/" + c.targetRepository + "/blobs/uploads/"
+	if c.source == c.target {
+		uploadPath += "?" + url.Values{"mount": {blob.Digest}, "from": {c.sourceRepository}}.Encode()
+	}
+	response, err = c.target.Do(http.MethodPost, uploadPath, c.pushScope(), nil, nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode == http.StatusCreated {
+		// mounted
+		c.copied++
+		return nil
+	} else if response.StatusCode != http.StatusAccepted {
+		return errors.New(fmt.Sprint("failed to start upload of blob ", blob.Digest, " to registry ", c.target.Host, ", status ", response.StatusCode))
+	}
+	location, err := response.Request.URL.Parse(response.Header.Get("Location"))
+	if err != nil {
+		return fmt.Errorf("invalid upload location of registry %s: %w", c.target.Host, err)
+	}
+	query := location.Query()
+	query.Set("digest", blob.Digest)
+	location.RawQuery = query.Encode()
+
+	source, err := c.source.Do(http.MethodGet, "/v2/"+c.sourceRepository+"/blobs/"+blob.Digest, "repository:"+c.sourceRepository+":pull", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer source.Body.Close()
+	if source.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprint("failed to get blob ", blob.Digest, " from registry ", c.source.Host, ", status ", source.StatusCode))
+	}
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	if source.ContentLength >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(source.ContentLength, 10))
+	}
+	response, err = c.target.Do(http.MethodPut, location.String(), c.pushScope(), header, source.Body)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		return errors.New(fmt.Sprint("failed to upload blob ", blob.Digest, " to registry ", c.target.Host, ", status ", response.StatusCode))
+	}
+	c.copied++
+	return nil
+}
+
+func (c *imageCopier) pushScope() string {
+	scope := "repository:" + c.targetRepository + ":pull,push"
+	if c.source == c.target && c.sourceRepository != c.targetRepository {
+		// mounting blob needs pull access of source repository in same token
+		scope += " repository:" + c.sourceRepository + ":pull"
+	}
+	return scope
+}
+
+// IsSameRegistry checks whether images are in same registry
+func IsSameRegistry(image string, registry string) bool {
+	return Host(image) == NormalizeHost(strings.TrimSuffix(registry, "/"))
+}
@@ -0,0 +1,143 @@
+package registry
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestCopyImageBetweenRegistries(t *testing.T) {
+	source := newFakeRegistry(t, "bearer")
+	target := newFakeRegistry(t, "basic")
+	manifest := source.addImage("team/app", "v1", "layer one", "layer two")
+	setDockerConfig(t, map[string]Credentials{
+		source.Host(): {Username: "user", Password: "pass"},
+		target.Host(): {Username: "user", Password: "pass"},
+	})
+
+	var output strings.Builder
+	logger := log.New(&output, "", 0)
+	digest, err := CopyImage(source.Host()+"/team/app:v1", target.Host()+"/prod/app:v1", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != digestOf(manifest) {
+		t.Errorf("digest = %s, want %s", digest, digestOf(manifest))
+	}
+	if !bytes.Equal(target.manifests["prod/app:v1"], manifest) {
+		t.Errorf("target manifest = %s, want manifest copied as is", target.manifests["prod/app:v1"])
+	}
+	for key, blob := range source.blobs {
+		digest := key[strings.Index(key, "@")+1:]
+		if !bytes.Equal(target.blobs["prod/app@"+digest], blob) {
+			t.Errorf("blob %s not copied", digest)
+		}
+	}
+	if uploads := target.requestCount("PUT", "/blobs/uploads/"); uploads != 3 {
+		t.Errorf("blobs uploaded = %d, want 3", uploads)
+	}
+	if !strings.Contains(output.String(), "with digest  "+digest) {
+		t.Errorf("copy output = %q", output.String())
+	}
+
+	// blobs existing in target are not uploaded again
+	if _, err := CopyImage(source.Host()+"/team/app:v1", target.Host()+"/prod/app:v2", logger); err != nil {
+		t.Fatal(err)
+	}
+	if uploads := target.requestCount("PUT", "/blobs/uploads/"); uploads != 3 {
+		t.Errorf("blobs uploaded = %d, want existing blobs not uploaded again", uploads)
+	}
+}
+
+func TestCopyImageMountsBlobsInSameRegistry(t *testing.T) {
+	registry := newFakeRegistry(t, "bearer")
+	manifest := registry.addImage("team/app", "v1", "layer one", "layer two")
+	setDockerConfig(t, map[string]Credentials{registry.Host(): {Username: "user", Password: "pass"}})
+
+	digest, err := CopyImage(registry.Host()+"/team/app:v1", registry.Host()+"/prod/app:v1", log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != digestOf(manifest) || !bytes.Equal(registry.manifests["prod/app:v1"], manifest) {
+		t.Errorf("copied manifest = %s with digest %s", registry.manifests["prod/app:v1"], digest)
+	}
+	if mounts := registry.requestCount("POST", "mount="); mounts != 3 {
+		t.Errorf("blobs mounted = %d, want 3", mounts)
+	}
+	if uploads := registry.requestCount("PUT", "/blobs/uploads/"); uploads != 0 {
+		t.Errorf("blobs uploaded = %d, want all mounted", uploads)
+	}
+	// token of mount has push scope of target and pull scope of source repository
+	wantScope := "repository:prod/app:pull,push repository:team/app:pull"
+	found := false
+	for _, scope := range registry.tokenRequests {
+		found = found || scope == wantScope
+	}
+	if !found {
+		t.Errorf("token requests = %v, want %q", registry.tokenRequests, wantScope)
+	}
+}
+
+func TestCopyImageByDigest(t *testing.T) {
+	source := newFakeRegistry(t, "")
+	target := newFakeRegistry(t, "")
+	manifest := source.addImage("team/app", "v1", "layer")
+	setDockerConfig(t, nil)
+
+	digest, err := CopyImage(source.Host()+"/team/app@"+digestOf(manifest), target.Host()+"/prod/app", log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != digestOf(manifest) || !bytes.Equal(target.manifests["prod/app:"+digest], manifest) {
+		t.Errorf("image not copied by digest %s: %v", digest, target.manifests)
+	}
+}
+
+func TestCopyImageVerifiesDigests(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(source *fakeRegistry, target *fakeRegistry, manifest []byte) string // returns source image
+		wantErr string
+	}{
+		{
+			name: "source manifest doesn't match digest",
+			setup: func(source *fakeRegistry, target *fakeRegistry, manifest []byte) string {
+				wrong := "sha256:" + strings.Repeat("0", 64)
+				source.manifests["team/app:"+wrong] = manifest
+				return source.Host() + "/team/app@" + wrong
+			},
+			wantErr: " in registry is sha256:",
+		},
+		{
+			name: "blob doesn't match digest",
+			setup: func(source *fakeRegistry, target *fakeRegistry, manifest []byte) string {
+				source.corruptBlobs = true
+				return source.Host() + "/team/app:v1"
+			},
+			wantErr: "failed to upload blob sha256:",
+		},
+		{
+			name: "target changes manifest digest",
+			setup: func(source *fakeRegistry, target *fakeRegistry, manifest []byte) string {
+				target.pushedDigest = "sha256:" + strings.Repeat("1", 64)
+				return source.Host() + "/team/app:v1"
+			},
+			wantErr: "changed from sha256:",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := newFakeRegistry(t, "")
+			target := newFakeRegistry(t, "")
+			manifest := source.addImage("team/app", "v1", "layer")
+			setDockerConfig(t, nil)
+			sourceImage := test.setup(source, target, manifest)
+			_, err := CopyImage(sourceImage, target.Host()+"/prod/app:v1", log.New(ioutil.Discard, "", 0))
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("CopyImage error = %v, want error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// CREDENTIALS_NOT_FOUND is reported by credential helper (on stdout) if it has no credentials of registry
+const CREDENTIALS_NOT_FOUND = "credentials not found in native keychain"
+
+// helperCredentials is credentials as read from and written to stdin/stdout of docker credential helper
+type helperCredentials struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+// credentialHelper returns name of credential helper of registry in docker config, from `credHelpers` by registry or default `credsStore`. Empty if there is none
+func credentialHelper(config map[string]interface{}, registry string) string {
+	helpers, _ := config["credHelpers"].(map[string]interface{})
+	for key, value := range helpers {
+		if NormalizeHost(key) == NormalizeHost(registry) {
+			helper, _ := value.(string)
+			return helper
+		}
+	}
+	store, _ := config["credsStore"].(string)
+	return store
+}
+
+// helperServerURL returns registry as passed to credential helper, Docker Hub by its legacy URL same as docker CLI
+func helperServerURL(registry string) string {
+	if NormalizeHost(registry) == DOCKER_HUB {
+		return DOCKER_HUB_CONFIG
+	}
+	return NormalizeHost(registry)
+}
+
+// getHelperCredentials gets credentials of registry from credential helper `docker-credential-<helper> get`. Found is false if helper doesn't have them
+func getHelperCredentials(helper string, registry string) (Credentials, bool, error) {
+	output, err := runHelper(helper, "get", strings.NewReader(helperServerURL(registry)))
+	if err != nil {
+		if strings.Contains(string(output), CREDENTIALS_NOT_FOUND) {
+			return Credentials{}, false, nil
+		}
+		return Credentials{}, false, err
+	}
+	var stored helperCredentials
+	if err := json.Unmarshal(output, &stored); err != nil {
+		return Credentials{}, false, fmt.Errorf("invalid credentials of %s from docker-credential-%s: %w", registry, helper, err)
+	}
+	if stored.Username == "<token>" {
+		// identity token is stored with this username
+		return Credentials{IdentityToken: stored.Secret}, true, nil
+	}
+	return Credentials{Username: stored.Username, Password: stored.Secret}, true, nil
+}
+
+// storeHelperCredentials saves credentials of registry with credential helper `docker-credential-<helper> store`. Secret is passed on stdin, never as argument
+func storeHelperCredentials(helper string, registry string, credentials Credentials) error {
+	stored := helperCredentials{ServerURL: helperServerURL(registry), Username: credentials.Username, Secret: credentials.Password}
+	if credentials.IdentityToken != "" {
+		stored.Username, stored.Secret = "<token>", credentials.IdentityToken
+	}
+	input, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	_, err = runHelper(helper, "store", bytes.NewReader(input))
+	return err
+}
+
+// listHelperCredentials returns registries having credentials in credential helper, from `docker-credential-<helper> list`
+func listHelperCredentials(helper string) ([]string, error) {
+	output, err := runHelper(helper, "list", strings.NewReader(""))
+	if err != nil {
+		return nil, err
+	}
+	var listed map[string]string
+	if err := json.Unmarshal(output, &listed); err != nil {
+		return nil, fmt.Errorf("invalid list of credentials from docker-credential-%s: %w", helper, err)
+	}
+	var registries []string
+	for registry := range listed {
+		registries = append(registries, registry)
+	}
+	sort.Strings(registries)
+	return registries, nil
+}
+
+func runHelper(helper string, action string, input io.Reader) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	command := exec.Command("docker-credential-"+helper, action)
+	command.Stdin = input
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+	if err := command.Run(); err != nil {
+		message := strings.TrimSpace(stdout.String() + " " + stderr.String())
+		return stdout.Bytes(), errors.New(fmt.Sprint("docker-credential-", helper, " ", action, " failed: ", err, " ", message))
+	}
+	return stdout.Bytes(), nil
+}
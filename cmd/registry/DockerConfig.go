@@ -0,0 +1,292 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DOCKER_HUB is the registry of images without registry host, and its key in docker config
+const (
+	DOCKER_HUB        = "docker.io"
+	DOCKER_HUB_CONFIG = "https://index.docker.io/v1/"
+)
+
+// Credentials for a registry. Either user and password or identity token (from `docker login` with OAuth)
+type Credentials struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// DockerConfigPath returns path of docker config.json, in $DOCKER_CONFIG or ~/.docker
+func DockerConfigPath() string {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".docker")
+	}
+	return filepath.Join(dir, "config.json")
+}
+
+// readDockerConfig reads docker config as generic JSON, so unknown fields are kept when saving. Missing config is empty
+func readDockerConfig() (map[string]interface{}, error) {
+	config := map[string]interface{}{}
+	content, err := ioutil.ReadFile(DockerConfigPath())
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse docker config %s: %w", DockerConfigPath(), err)
+	}
+	return config, nil
+}
+
+// GetCredentials returns credentials of registry from its credential helper (`credHelpers` or `credsStore` of docker config), or saved in docker config `auths`.
+// Empty credentials are returned if registry is not in config
+func GetCredentials(registry string) (Credentials, error) {
+	config, err := readDockerConfig()
+	if err != nil {
+		return Credentials{}, err
+	}
+	return configCredentials(config, registry)
+}
+
+// configCredentials returns credentials of registry in docker config format (also used by containers auth file), empty if registry is not in config
+func configCredentials(config map[string]interface{}, registry string) (Credentials, error) {
+	if helper := credentialHelper(config, registry); helper != "" {
+		credentials, found, err := getHelperCredentials(helper, registry)
+		if err != nil || found {
+			return credentials, err
+		}
+	}
+	auths, _ := config["auths"].(map[string]interface{})
+	for key, value := range auths {
+		if NormalizeHost(key) != NormalizeHost(registry) {
+			continue
+		}
+		auth, _ := value.(map[string]interface{})
+		credentials := Credentials{}
+		credentials.IdentityToken, _ = auth["identitytoken"].(string)
+		if encoded, _ := auth["auth"].(string); encoded != "" {
+			decoded, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return Credentials{}, fmt.Errorf("invalid auth of %s in docker config: %w", key, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			credentials.Username = parts[0]
+			if len(parts) > 1 {
+				credentials.Password = parts[1]
+			}
+		}
+		return credentials, nil
+	}
+	return Credentials{}, nil
+}
+
+// SaveCredentials saves credentials of registry same as `docker login`: with credential helper of registry if docker config has one
+// (leaving an empty entry in `auths`), otherwise base64 encoded in docker config `auths`
+func SaveCredentials(registry string, credentials Credentials) error {
+	config, err := readDockerConfig()
+	if err != nil {
+		return err
+	}
+	auths, _ := config["auths"].(map[string]interface{})
+	if auths == nil {
+		auths = map[string]interface{}{}
+		config["auths"] = auths
+	}
+	key := NormalizeHost(registry)
+	if key == NormalizeHost(DOCKER_HUB) {
+		key = DOCKER_HUB_CONFIG
+	}
+	auth := map[string]interface{}{"auth": base64.StdEncoding.EncodeToString([]byte(credentials.Username + ":" + credentials.Password))}
+	if helper := credentialHelper(config, registry); helper != "" {
+		if err := storeHelperCredentials(helper, registry, credentials); err != nil {
+			return err
+		}
+		auth = map[string]interface{}{}
+	} else if credentials.IdentityToken != "" {
+		// password isn't saved if registry issued identity token
+		auth = map[string]interface{}{"auth": base64.StdEncoding.EncodeToString([]byte(credentials.Username + ":")), "identitytoken": credentials.IdentityToken}
+	}
+	auths[key] = auth
+	content, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return err
+	}
+	path := DockerConfigPath()
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// written to temp file (created readable only by user) and renamed, so config isn't left readable by others or partially written
+	file, err := ioutil.TempFile(filepath.Dir(path), "config.json.")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// WriteAuthConfig writes copy of docker config to path, with default credentials of registry added if docker config (and its credential helper) doesn't have credentials of it.
+// Builders reading the copy get default credentials (like Cortex token for DCI registry) along with credentials of other registries (like registries of base images),
+// so default credentials aren't saved in docker config of user. With containersAuth, containers auth file of podman and buildah is merged into the copy,
+// taking precedence over docker config, and default credentials are added only if it doesn't have credentials of registry either. Returns whether config is written
+func WriteAuthConfig(path string, registry string, containersAuth bool) (bool, error) {
+	defaultMutex.RLock()
+	defaults, ok := defaultCredentials[NormalizeHost(registry)]
+	defaultMutex.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	if saved, err := GetCredentials(registry); err != nil || saved != (Credentials{}) {
+		return false, err
+	}
+	config, err := readDockerConfig()
+	if err != nil {
+		return false, err
+	}
+	if containersAuth {
+		containers, err := readContainersAuth()
+		if err != nil {
+			return false, err
+		}
+		if saved, err := configCredentials(containers, registry); err != nil || saved != (Credentials{}) {
+			return false, err
+		}
+		mergeAuthConfig(config, containers)
+	}
+	auths, _ := config["auths"].(map[string]interface{})
+	if auths == nil {
+		auths = map[string]interface{}{}
+		config["auths"] = auths
+	}
+	key := NormalizeHost(registry)
+	if key == NormalizeHost(DOCKER_HUB) {
+		key = DOCKER_HUB_CONFIG
+	}
+	auths[key] = map[string]interface{}{"auth": base64.StdEncoding.EncodeToString([]byte(defaults.Username + ":" + defaults.Password))}
+	// credential helper of registry and credential store would take precedence over auths
+	helpers, _ := config["credHelpers"].(map[string]interface{})
+	if helpers == nil {
+		helpers = map[string]interface{}{}
+	}
+	for host := range helpers {
+		if NormalizeHost(host) == NormalizeHost(registry) {
+			delete(helpers, host)
+		}
+	}
+	// registries having credentials in credential store get it as their helper, so their credentials are kept
+	if store, _ := config["credsStore"].(string); store != "" {
+		hosts, err := listHelperCredentials(store)
+		if err != nil {
+			log.Println("[WARN] Credentials of registries in docker-credential-"+store+" are not passed to builder.", err)
+		}
+		for _, host := range hosts {
+			if _, ok := helpers[host]; !ok && NormalizeHost(host) != NormalizeHost(registry) {
+				helpers[host] = store
+			}
+		}
+		delete(config, "credsStore")
+	}
+	if len(helpers) > 0 {
+		config["credHelpers"] = helpers
+	}
+	content, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return false, err
+	}
+	return true, ioutil.WriteFile(path, content, 0600)
+}
+
+// ContainersAuthPath returns path of auth file of podman and buildah, $REGISTRY_AUTH_FILE or $XDG_RUNTIME_DIR/containers/auth.json. Empty if neither is set
+func ContainersAuthPath() string {
+	if path := os.Getenv("REGISTRY_AUTH_FILE"); path != "" {
+		return path
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "containers", "auth.json")
+	}
+	return ""
+}
+
+// readContainersAuth reads containers auth file, which has format of docker config. Missing file is empty
+func readContainersAuth() (map[string]interface{}, error) {
+	config := map[string]interface{}{}
+	path := ContainersAuthPath()
+	if path == "" {
+		return config, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse containers auth file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// mergeAuthConfig merges `auths` and `credHelpers` of containers auth file into docker config. Entries of containers auth file replace entries of same registry host
+func mergeAuthConfig(config map[string]interface{}, containers map[string]interface{}) {
+	for _, field := range []string{"auths", "credHelpers"} {
+		entries, _ := containers[field].(map[string]interface{})
+		if len(entries) == 0 {
+			continue
+		}
+		merged, _ := config[field].(map[string]interface{})
+		if merged == nil {
+			merged = map[string]interface{}{}
+			config[field] = merged
+		}
+		for key, value := range entries {
+			// entries of a repository (like quay.io/team) don't replace entry of registry
+			if !strings.Contains(strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://"), "/"), "/") {
+				for existing := range merged {
+					if NormalizeHost(existing) == NormalizeHost(key) {
+						delete(merged, existing)
+					}
+				}
+			}
+			merged[key] = value
+		}
+	}
+}
+
+// NormalizeHost returns host of registry URL as saved in docker config, which may have scheme and path like https://index.docker.io/v1/
+func NormalizeHost(registry string) string {
+	key := strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://")
+	key = strings.SplitN(key, "/", 2)[0]
+	if key == "index.docker.io" || key == "registry-1.docker.io" {
+		return DOCKER_HUB
+	}
+	return key
+}
+
+// Host returns registry host of image like `<registry>/<namespace>/<name>:<tag>`. Images without registry are in Docker Hub
+func Host(image string) string {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return NormalizeHost(parts[0])
+	}
+	return DOCKER_HUB
+}
@@ -0,0 +1,166 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteAuthConfig(t *testing.T) {
+	setDockerConfig(t, map[string]Credentials{"other.example.com": {Username: "other", Password: "pass"}})
+	userConfig, _ := ioutil.ReadFile(DockerConfigPath())
+	SetDefaultCredentials("dci.example.com", Credentials{Username: "cli", Password: "cortex-token"})
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	written, err := WriteAuthConfig(path, "dci.example.com", false)
+	if err != nil || !written {
+		t.Fatalf("WriteAuthConfig = %v, %v", written, err)
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	content, _ := ioutil.ReadFile(path)
+	if err := json.Unmarshal(content, &config); err != nil {
+		t.Fatal(err)
+	}
+	if auth := config.Auths["dci.example.com"].Auth; auth != base64.StdEncoding.EncodeToString([]byte("cli:cortex-token")) {
+		t.Errorf("auth of dci.example.com = %q, want default credentials", auth)
+	}
+	if _, ok := config.Auths["other.example.com"]; !ok {
+		t.Errorf("credentials of other registries not kept: %s", content)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("auth config mode = %v, want readable only by user", info.Mode())
+	}
+	if current, _ := ioutil.ReadFile(DockerConfigPath()); string(current) != string(userConfig) {
+		t.Errorf("docker config of user changed to %s", current)
+	}
+
+	// credentials in docker config are used as is
+	SetDefaultCredentials("other.example.com", Credentials{Username: "cli", Password: "cortex-token"})
+	for _, registry := range []string{"other.example.com", "unknown.example.com"} {
+		if written, err := WriteAuthConfig(path+"."+registry, registry, false); err != nil || written {
+			t.Errorf("WriteAuthConfig(%s) = %v, %v, want not written", registry, written, err)
+		}
+	}
+}
+
+// writeJSON writes value as JSON file
+func writeJSON(t *testing.T, path string, value interface{}) {
+	t.Helper()
+	content, _ := json.Marshal(value)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readAuthConfig reads auth config written by WriteAuthConfig
+func readAuthConfig(t *testing.T, path string) map[string]interface{} {
+	t.Helper()
+	var config map[string]interface{}
+	content, _ := ioutil.ReadFile(path)
+	if err := json.Unmarshal(content, &config); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestWriteAuthConfigExpandsCredentialStore(t *testing.T) {
+	// fake credential store has credentials of base image registries, but not of DCI registry
+	bin := t.TempDir()
+	script := "#!/bin/sh\ncase \"$1\" in\n" +
+		"list) echo '{\"https://index.docker.io/v1/\":\"user\",\"base.example.com\":\"user\",\"pinned.example.com\":\"user\"}' ;;\n" +
+		"*) echo 'credentials not found in native keychain'; exit 1 ;;\nesac\n"
+	if err := ioutil.WriteFile(filepath.Join(bin, "docker-credential-fake"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	dir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dir)
+	writeJSON(t, filepath.Join(dir, "config.json"), map[string]interface{}{
+		"credsStore":  "fake",
+		"credHelpers": map[string]string{"pinned.example.com": "other", "dci.example.com": "fake"},
+	})
+	SetDefaultCredentials("dci.example.com", Credentials{Username: "cli", Password: "cortex-token"})
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	if written, err := WriteAuthConfig(path, "dci.example.com", false); err != nil || !written {
+		t.Fatalf("WriteAuthConfig = %v, %v", written, err)
+	}
+	config := readAuthConfig(t, path)
+	if _, ok := config["credsStore"]; ok {
+		t.Errorf("credsStore is kept, it would take precedence over default credentials")
+	}
+	helpers, _ := config["credHelpers"].(map[string]interface{})
+	want := map[string]interface{}{"https://index.docker.io/v1/": "fake", "base.example.com": "fake", "pinned.example.com": "other"}
+	if len(helpers) != len(want) {
+		t.Errorf("credHelpers = %v, want %v", helpers, want)
+	}
+	for host, helper := range want {
+		if helpers[host] != helper {
+			t.Errorf("credHelpers[%s] = %v, want %v", host, helpers[host], helper)
+		}
+	}
+	auths, _ := config["auths"].(map[string]interface{})
+	if _, ok := auths["dci.example.com"]; !ok {
+		t.Errorf("default credentials of dci.example.com not written: %v", auths)
+	}
+}
+
+func TestWriteAuthConfigMergesContainersAuth(t *testing.T) {
+	setDockerConfig(t, map[string]Credentials{"other.example.com": {Username: "docker", Password: "pass"}, "docker.example.com": {Username: "docker", Password: "pass"}})
+	runtimeDir := t.TempDir()
+	t.Setenv("REGISTRY_AUTH_FILE", "")
+	t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+	podmanAuth := base64.StdEncoding.EncodeToString([]byte("podman:pass"))
+	writeJSON(t, filepath.Join(runtimeDir, "containers", "auth.json"), map[string]interface{}{
+		"auths": map[string]interface{}{"https://other.example.com": map[string]string{"auth": podmanAuth}, "quay.io": map[string]string{"auth": podmanAuth}},
+	})
+	SetDefaultCredentials("dci.example.com", Credentials{Username: "cli", Password: "cortex-token"})
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	if written, err := WriteAuthConfig(path, "dci.example.com", true); err != nil || !written {
+		t.Fatalf("WriteAuthConfig = %v, %v", written, err)
+	}
+	auths, _ := readAuthConfig(t, path)["auths"].(map[string]interface{})
+	tests := map[string]string{
+		"https://other.example.com": "podman:pass", // containers auth file over docker config
+		"quay.io":                   "podman:pass",
+		"docker.example.com":        "docker:pass",
+		"dci.example.com":           "cli:cortex-token",
+	}
+	for host, want := range tests {
+		auth, _ := auths[host].(map[string]interface{})
+		if auth["auth"] != base64.StdEncoding.EncodeToString([]byte(want)) {
+			t.Errorf("auth of %s = %v, want %s", host, auth["auth"], want)
+		}
+	}
+	if _, ok := auths["other.example.com"]; ok {
+		t.Errorf("docker config entry of other.example.com is kept along with containers auth file entry")
+	}
+	if written, err := WriteAuthConfig(path, "dci.example.com", false); err != nil || !written {
+		t.Fatalf("WriteAuthConfig = %v, %v", written, err)
+	}
+	if auths, _ := readAuthConfig(t, path)["auths"].(map[string]interface{}); auths["quay.io"] != nil {
+		t.Errorf("containers auth file merged without containersAuth")
+	}
+
+	// credentials in containers auth file (REGISTRY_AUTH_FILE over XDG_RUNTIME_DIR) are used as is
+	authFile := filepath.Join(t.TempDir(), "auth.json")
+	t.Setenv("REGISTRY_AUTH_FILE", authFile)
+	writeJSON(t, authFile, map[string]interface{}{"auths": map[string]interface{}{"dci.example.com": map[string]string{"auth": podmanAuth}}})
+	if written, err := WriteAuthConfig(path+".saved", "dci.example.com", true); err != nil || written {
+		t.Errorf("WriteAuthConfig = %v, %v, want not written", written, err)
+	}
+	if ContainersAuthPath() != authFile {
+		t.Errorf("ContainersAuthPath = %s, want REGISTRY_AUTH_FILE", ContainersAuthPath())
+	}
+}
@@ -0,0 +1,408 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manifest media types accepted, so digest of multi-platform image is digest of its index
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+var (
+	challengeParamRegex = regexp.MustCompile(`(\w+)="([^"]*)"`)
+	nextLinkRegex       = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="next"`)
+)
+
+var (
+	defaultCredentials = map[string]Credentials{}
+	defaultMutex       sync.RWMutex
+)
+
+// SetDefaultCredentials sets credentials used for registry if docker config doesn't have credentials of it, like Cortex token for DCI registry
+func SetDefaultCredentials(registry string, credentials Credentials) {
+	defaultMutex.Lock()
+	defer defaultMutex.Unlock()
+	defaultCredentials[NormalizeHost(registry)] = credentials
+}
+
+// LookupCredentials returns credentials of registry from docker config, or default credentials of registry
+func LookupCredentials(registry string) (Credentials, error) {
+	credentials, err := GetCredentials(registry)
+	if err != nil || credentials != (Credentials{}) {
+		return credentials, err
+	}
+	defaultMutex.RLock()
+	defer defaultMutex.RUnlock()
+	return defaultCredentials[NormalizeHost(registry)], nil
+}
+
+// Reference is image reference parsed as registry host, repository and tag or digest
+type Reference struct {
+	Host       string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseReference parses image like `<registry>/<namespace>/<name>:<tag>` or `<registry>/<namespace>/<name>@sha256:..`. Tag defaults to latest
+func ParseReference(image string) Reference {
+	reference := Reference{Host: Host(image)}
+	name := image
+	if reference.Host != DOCKER_HUB || strings.HasPrefix(image, DOCKER_HUB+"/") {
+		name = image[strings.Index(image, "/")+1:]
+	}
+	if i := strings.Index(name, "@"); i >= 0 {
+		reference.Digest = name[i+1:]
+		name = name[:i]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		reference.Tag = name[i+1:]
+		name = name[:i]
+	} else if reference.Digest == "" {
+		reference.Tag = "latest"
+	}
+	if reference.Host == DOCKER_HUB && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	reference.Repository = name
+	return reference
+}
+
+// Name returns reference of tag, or of digest if tag is not given
+func (r Reference) Name() string {
+	if r.Tag != "" {
+		return r.Tag
+	}
+	return r.Digest
+}
+
+// Client of registry using OCI Distribution (v2) API. Handles basic or bearer token authentication challenged by registry
+type Client struct {
+	Host        string
+	Credentials Credentials
+	http        *http.Client
+	basic       bool
+	tokens      map[string]string // bearer token by scope
+	mutex       sync.Mutex
+}
+
+// NewClient creates client of registry with credentials from docker config (or default credentials).
+// Registry is accessed over https, except localhost and registries in FABRIC_INSECURE_REGISTRIES (comma separated)
+func NewClient(host string) (*Client, error) {
+	credentials, err := LookupCredentials(host)
+	if err != nil {
+		return nil, err
+	}
+	ignoreCert, _ := strconv.ParseBool(os.Getenv("IGNORE_INVALID_SSL_CERT"))
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: &tls.Config{InsecureSkipVerify: ignoreCert}}
+	return &Client{Host: NormalizeHost(host), Credentials: credentials, http: &http.Client{Transport: transport}, tokens: map[string]string{}}, nil
+}
+
+// Login validates credentials with registry, authenticating to its API version check (/v2/) without docker daemon
+func Login(registry string, credentials Credentials) error {
+	client, err := NewClient(registry)
+	if err != nil {
+		return err
+	}
+	client.Credentials = credentials
+	response, err := client.Do(http.MethodGet, "/v2/", "", nil, nil)
+	if err != nil {
+		return fmt.Errorf("login to %s failed: %w", client.Host, err)
+	}
+	response.Body.Close()
+	if response.StatusCode == http.StatusUnauthorized {
+		return errors.New(fmt.Sprint("login to ", client.Host, " failed, invalid credentials of ", credentials.Username))
+	} else if response.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprint("login to ", client.Host, " failed, status ", response.StatusCode))
+	}
+	return nil
+}
+
+func (c *Client) baseURL() string {
+	host := c.Host
+	if host == DOCKER_HUB {
+		host = "registry-1.docker.io"
+	}
+	scheme := "https"
+	hostname := strings.Split(host, ":")[0]
+	if hostname == "localhost" || hostname == "127.0.0.1" {
+		scheme = "http"
+	}
+	for _, insecure := range strings.Split(os.Getenv("FABRIC_INSECURE_REGISTRIES"), ",") {
+		if strings.TrimSpace(insecure) == host {
+			scheme = "http"
+		}
+	}
+	return scheme + "://" + host
+}
+
+// Do sends request to registry path (like /v2/<repository>/manifests/<tag>) or URL (like upload location), authenticating for scope
+// (like repository:<repository>:pull) if challenged. Content-Length header sets length of streamed body
+func (c *Client) Do(method string, path string, scope string, header http.Header, body io.Reader) (*http.Response, error) {
+	requestURL := path
+	if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+		requestURL = c.baseURL() + path
+	}
+	request, err := http.NewRequest(method, requestURL, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	if length := header.Get("Content-Length"); length != "" {
+		if request.ContentLength, err = strconv.ParseInt(length, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	c.authorize(request, scope)
+	response, err := c.http.Do(request)
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		return response, err
+	}
+	response.Body.Close()
+	if err := c.authenticate(response.Header.Get("WWW-Authenticate"), scope); err != nil {
+		return nil, err
+	}
+	if body != nil {
+		if request.GetBody == nil {
+			return nil, errors.New(fmt.Sprint("registry ", c.Host, " requested authentication, request to ", path, " can't be sent again"))
+		}
+		if request.Body, err = request.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	c.authorize(request, scope)
+	return c.http.Do(request)
+}
+
+func (c *Client) authorize(request *http.Request, scope string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if token, ok := c.tokens[scope]; ok {
+		request.Header.Set("Authorization", "Bearer "+token)
+	} else if c.basic {
+		request.SetBasicAuth(c.Credentials.Username, c.Credentials.Password)
+	}
+}
+
+// authenticate handles WWW-Authenticate challenge, fetching bearer token from token service of registry
+func (c *Client) authenticate(challenge string, scope string) error {
+	scheme := strings.ToLower(strings.SplitN(challenge, " ", 2)[0])
+	if scheme == "basic" {
+		if c.Credentials.Username == "" {
+			return errors.New(fmt.Sprint("registry ", c.Host, " requires credentials, login using `fabric dockerAuth` or `docker login`"))
+		}
+		c.mutex.Lock()
+		c.basic = true
+		c.mutex.Unlock()
+		return nil
+	}
+	if scheme != "bearer" {
+		return errors.New(fmt.Sprint("unsupported authentication challenge of registry ", c.Host, ": ", challenge))
+	}
+	params := map[string]string{}
+	for _, match := range challengeParamRegex.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	query := url.Values{"service": {params["service"]}}
+	// scope can be space separated scopes, like push scope of a repository and pull scope of other repository
+	for _, s := range strings.Fields(scope) {
+		query.Add("scope", s)
+	}
+	var request *http.Request
+	var err error
+	if c.Credentials.IdentityToken != "" {
+		query.Set("grant_type", "refresh_token")
+		query.Set("refresh_token", c.Credentials.IdentityToken)
+		query.Set("client_id", "fabric")
+		request, err = http.NewRequest(http.MethodPost, params["realm"], strings.NewReader(query.Encode()))
+		if err == nil {
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		request, err = http.NewRequest(http.MethodGet, params["realm"]+"?"+query.Encode(), nil)
+		if err == nil && c.Credentials.Username != "" {
+			request.SetBasicAuth(c.Credentials.Username, c.Credentials.Password)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	response, err := c.http.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to get token of registry %s: %w", c.Host, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprint("failed to get token of registry ", c.Host, ", status ", response.StatusCode, ". Login using `fabric dockerAuth` or `docker login`"))
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return fmt.Errorf("invalid token response of registry %s: %w", c.Host, err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	c.mutex.Lock()
+	c.tokens[scope] = token.Token
+	c.mutex.Unlock()
+	return nil
+}
+
+// Digest returns digest of manifest of repository tag (or digest), empty if it doesn't exist
+func (c *Client) Digest(repository string, reference string) (string, error) {
+	header := http.Header{"Accept": {strings.Join(manifestMediaTypes, ", ")}}
+	path := "/v2/" + repository + "/manifests/" + reference
+	response, err := c.Do(http.MethodHead, path, "repository:"+repository+":pull", header, nil)
+	if err != nil {
+		return "", err
+	}
+	response.Body.Close()
+	switch {
+	case response.StatusCode == http.StatusNotFound:
+		return "", nil
+	case response.StatusCode != http.StatusOK:
+		return "", errors.New(fmt.Sprint("failed to get manifest ", repository, ":", reference, " from registry ", c.Host, ", status ", response.StatusCode))
+	case response.Header.Get("Docker-Content-Digest") != "":
+		return response.Header.Get("Docker-Content-Digest"), nil
+	}
+	// registries may not return digest header, then digest is computed from manifest
+	_, _, digest, err := c.Manifest(repository, reference)
+	return digest, err
+}
+
+// Manifest returns manifest of repository tag (or digest) with its media type and digest
+func (c *Client) Manifest(repository string, reference string) (manifest []byte, mediaType string, digest string, err error) {
+	header := http.Header{"Accept": {strings.Join(manifestMediaTypes, ", ")}}
+	response, err := c.Do(http.MethodGet, "/v2/"+repository+"/manifests/"+reference, "repository:"+repository+":pull", header, nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, "", "", errors.New(fmt.Sprint("failed to get manifest ", repository, ":", reference, " from registry ", c.Host, ", status ", response.StatusCode))
+	}
+	if manifest, err = ioutil.ReadAll(response.Body); err != nil {
+		return nil, "", "", err
+	}
+	mediaType = strings.Split(response.Header.Get("Content-Type"), ";")[0]
+	if mediaType == "" || mediaType == "application/json" {
+		mediaType = manifestMediaType(manifest)
+	}
+	digest = fmt.Sprintf("sha256:%x", sha256.Sum256(manifest))
+	return manifest, mediaType, digest, nil
+}
+
+// manifestMediaType returns mediaType field of manifest, for registries not returning it as content type
+func manifestMediaType(manifest []byte) string {
+	var fields struct {
+		MediaType string `json:"mediaType"`
+	}
+	json.Unmarshal(manifest, &fields)
+	return fields.MediaType
+}
+
+// Tags returns tags of repository, following pagination of registry. Repository not existing has no tags
+func (c *Client) Tags(repository string) ([]string, error) {
+	var tags []string
+	path := "/v2/" + repository + "/tags/list"
+	for path != "" {
+		response, err := c.Do(http.MethodGet, path, "repository:"+repository+":pull", nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		if response.StatusCode == http.StatusNotFound {
+			response.Body.Close()
+			return tags, nil
+		} else if response.StatusCode != http.StatusOK {
+			response.Body.Close()
+			return nil, errors.New(fmt.Sprint("failed to list tags of ", repository, " in registry ", c.Host, ", status ", response.StatusCode))
+		}
+		err = json.NewDecoder(response.Body).Decode(&page)
+		response.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid tags of %s in registry %s: %w", repository, c.Host, err)
+		}
+		tags = append(tags, page.Tags...)
+		path = ""
+		if match := nextLinkRegex.FindStringSubmatch(response.Header.Get("Link")); match != nil {
+			path = match[1]
+		}
+	}
+	return tags, nil
+}
+
+// Created returns creation time of image from its config. For multi-platform image, creation time of its first image is used
+func (c *Client) Created(repository string, reference string) (time.Time, error) {
+	manifest, _, _, err := c.Manifest(repository, reference)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var fields struct {
+		Config struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+		Manifests []struct {
+			Digest string `json:"digest"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(manifest, &fields); err != nil {
+		return time.Time{}, fmt.Errorf("invalid manifest %s:%s in registry %s: %w", repository, reference, c.Host, err)
+	}
+	if len(fields.Manifests) > 0 {
+		return c.Created(repository, fields.Manifests[0].Digest)
+	}
+	if fields.Config.Digest == "" {
+		return time.Time{}, errors.New(fmt.Sprint("manifest ", repository, ":", reference, " in registry ", c.Host, " has no config"))
+	}
+	response, err := c.Do(http.MethodGet, "/v2/"+repository+"/blobs/"+fields.Config.Digest, "repository:"+repository+":pull", nil, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return time.Time{}, errors.New(fmt.Sprint("failed to get config of ", repository, ":", reference, " from registry ", c.Host, ", status ", response.StatusCode))
+	}
+	var config struct {
+		Created time.Time `json:"created"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&config); err != nil {
+		return time.Time{}, fmt.Errorf("invalid config of %s:%s in registry %s: %w", repository, reference, c.Host, err)
+	}
+	return config.Created, nil
+}
+
+// ImageDigest returns digest of image in its registry, empty if image doesn't exist
+func ImageDigest(image string) (string, error) {
+	reference := ParseReference(image)
+	client, err := NewClient(reference.Host)
+	if err != nil {
+		return "", err
+	}
+	return client.Digest(reference.Repository, reference.Name())
+}
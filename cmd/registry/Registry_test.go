@@ -0,0 +1,366 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRegistry is an in-memory registry of OCI Distribution API, authenticating with bearer tokens of its own token service (/token),
+// with basic authentication, or not at all
+type fakeRegistry struct {
+	*httptest.Server
+	auth          string // bearer, basic or empty
+	username      string
+	password      string
+	mutex         sync.Mutex
+	manifests     map[string][]byte // by repository and reference (tag or digest)
+	mediaTypes    map[string]string
+	blobs         map[string][]byte // by repository and digest
+	uploads       map[string]string // repository by upload id
+	tokenRequests []string          // scopes of token requests
+	requests      []string          // method and path (with query) of registry requests
+	corruptBlobs  bool              // serve blobs with content not matching their digest
+	pushedDigest  string            // digest header of pushed manifests, instead of their digest
+}
+
+func newFakeRegistry(t *testing.T, auth string) *fakeRegistry {
+	registry := &fakeRegistry{auth: auth, username: "user", password: "pass", manifests: map[string][]byte{}, mediaTypes: map[string]string{},
+		blobs: map[string][]byte{}, uploads: map[string]string{}}
+	registry.Server = httptest.NewServer(http.HandlerFunc(registry.serve))
+	t.Cleanup(registry.Close)
+	return registry
+}
+
+// Host is registry host, accessed over http as it is 127.0.0.1
+func (r *fakeRegistry) Host() string {
+	return strings.TrimPrefix(r.URL, "http://")
+}
+
+func digestOf(content []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
+
+// addImage adds image with config and layers to repository, and returns manifest
+func (r *fakeRegistry) addImage(repository string, tag string, layers ...string) []byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	config := []byte(`{"architecture":"amd64","created":"2024-01-02T03:04:05Z"}`)
+	r.blobs[repository+"@"+digestOf(config)] = config
+	manifest := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        map[string]interface{}{"mediaType": "application/vnd.oci.image.config.v1+json", "digest": digestOf(config), "size": len(config)},
+	}
+	var descriptors []interface{}
+	for _, layer := range layers {
+		r.blobs[repository+"@"+digestOf([]byte(layer))] = []byte(layer)
+		descriptors = append(descriptors, map[string]interface{}{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": digestOf([]byte(layer)), "size": len(layer)})
+	}
+	manifest["layers"] = descriptors
+	content, _ := json.Marshal(manifest)
+	for _, reference := range []string{tag, digestOf(content)} {
+		r.manifests[repository+":"+reference] = content
+		r.mediaTypes[repository+":"+reference] = "application/vnd.oci.image.manifest.v1+json"
+	}
+	return content
+}
+
+// requestCount counts requests of method with path (and query) containing text
+func (r *fakeRegistry) requestCount(method string, text string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	count := 0
+	for _, request := range r.requests {
+		if strings.HasPrefix(request, method+" ") && strings.Contains(request, text) {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *fakeRegistry) serve(w http.ResponseWriter, request *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if request.URL.Path == "/token" {
+		r.serveToken(w, request)
+		return
+	}
+	r.requests = append(r.requests, request.Method+" "+request.URL.RequestURI())
+	path := request.URL.Path
+	repository, kind, reference := "", "", ""
+	for _, separator := range []string{"/manifests/", "/blobs/uploads/", "/blobs/"} {
+		if i := strings.Index(path, separator); i > 0 {
+			repository, kind, reference = strings.TrimPrefix(path[:i], "/v2/"), strings.Trim(separator, "/"), path[i+len(separator):]
+			break
+		}
+	}
+	write := request.Method == http.MethodPut || request.Method == http.MethodPost
+	if !r.authorized(w, request, repository, write) {
+		return
+	}
+	switch {
+	case path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case kind == "manifests" && request.Method == http.MethodPut:
+		content, _ := ioutil.ReadAll(request.Body)
+		r.manifests[repository+":"+reference] = content
+		r.manifests[repository+":"+digestOf(content)] = content
+		r.mediaTypes[repository+":"+reference] = request.Header.Get("Content-Type")
+		digest := digestOf(content)
+		if r.pushedDigest != "" {
+			digest = r.pushedDigest
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+	case kind == "manifests":
+		content, ok := r.manifests[repository+":"+reference]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", r.mediaTypes[repository+":"+reference])
+		w.Header().Set("Docker-Content-Digest", digestOf(content))
+		w.Write(content)
+	case kind == "blobs/uploads" && request.Method == http.MethodPost:
+		if mount, from := request.URL.Query().Get("mount"), request.URL.Query().Get("from"); mount != "" {
+			if blob, ok := r.blobs[from+"@"+mount]; ok {
+				r.blobs[repository+"@"+mount] = blob
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		id := fmt.Sprint("upload-", len(r.uploads))
+		r.uploads[id] = repository
+		w.Header().Set("Location", "/v2/"+repository+"/blobs/uploads/"+id+"?state=1")
+		w.WriteHeader(http.StatusAccepted)
+	case kind == "blobs/uploads" && request.Method == http.MethodPut:
+		digest := request.URL.Query().Get("digest")
+		content, _ := ioutil.ReadAll(request.Body)
+		if r.uploads[reference] != repository || request.URL.Query().Get("state") != "1" {
+			w.WriteHeader(http.StatusNotFound)
+		} else if digestOf(content) != digest {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":[{"code":"DIGEST_INVALID"}]}`))
+		} else {
+			r.blobs[repository+"@"+digest] = content
+			w.WriteHeader(http.StatusCreated)
+		}
+	case kind == "blobs":
+		blob, ok := r.blobs[repository+"@"+reference]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.corruptBlobs {
+			blob = append([]byte("corrupt "), blob...)
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(blob)))
+		if request.Method == http.MethodGet {
+			w.Write(blob)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// serveToken issues token of requested scopes (as token itself) to user with valid credentials, or anonymous pull token
+func (r *fakeRegistry) serveToken(w http.ResponseWriter, request *http.Request) {
+	scopes := request.URL.Query()["scope"]
+	r.tokenRequests = append(r.tokenRequests, strings.Join(scopes, " "))
+	username, password, ok := request.BasicAuth()
+	if ok && (username != r.username || password != r.password) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !ok {
+		// anonymous users can only pull
+		for _, scope := range scopes {
+			if strings.Contains(scope, "push") {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]string{"token": base64.StdEncoding.EncodeToString([]byte(strings.Join(scopes, " ")))})
+}
+
+// authorized checks authorization of request to repository, challenging client if not authorized
+func (r *fakeRegistry) authorized(w http.ResponseWriter, request *http.Request, repository string, write bool) bool {
+	switch r.auth {
+	case "basic":
+		if username, password, ok := request.BasicAuth(); ok && username == r.username && password == r.password {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="fake"`)
+	case "bearer":
+		token, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer "))
+		action := "pull"
+		if write {
+			action = "pull,push"
+		}
+		granted := repository == ""
+		for _, scope := range strings.Fields(string(token)) {
+			granted = granted || scope == "repository:"+repository+":"+action || scope == "repository:"+repository+":pull,push"
+		}
+		if granted && request.Header.Get("Authorization") != "" {
+			// mounting needs pull access of source repository
+			from := request.URL.Query().Get("from")
+			if from == "" || strings.Contains(string(token), "repository:"+from+":pull") {
+				return true
+			}
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake",scope="repository:%s:%s"`, r.URL, repository, action))
+	default:
+		return true
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	return false
+}
+
+// setDockerConfig saves credentials of registries in docker config of test
+func setDockerConfig(t *testing.T, credentials map[string]Credentials) {
+	dir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dir)
+	auths := map[string]interface{}{}
+	for host, c := range credentials {
+		auths[host] = map[string]string{"auth": base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password))}
+	}
+	content, _ := json.Marshal(map[string]interface{}{"auths": auths})
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientBearerToken(t *testing.T) {
+	registry := newFakeRegistry(t, "bearer")
+	registry.addImage("team/app", "v1", "layer")
+	setDockerConfig(t, map[string]Credentials{registry.Host(): {Username: "user", Password: "pass"}})
+	client, err := NewClient(registry.Host())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		digest, err := client.Digest("team/app", "v1")
+		if err != nil || digest == "" {
+			t.Fatalf("Digest = %q, %v", digest, err)
+		}
+	}
+	if want := []string{"repository:team/app:pull"}; strings.Join(registry.tokenRequests, ",") != strings.Join(want, ",") {
+		t.Errorf("token requests = %v, want token fetched once and reused: %v", registry.tokenRequests, want)
+	}
+
+	// request with body is sent again after authentication
+	body := []byte(`{"schemaVersion":2}`)
+	response, err := client.Do(http.MethodPut, "/v2/team/app/manifests/v2", "repository:team/app:pull,push", http.Header{"Content-Type": {"application/vnd.oci.image.manifest.v1+json"}}, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusCreated || !bytes.Equal(registry.manifests["team/app:v2"], body) {
+		t.Errorf("PUT status = %d, manifest %s", response.StatusCode, registry.manifests["team/app:v2"])
+	}
+	if len(registry.tokenRequests) != 2 {
+		t.Errorf("token requests = %v, want push token fetched", registry.tokenRequests)
+	}
+}
+
+func TestClientAnonymousPull(t *testing.T) {
+	registry := newFakeRegistry(t, "bearer")
+	registry.addImage("library/alpine", "3", "layer")
+	setDockerConfig(t, nil)
+	client, err := NewClient(registry.Host())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags, err := client.Tags("library/alpine"); err != nil || len(tags) != 0 {
+		// fake registry has no tags list, so repository is not found
+		t.Fatalf("Tags = %v, %v", tags, err)
+	}
+	if digest, err := client.Digest("library/alpine", "3"); err != nil || digest == "" {
+		t.Fatalf("Digest = %q, %v", digest, err)
+	}
+	_, err = client.Do(http.MethodPost, "/v2/library/alpine/blobs/uploads/", "repository:library/alpine:pull,push", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "failed to get token of registry "+registry.Host()+", status 401") {
+		t.Fatalf("push error = %v, want token error", err)
+	}
+}
+
+func TestClientBasicAuth(t *testing.T) {
+	registry := newFakeRegistry(t, "basic")
+	tests := []struct {
+		name        string
+		credentials Credentials
+		wantErr     string
+	}{
+		{name: "valid credentials", credentials: Credentials{Username: "user", Password: "pass"}},
+		{name: "invalid credentials", credentials: Credentials{Username: "user", Password: "wrong"}, wantErr: "invalid credentials of user"},
+		{name: "no credentials", wantErr: "requires credentials"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setDockerConfig(t, nil)
+			err := Login(registry.Host(), test.credentials)
+			if test.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("Login error = %v, want error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientBearerTokenInvalidCredentials(t *testing.T) {
+	registry := newFakeRegistry(t, "bearer")
+	setDockerConfig(t, map[string]Credentials{registry.Host(): {Username: "user", Password: "wrong"}})
+	client, err := NewClient(registry.Host())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Digest("team/app", "v1")
+	if err == nil || !strings.Contains(err.Error(), "status 401. Login using `fabric dockerAuth` or `docker login`") {
+		t.Fatalf("Digest error = %v, want token error", err)
+	}
+}
+
+func TestClientDefaultCredentials(t *testing.T) {
+	registry := newFakeRegistry(t, "basic")
+	setDockerConfig(t, nil)
+	SetDefaultCredentials(registry.Host(), Credentials{Username: "user", Password: "pass"})
+	client, err := NewClient(registry.Host())
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.Do(http.MethodGet, "/v2/", "", nil, nil)
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("Do = %v, %v, want default credentials used", response, err)
+	}
+	response.Body.Close()
+}
+
+func TestParseReference(t *testing.T) {
+	tests := map[string]Reference{
+		"alpine":                               {Host: DOCKER_HUB, Repository: "library/alpine", Tag: "latest"},
+		"team/app:v1":                          {Host: DOCKER_HUB, Repository: "team/app", Tag: "v1"},
+		"localhost:5000/team/app":              {Host: "localhost:5000", Repository: "team/app", Tag: "latest"},
+		"registry.example.com/a/b/c:v1":        {Host: "registry.example.com", Repository: "a/b/c", Tag: "v1"},
+		"registry.example.com/app@sha256:feed": {Host: "registry.example.com", Repository: "app", Digest: "sha256:feed"},
+	}
+	for image, want := range tests {
+		if got := ParseReference(image); got != want {
+			t.Errorf("ParseReference(%s) = %+v, want %+v", image, got, want)
+		}
+	}
+}
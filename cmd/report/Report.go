@@ -0,0 +1,223 @@
+package report
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+const (
+	FORMAT_JSON  = "json"
+	FORMAT_JUNIT = "junit"
+
+	STATUS_DEPLOYED     = "deployed"
+	STATUS_FAILED       = "failed"
+	STATUS_NOT_DEPLOYED = "not-deployed"
+	STATUS_ROLLED_BACK  = "rolled-back"
+)
+
+// Report is machine-readable record of a `fabric` run for CI, with docker images built and Cortex resources deployed
+type Report struct {
+	Manifest  string            `json:"manifest,omitempty"`
+	StartedAt time.Time         `json:"startedAt"`
+	Duration  int64             `json:"durationMs"`
+	Images    []ImageResult     `json:"images"`
+	Digests   map[string]string `json:"imageDigests,omitempty"` // digest by image tag, of images substituted in actions
+	Resources []ResourceResult  `json:"resources"`
+	Retries   *RetryStats       `json:"retries,omitempty"`
+	mutex     sync.Mutex
+}
+
+type ImageResult struct {
+	Name       string `json:"name"`
+	Dockerfile string `json:"dockerfile"`
+	Image      string `json:"image,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+	Reused     bool   `json:"reused,omitempty"`  // image existed in registry, so it wasn't built
+	Skipped    bool   `json:"skipped,omitempty"` // skipped in fabric-build.yaml
+	Duration   int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+}
+
+type ResourceResult struct {
+	Kind        string `json:"kind"`
+	Name        string `json:"name"`
+	Source      string `json:"source"`
+	Transformer string `json:"transformer,omitempty"`
+	Status      string `json:"status"`
+	StatusCode  int    `json:"httpStatus,omitempty"`
+	Duration    int64  `json:"durationMs"`
+	Error       string `json:"error,omitempty"`
+}
+
+// RetryStats are counts of Cortex API calls retried on transient failures
+type RetryStats struct {
+	Requests        int64            `json:"requests"`
+	RetriedRequests int64            `json:"retriedRequests"`
+	Retries         int64            `json:"retries"`
+	Recovered       int64            `json:"recovered"`
+	Exhausted       int64            `json:"exhausted"`
+	ByReason        map[string]int64 `json:"byReason,omitempty"`
+}
+
+func New(manifest string) *Report {
+	return &Report{Manifest: manifest, StartedAt: time.Now(), Images: []ImageResult{}, Resources: []ResourceResult{}}
+}
+
+// ValidateFormat checks report format is one of json or junit
+func ValidateFormat(format string) error {
+	if format != FORMAT_JSON && format != FORMAT_JUNIT {
+		return errors.New("report format must be " + FORMAT_JSON + " or " + FORMAT_JUNIT)
+	}
+	return nil
+}
+
+// AddImage records docker image build. Report methods are no-op on nil report, so callers don't have to check if report is enabled
+func (r *Report) AddImage(image ImageResult) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Images = append(r.Images, image)
+}
+
+// AddDigest records digest of image tag, which actions are pinned to
+func (r *Report) AddDigest(image string, digest string) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.Digests == nil {
+		r.Digests = map[string]string{}
+	}
+	r.Digests[image] = digest
+}
+
+func (r *Report) AddResource(resource ResourceResult) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Resources = append(r.Resources, resource)
+}
+
+func (r *Report) SetRetries(stats RetryStats) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Retries = &stats
+}
+
+// Write saves report in given format (json or junit) to path
+func (r *Report) Write(format string, path string) error {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Duration = time.Since(r.StartedAt).Milliseconds()
+
+	var content []byte
+	var err error
+	switch format {
+	case FORMAT_JSON:
+		content, err = json.MarshalIndent(r, "", "  ")
+	case FORMAT_JUNIT:
+		content, err = xml.MarshalIndent(r.junit(), "", "  ")
+		content = append([]byte(xml.Header), content...)
+	default:
+		err = ValidateFormat(format)
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+// JUnit XML schema subset understood by Jenkins & GitLab
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Content string `xml:",chardata"`
+}
+
+func (r *Report) junit() junitTestSuites {
+	timestamp := r.StartedAt.Format(time.RFC3339)
+	images := junitTestSuite{Name: "docker-images", Timestamp: timestamp}
+	var imagesTime int64
+	for _, image := range r.Images {
+		testCase := junitTestCase{ClassName: "image", Name: image.Name, Time: seconds(image.Duration), SystemOut: image.Image}
+		if image.Error != "" {
+			testCase.Failure = &junitMessage{Message: image.Error, Content: image.Dockerfile}
+			images.Failures++
+		} else if image.Reused {
+			testCase.Skipped = &junitMessage{Message: "exists in registry"}
+			images.Skipped++
+		} else if image.Skipped {
+			testCase.Skipped = &junitMessage{Message: "skipped"}
+			images.Skipped++
+		}
+		imagesTime += image.Duration
+		images.TestCases = append(images.TestCases, testCase)
+	}
+	images.Tests = len(images.TestCases)
+	images.Time = seconds(imagesTime)
+
+	resources := junitTestSuite{Name: "cortex-resources", Timestamp: timestamp}
+	var resourcesTime int64
+	for _, resource := range r.Resources {
+		testCase := junitTestCase{ClassName: resource.Kind, Name: resource.Name, Time: seconds(resource.Duration), SystemOut: resource.Source}
+		switch resource.Status {
+		case STATUS_FAILED:
+			testCase.Failure = &junitMessage{Message: resource.Error, Content: fmt.Sprint("HTTP status: ", resource.StatusCode, "\nsource: ", resource.Source, "\ntransformer: ", resource.Transformer)}
+			resources.Failures++
+		case STATUS_NOT_DEPLOYED:
+			testCase.Skipped = &junitMessage{Message: "not deployed"}
+			resources.Skipped++
+		case STATUS_ROLLED_BACK:
+			testCase.Skipped = &junitMessage{Message: "rolled back"}
+			resources.Skipped++
+		}
+		resourcesTime += resource.Duration
+		resources.TestCases = append(resources.TestCases, testCase)
+	}
+	resources.Tests = len(resources.TestCases)
+	resources.Time = seconds(resourcesTime)
+	return junitTestSuites{Suites: []junitTestSuite{images, resources}}
+}
+
+func seconds(millis int64) string {
+	return fmt.Sprintf("%.3f", float64(millis)/1000)
+}
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"fabric-ops/cmd/build"
+	"fabric-ops/cmd/config"
+	"fabric-ops/cmd/registry"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// resolveActionImages looks up images of Dockerfiles in repo in registry, for substituting action images when deploying without building.
+// With commit, the image tagged for that commit (in configured tag format) is used. Otherwise the newest image (by creation time in its config)
+// with tag matching tag format for current branch is used. Images not found for commit are an error, images not found otherwise are not substituted
+func resolveActionImages(repoDir string, commit string) build.ImageMap {
+	format := config.Get(config.DOCKER_IMAGE_TAG_FORMAT)
+	if format == "" {
+		format = build.DEFAULT_TAG_FORMAT
+	}
+	var tag string
+	var pattern *regexp.Regexp
+	if commit != "" {
+		version, err := build.DescribeRevision(repoDir, commit)
+		if err != nil {
+			log.Fatalln("Failed to describe commit ", commit, " of repo ", repoDir, ": ", err)
+		}
+		if tag, err = build.FormatVersion(format, version); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("Looking up images tagged ", tag, " of commit ", commit, " in registry")
+	} else {
+		branch := ""
+		if version, err := build.DescribeRepo(repoDir); err == nil {
+			branch = version.Branch
+		}
+		var err error
+		if pattern, err = build.TagPattern(format, branch); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("Looking up newest images with tag matching ", pattern, " in registry")
+	}
+
+	dockerRegistry, namespace := dockerRegistryAndNamespace(config.Get(config.DOCKER_PREGISTRY_PREFIX))
+	clients := map[string]*registry.Client{}
+	images := build.ImageMap{}
+	var missing []string
+	for _, dockerfile := range findDockerfiles(repoDir) {
+		buildConfig, err := build.LoadBuildConfig(dockerfile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if buildConfig.Skip {
+			continue
+		}
+		name := buildConfig.ImageName(dockerfile)
+		reference := registry.ParseReference(build.DockerImageTag(namespace, name, "latest", dockerRegistry))
+		client, ok := clients[reference.Host]
+		if !ok {
+			if client, err = registry.NewClient(reference.Host); err != nil {
+				log.Fatalln(err)
+			}
+			clients[reference.Host] = client
+		}
+		imageTag := tag
+		if commit == "" {
+			imageTag, err = newestTag(client, reference.Repository, pattern)
+		}
+		var digest string
+		if err == nil && imageTag != "" {
+			digest, err = client.Digest(reference.Repository, imageTag)
+		}
+		if err != nil {
+			log.Fatalln("Failed to look up image of ", name, " in registry ", reference.Host, ": ", err)
+		}
+		if digest == "" {
+			log.Println("[WARN] No image of ", name, " found in registry ", reference.Host, " (repository ", reference.Repository, ")")
+			missing = append(missing, name)
+			continue
+		}
+		image := build.Image{Image: build.DockerImageTag(namespace, name, imageTag, dockerRegistry), Digest: digest}
+		log.Println("Resolved image of ", name, ": ", image.Image, " with digest ", image.Digest)
+		images[name] = image
+	}
+	if commit != "" && len(missing) > 0 {
+		log.Fatalln("Images of commit ", commit, " are not in registry: ", strings.Join(missing, ", "), ". Build them first with `fabric build`")
+	}
+	return images
+}
+
+// newestTag returns tag of repository matching pattern, of image created last. Empty if no tag matches
+func newestTag(client *registry.Client, repository string, pattern *regexp.Regexp) (string, error) {
+	tags, err := client.Tags(repository)
+	if err != nil {
+		return "", err
+	}
+	newest := ""
+	var newestCreated time.Time
+	for _, tag := range tags {
+		if !pattern.MatchString(tag) {
+			continue
+		}
+		created, err := client.Created(repository, tag)
+		if err != nil {
+			return "", err
+		}
+		if newest == "" || created.After(newestCreated) {
+			newest, newestCreated = tag, created
+		}
+	}
+	return newest, nil
+}
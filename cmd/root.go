@@ -7,7 +7,12 @@ import (
 	"encoding/pem"
 	"errors"
 	"fabric-ops/cmd/build"
+	"fabric-ops/cmd/config"
 	"fabric-ops/cmd/deploy"
+	"fabric-ops/cmd/registry"
+	"fabric-ops/cmd/report"
+	"fabric-ops/cmd/secret"
+	"fmt"
 	"github.com/spf13/cobra"
 	"github.com/spf13/cobra/doc"
 	"github.com/tidwall/gjson"
@@ -17,7 +22,13 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
 )
 
 const (
@@ -25,7 +36,6 @@ const (
 )
 
 var (
-	dockerfileRegex, _   = regexp.Compile("Dockerfile")
 	jsonYamlFileRegex, _ = regexp.Compile(".*\\.(json|yaml)")
 	pathSep, _           = regexp.Compile(`\\|/`)
 )
@@ -43,27 +53,50 @@ var rootCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		log.Println("Building Cortex Action in repo checkout ", args[0])
 		var repoDir = args[0]
-		var dockerfiles = build.GlobFiles(repoDir, *dockerfileRegex)
+		var dockerfiles = findDockerfiles(repoDir)
 		mapping := map[string]string{} // get docker images built
 
+		manifestFile := cmd.Flag("manifest").Value.String()
+		if manifestFile == "" {
+			manifestFile = defaultManifestFile
+		}
+		options := getDeployOptions(cmd, manifestFile)
+		cortex := createCortexClientFromConfig()
+		workDir, removeWorkDir := newWorkDir(repoDir)
+		// resources are read before building images, so missing dependency or dependency cycle fails before any image is pushed
+		graph := manifestResources(cortex, repoDir, workDir, manifestFile, nil)
+
 		if len(dockerfiles) == 0 {
 			log.Println("No Dockerfiles found in ", repoDir)
 		} else {
 			log.Println("Repo ", repoDir, " Dockerfiles ", dockerfiles)
-			var gitTag = build.DockerBuildVersion(repoDir)
-			var namespace = deploy.GetEnvVar("DOCKER_PREGISTRY_PREFIX")
-			dockerimages := buildActionImages(dockerfiles, repoDir, gitTag, namespace)
-			for _, image := range dockerimages {
-				mapping[deploy.DockerImageName(image)] = image
+			buildOptions := getBuildOptions(cmd)
+			var gitTag = gitVersion(repoDir, buildOptions)
+			var namespace = config.Get(config.DOCKER_PREGISTRY_PREFIX)
+			var images build.ImageMap
+			if options.DryRun {
+				// images are not built in dry run, but action images are substituted with the ones this run would build
+				images = plannedActionImages(dockerfiles, repoDir, gitTag, namespace, buildOptions)
+			} else {
+				var err error
+				if images, err = buildActionImages(dockerfiles, repoDir, gitTag, namespace, buildOptions, options.Report); err != nil {
+					writeReport(cmd, options.Report)
+					removeWorkDir()
+					log.Fatalln(err)
+				}
+				writeImageMap(cmd, images)
 			}
+			mapping = imageMapping(images, pinDigest(cmd), options.Report)
 		}
 
-		manifestFile := cmd.Flag("manifest").Value.String()
-		if manifestFile == "" {
-			manifestFile = defaultManifestFile
-		}
 		//deploy
-		deployCortexManifest(repoDir, manifestFile, mapping)
+		substituteActionImages(graph, mapping)
+		err := deployManifestResources(cortex, repoDir, manifestFile, graph, options)
+		removeWorkDir()
+		writeReport(cmd, options.Report)
+		if err != nil {
+			log.Fatalln(err)
+		}
 	},
 }
 
@@ -74,18 +107,27 @@ var buildCmd = &cobra.Command{
 	Short:                 "Search for Dockerfile(s) in Git repo and builds Docker images",
 	Long:                  `Follows convention: Build docker image using Dockerfile and configured build context, <DOCKER_PREGISTRY_PREFIX as namespace>/<image name as parent dir>:g<Git tag and version>, and return build image details`,
 	Run: func(cmd *cobra.Command, args []string) {
-		log.Println("Building Cortex Action in repo checkout ", args[0])
 		var repoDir = args[0]
-		var dockerfiles = build.GlobFiles(repoDir, *dockerfileRegex)
+		var dockerfiles = findDockerfiles(repoDir)
+		if list, _ := cmd.Flags().GetBool("list"); list {
+			listDockerfiles(repoDir, dockerfiles)
+			return
+		}
+		log.Println("Building Cortex Action in repo checkout ", args[0])
 		if len(dockerfiles) == 0 {
 			log.Println("No Dockerfile found in ", repoDir)
 			return
 		}
 
-		var gitTag = build.DockerBuildVersion(repoDir)
-		var namespace = deploy.GetEnvVar("DOCKER_PREGISTRY_PREFIX")
+		buildOptions := getBuildOptions(cmd)
+		var gitTag = gitVersion(repoDir, buildOptions)
+		var namespace = config.Get(config.DOCKER_PREGISTRY_PREFIX)
 
-		buildActionImages(dockerfiles, repoDir, gitTag, namespace)
+		images, err := buildActionImages(dockerfiles, repoDir, gitTag, namespace, buildOptions, nil)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		writeImageMap(cmd, images)
 	},
 }
 
@@ -101,10 +143,9 @@ var deployCmd = &cobra.Command{
 			`actionImageMapping` is actionName (and docker image name) to docker image URL in registry mapping. This is required for substituting
 			docker image in action definition exported from one environment and deploying to other environment.
 
-			Currently, invoking this will not perform docker image substitution and action deployment may fail, unless deploying action in same DCI from where
-			its exported or image exists in the DCI (may be manually copied or docker registry is shared within multiple DCIs)
-
-			Alternatively, we can query docker registry based on image name. But this will add dependency on registry tools/plugins for search. Better use root cmd for action substitution
+			Images are substituted with --images, a file written by `fabric build --images-file` in build stage, or with images looked up in registry
+			with --resolve-images or --image-commit. Otherwise action deployment may fail, unless deploying action in same DCI from where its exported
+			or image exists in the DCI (may be manually copied or docker registry is shared within multiple DCIs)
 		*/
 		manifestFile := cmd.Flag("manifest").Value.String()
 		if manifestFile == "" {
@@ -112,56 +153,377 @@ var deployCmd = &cobra.Command{
 		}
 		//deploy
 		log.Println("Deploying Cortex resources from manifest ", manifestFile, " in repo ", repoDir)
-		deployCortexManifest(repoDir, manifestFile, nil)
+		options := getDeployOptions(cmd, manifestFile)
+		var mapping map[string]string
+		resolve, _ := cmd.Flags().GetBool("resolve-images")
+		commit := cmd.Flag("image-commit").Value.String()
+		imagesFile := cmd.Flag("images").Value.String()
+		if resolve || commit != "" || imagesFile != "" {
+			images := build.ImageMap{}
+			if resolve || commit != "" {
+				images = resolveActionImages(repoDir, commit)
+			}
+			if imagesFile != "" {
+				built, err := build.ReadImageMap(imagesFile)
+				if err != nil {
+					log.Fatalln(err)
+				}
+				log.Println("Substituting images of actions with ", len(built), " images from ", imagesFile)
+				// images built override images looked up in registry
+				for name, image := range built {
+					images[name] = image
+				}
+			}
+			mapping = imageMapping(images, pinDigest(cmd), options.Report)
+		}
+		err := deployCortexManifest(repoDir, manifestFile, mapping, options)
+		writeReport(cmd, options.Report)
+		if err != nil {
+			log.Fatalln(err)
+		}
 	},
 }
 
 var dockerLoginCmd = &cobra.Command{
-	Use: "dockerAuth <DockerRegistryURL> <User> <Password>",
+	Use: "dockerAuth <DockerRegistryURL> <User> [--password-stdin | --password-file <file>]",
 	Args: func(cmd *cobra.Command, args []string) error {
-		if len(args) < 3 {
-			return errors.New("requires 3 args: <DockerRegistryURL> <User> <Password>")
+		if len(args) == 3 {
+			return errors.New("password as argument is exposed in process list and shell history, use --password-stdin or --password-file")
+		}
+		if len(args) != 2 {
+			return errors.New("requires 2 args: <DockerRegistryURL> <User>")
 		}
 		return nil
 	},
 	DisableFlagsInUseLine: true,
 	Short:                 "Docker login for pushing images",
-	Long:                  "Docker login for pushing images",
+	Long: `Docker login for pushing images. Credentials are validated and saved in docker config $DOCKER_CONFIG/config.json (~/.docker/config.json),
+or with credential helper of registry (credsStore or credHelpers in docker config), same as docker login. Password is read from stdin or file
+(password as argument isn't accepted), so it isn't exposed in process list or shell history. Login to Docker registry of Cortex DCI isn't needed for building images, Cortex token is used for it`,
 	Run: func(cmd *cobra.Command, args []string) {
 		dockerRegistry := args[0]
 		dockerUser := args[1]
-		dockerPassword := args[2]
+		dockerPassword, err := readPassword(cmd)
+		if err != nil {
+			log.Fatalln(err)
+		}
 
 		build.DockerLogin(dockerRegistry, dockerUser, dockerPassword)
 		log.Println("Docker login successful")
 	},
 }
 
-func buildActionImages(dockerfiles []string, repoDir string, gitTag string, namespace string) []string {
-	cortex := createCortexClientFromConfig()
-	registry := deploy.GetEnvVar("DOCKER_PREGISTRY_URL")
-	if namespace == "" {
-		namespace = cortex.GetAccount()
+// readPassword reads password of dockerAuth from stdin or file, with trailing newline removed
+func readPassword(cmd *cobra.Command) (string, error) {
+	passwordStdin, _ := cmd.Flags().GetBool("password-stdin")
+	passwordFile := cmd.Flag("password-file").Value.String()
+	var content []byte
+	var err error
+	switch {
+	case passwordStdin && passwordFile != "":
+		return "", errors.New("--password-stdin and --password-file can't be used together")
+	case passwordStdin:
+		content, err = ioutil.ReadAll(os.Stdin)
+	case passwordFile != "":
+		content, err = ioutil.ReadFile(passwordFile)
+	default:
+		return "", errors.New("password is required, use --password-stdin or --password-file")
 	}
-	if registry == "" {
-		registry = cortex.GetDockerRegistry()
-	} else {
-		registry = strings.Trim(registry, "/")
+	if err != nil {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+	password := strings.TrimRight(string(content), "\r\n")
+	if password == "" {
+		return "", errors.New("password is empty")
+	}
+	return password, nil
+}
+
+// findDockerfiles returns Dockerfiles of repo matching DOCKERFILE_INCLUDE globs, except DOCKERFILE_EXCLUDE globs and .fabricignore
+func findDockerfiles(repoDir string) []string {
+	include := build.SplitPatterns(config.Get(config.DOCKERFILE_INCLUDE), build.DEFAULT_DOCKERFILE_INCLUDE)
+	exclude := build.SplitPatterns(config.Get(config.DOCKERFILE_EXCLUDE), build.DEFAULT_DOCKERFILE_EXCLUDE)
+	dockerfiles, err := build.FindDockerfiles(repoDir, include, exclude)
+	if err != nil {
+		log.Fatalln("Failed to search Dockerfiles in ", repoDir, ": ", err)
+	}
+	return dockerfiles
+}
+
+// listDockerfiles prints discovered Dockerfiles with image name and build context, without building
+func listDockerfiles(repoDir string, dockerfiles []string) {
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "DOCKERFILE\tNAME\tCONTEXT\tBUILD")
+	for _, dockerfile := range dockerfiles {
+		buildConfig, err := build.LoadBuildConfig(dockerfile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		outcome := "yes"
+		if buildConfig.Skip {
+			outcome = "skipped"
+		}
+		fmt.Fprintln(table, strings.Join([]string{repoPath(repoDir, dockerfile), buildConfig.ImageName(dockerfile), repoPath(repoDir, getBuildContext(repoDir, dockerfile, buildConfig)), outcome}, "\t"))
+	}
+	table.Flush()
+}
+
+// repoPath returns path relative to repo, if it's in repo
+func repoPath(repoDir string, path string) string {
+	if rel, err := filepath.Rel(repoDir, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return path
+}
+
+// buildOptions are flags of root and build command controlling image builds
+type buildOptions struct {
+	SkipExisting   bool // reuse image with same tag in registry instead of building and pushing
+	ContextHashTag bool // tag images with hash of build context instead of git version
+	AllowLatest    bool // allow tagging images `latest`, outside git repo or by tag format
+	Concurrency    int  // images built at the same time
+}
+
+func getBuildOptions(cmd *cobra.Command) buildOptions {
+	skipExisting, _ := cmd.Flags().GetBool("skip-existing")
+	contextHashTag, _ := cmd.Flags().GetBool("context-hash-tag")
+	allowLatest, _ := cmd.Flags().GetBool("allow-latest")
+	concurrency, _ := cmd.Flags().GetInt("build-concurrency")
+	if concurrency < 1 {
+		log.Fatalln("--build-concurrency must be at least 1")
+	}
+	return buildOptions{SkipExisting: skipExisting, ContextHashTag: contextHashTag, AllowLatest: allowLatest, Concurrency: concurrency}
+}
+
+// gitVersion returns image version of repo in configured tag format. It isn't used with --context-hash-tag, so repo doesn't need to be a git repo
+func gitVersion(repoDir string, options buildOptions) string {
+	if options.ContextHashTag {
+		return ""
+	}
+	return build.DockerBuildVersion(repoDir, config.Get(config.DOCKER_IMAGE_TAG_FORMAT), options.AllowLatest)
+}
+
+// imageBuild is outcome of building an image, shown in build summary
+type imageBuild struct {
+	Name       string
+	Dockerfile string
+	Image      string
+	Digest     string
+	Reused     bool // image existed in registry
+	Skipped    bool // skipped in fabric-build.yaml
+	Duration   time.Duration
+	Err        error
+}
+
+// buildActionImages builds and pushes images of Dockerfiles, --build-concurrency at a time. All images are built even if some fail, and error lists failed images
+func buildActionImages(dockerfiles []string, repoDir string, gitTag string, namespace string, options buildOptions, buildReport *report.Report) (build.ImageMap, error) {
+	dockerRegistry, namespace := dockerRegistryAndNamespace(namespace)
+	if options.ContextHashTag {
+		gitTag = "<build context hash>"
+	}
+	log.Println("Building Docker images with tag: ", gitTag, " and namespace: ", namespace, ". Pushing to registry: ", dockerRegistry)
+
+	builds := make([]imageBuild, len(dockerfiles))
+	slots := make(chan struct{}, options.Concurrency)
+	var wg sync.WaitGroup
+	for i, dockerfile := range dockerfiles {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, dockerfile string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			builds[i] = buildActionImage(dockerfile, repoDir, gitTag, namespace, dockerRegistry, options)
+		}(i, dockerfile)
+	}
+	wg.Wait()
+
+	images := build.ImageMap{}
+	var failed []string
+	for _, b := range builds {
+		result := report.ImageResult{Name: b.Name, Dockerfile: b.Dockerfile, Image: b.Image, Digest: b.Digest, Reused: b.Reused, Skipped: b.Skipped, Duration: b.Duration.Milliseconds()}
+		if b.Err != nil {
+			result.Error = secret.Redact(b.Err.Error())
+			failed = append(failed, b.Name)
+		} else if !b.Skipped {
+			images[deploy.DockerImageName(b.Image)] = build.Image{Image: b.Image, Digest: b.Digest}
+		}
+		buildReport.AddImage(result)
+	}
+	logBuildSummary(builds)
+	if len(failed) > 0 {
+		return images, errors.New(fmt.Sprint("Failed to build ", len(failed), " of ", len(builds), " Docker images: ", strings.Join(failed, ", ")))
 	}
+	return images, nil
+}
+
+// pinDigest returns whether action images are referenced by digest (--pin-digest)
+func pinDigest(cmd *cobra.Command) bool {
+	pin, _ := cmd.Flags().GetBool("pin-digest")
+	return pin
+}
 
-	log.Println("Building Docker images with tag: ", gitTag, " and namespace: ", namespace, ". Pushing to registry: ", registry)
+// imageMapping returns images to substitute in actions by image name. Digests of pinned images are logged and recorded in report
+func imageMapping(images build.ImageMap, pin bool, deployReport *report.Report) map[string]string {
+	if pin {
+		for _, name := range sortedImageNames(images) {
+			image := images[name]
+			if image.Digest == "" {
+				log.Println("[WARN] Digest of image ", image.Image, " is not known, actions use its tag")
+				continue
+			}
+			log.Println("Image ", image.Image, " is pinned to digest ", image.Digest)
+			deployReport.AddDigest(image.Image, image.Digest)
+		}
+	}
+	return images.Mapping(pin)
+}
 
-	dockerimages := []string{}
+func sortedImageNames(images build.ImageMap) []string {
+	names := make([]string, 0, len(images))
+	for name := range images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writeImageMap saves images built to --images-file, if set
+func writeImageMap(cmd *cobra.Command, images build.ImageMap) {
+	imagesFile := cmd.Flag("images-file").Value.String()
+	if imagesFile == "" {
+		return
+	}
+	if err := build.WriteImageMap(imagesFile, images); err != nil {
+		log.Fatalln("Failed to write images file ", imagesFile, ": ", err)
+	}
+	log.Println("Images written to ", imagesFile)
+}
+
+// buildActionImage builds image of Dockerfile, unless image with same tag exists in registry. Output is prefixed with image name
+func buildActionImage(dockerfile string, repoDir string, gitTag string, namespace string, dockerRegistry string, options buildOptions) (result imageBuild) {
+	start := time.Now()
+	buildConfig, err := build.LoadBuildConfig(dockerfile)
+	var name = buildConfig.ImageName(dockerfile)
+	logger := log.New(log.Writer(), "["+name+"] ", log.Flags()|log.Lmsgprefix)
+	result = imageBuild{Name: name, Dockerfile: dockerfile, Err: err}
+	defer func() { result.Duration = time.Since(start) }()
+	if err != nil {
+		return result
+	}
+	if buildConfig.Skip {
+		logger.Println("Skipping ", dockerfile, ", skipped in ", build.BUILD_CONFIG_FILE)
+		result.Skipped = true
+		return result
+	}
+
+	logger.Println("Building ", dockerfile)
+	buildContext := getBuildContext(repoDir, dockerfile, buildConfig)
+	version, err := imageVersion(dockerfile, buildContext, gitTag, options)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if options.SkipExisting {
+		tag := build.DockerImageTag(namespace, name, version, dockerRegistry)
+		if digest := build.ExistingImageDigest(tag, logger); digest != "" {
+			logger.Println("Image ", tag, " exists in registry with digest ", digest, ", skipping build")
+			result.Image, result.Digest, result.Reused = tag, digest, true
+			return result
+		}
+	}
+	result.Image, result.Digest, result.Err = build.BuildActionImage(namespace, name, version, dockerfile, buildContext, dockerRegistry, buildConfig, logger)
+	if result.Err != nil {
+		logger.Println("Failed to build ", dockerfile, ": ", result.Err)
+	}
+	return result
+}
+
+func logBuildSummary(builds []imageBuild) {
+	var summary bytes.Buffer
+	table := tabwriter.NewWriter(&summary, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "NAME\tIMAGE\tDIGEST\tDURATION\tRESULT")
+	for _, b := range builds {
+		outcome := "BUILT"
+		if b.Err != nil {
+			outcome = "FAILED: " + strings.ReplaceAll(b.Err.Error(), "\n", " ")
+		} else if b.Reused {
+			outcome = "EXISTS"
+		} else if b.Skipped {
+			outcome = "SKIPPED"
+		}
+		image, digest := b.Image, b.Digest
+		if image == "" {
+			image = "-"
+		}
+		if digest == "" {
+			digest = "-"
+		}
+		fmt.Fprintln(table, strings.Join([]string{b.Name, image, digest, b.Duration.Round(time.Second).String(), outcome}, "\t"))
+	}
+	table.Flush()
+	log.Print("Build summary:\n", summary.String())
+}
+
+// plannedActionImages returns docker images buildActionImages would build and push, without building
+func plannedActionImages(dockerfiles []string, repoDir string, gitTag string, namespace string, options buildOptions) build.ImageMap {
+	dockerRegistry, namespace := dockerRegistryAndNamespace(namespace)
+	images := build.ImageMap{}
 	for _, dockerfile := range dockerfiles {
-		log.Println("Building ", dockerfile)
-		var name = filepath.Base(filepath.Dir(dockerfile))
-		dockerimages = append(dockerimages, build.BuildActionImage(namespace, name, gitTag, dockerfile, getBuildContext(repoDir, dockerfile), registry))
+		buildConfig, err := build.LoadBuildConfig(dockerfile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if buildConfig.Skip {
+			continue
+		}
+		var name = buildConfig.ImageName(dockerfile)
+		version, err := imageVersion(dockerfile, getBuildContext(repoDir, dockerfile, buildConfig), gitTag, options)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		image := build.DockerImageTag(namespace, name, version, dockerRegistry)
+		images[deploy.DockerImageName(image)] = build.Image{Image: image}
+	}
+	return images
+}
+
+// imageVersion is git version of repo, or hash of build context with --context-hash-tag
+func imageVersion(dockerfile string, buildContext string, gitTag string, options buildOptions) (string, error) {
+	if options.ContextHashTag {
+		return build.ContextHashVersion(dockerfile, buildContext)
+	}
+	return gitTag, nil
+}
+
+// dockerRegistryAndNamespace returns configured docker registry & namespace, defaults to Cortex DCI registry and account/project
+func dockerRegistryAndNamespace(namespace string) (string, string) {
+	cortex := createCortexClientFromConfig()
+	dockerRegistry := config.Get(config.DOCKER_PREGISTRY_URL)
+	if namespace == "" {
+		namespace = cortex.GetAccount()
 	}
-	return dockerimages
+	if dockerRegistry == "" {
+		var err error
+		dockerRegistry, err = cortex.GetDockerRegistry()
+		if err != nil {
+			log.Fatalln("Failed to get Docker registry of Cortex DCI", err)
+		}
+		// DCI registry accepts Cortex token, used if docker config doesn't have credentials of it
+		registry.SetDefaultCredentials(dockerRegistry, registry.Credentials{Username: "cli", Password: cortex.GetToken()})
+	} else {
+		dockerRegistry = strings.Trim(dockerRegistry, "/")
+	}
+	return dockerRegistry, namespace
 }
 
-func getBuildContext(repoDir string, dockerfile string) string {
-	buildContext := deploy.GetEnvVar("DOCKER_BUILD_CONTEXT")
+// getBuildContext returns build context of Dockerfile from its fabric-build.yaml (path relative to directory of Dockerfile), or DOCKER_BUILD_CONTEXT
+func getBuildContext(repoDir string, dockerfile string, buildConfig build.BuildConfig) string {
+	buildContext := config.Get(config.DOCKER_BUILD_CONTEXT)
+	if buildConfig.Context != "" {
+		buildContext = buildConfig.Context
+	}
 	switch buildContext {
 	case "", "DOCKERFILE_CURRENT_DIR":
 		return filepath.Dir(dockerfile)
@@ -170,6 +532,9 @@ func getBuildContext(repoDir string, dockerfile string) string {
 	case "REPO_ROOT":
 		return repoDir
 	default:
+		if buildConfig.Context != "" && !filepath.IsAbs(buildContext) {
+			return filepath.Join(filepath.Dir(dockerfile), buildContext)
+		}
 		return buildContext
 	}
 }
@@ -178,199 +543,438 @@ func checkTransformerExists(repoDir string) map[string]bool {
 	scriptTypeExists := map[string]bool{}
 	resourceTypes := []string{"agent", "snapshot", "skill", "action", "connection"}
 	for _, resourceType := range resourceTypes {
-		scriptPath := filepath.Join(repoDir, deploy.ARTIFACT_DIR, "_transformers", resourceType+".jsonnet")
-		_, err := os.Stat(scriptPath)
+		_, err := os.Stat(transformerScript(repoDir, resourceType))
 		scriptTypeExists[resourceType] = !os.IsNotExist(err)
 	}
 	return scriptTypeExists
 }
 
-func transformResource(resourceType string, repoDir string, relPath string, manifestFilePath string) string {
-	scriptPath := filepath.Join(repoDir, ".fabric", "_transformers", resourceType+".jsonnet")
-	json, err := deploy.Transform(filepath.Join(repoDir, relPath), scriptPath, resourceType, repoDir, manifestFilePath)
+// transformerScript returns path of jsonnet transformer script of resource type.
+// Script of selected environment `_transformers/<env>/<type>.jsonnet` is used, if it exists, instead of `_transformers/<type>.jsonnet`
+func transformerScript(repoDir string, resourceType string) string {
+	transformersDir := filepath.Join(repoDir, deploy.ARTIFACT_DIR, "_transformers")
+	if env := config.Selected(); env != "" {
+		scriptPath := filepath.Join(transformersDir, env, resourceType+".jsonnet")
+		if _, err := os.Stat(scriptPath); err == nil {
+			return scriptPath
+		}
+	}
+	return filepath.Join(transformersDir, resourceType+".jsonnet")
+}
+
+// transformerVars are settings of selected environment passed to transformer scripts as ext vars, along with env vars. Credentials are not passed
+func transformerVars() map[string]string {
+	vars := map[string]string{"env": config.Selected()}
+	for _, key := range []string{config.CORTEX_URL, config.CORTEX_ACCOUNT, config.CORTEX_PROJECT, config.DOCKER_PREGISTRY_URL, config.DOCKER_PREGISTRY_PREFIX, config.DOCKER_BUILD_CONTEXT} {
+		if value := config.Get(key); value != "" {
+			vars[key] = value
+		}
+	}
+	return vars
+}
+
+// newWorkDir creates directory for transformed resources of this run in `_tmp` of repo, so concurrent runs don't overwrite each other.
+// Returns the directory and function to remove it
+func newWorkDir(repoDir string) (string, func()) {
+	tmpDir := filepath.Join(repoDir, "_tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		log.Fatalln("Failed to create directory", tmpDir, err)
+	}
+	workDir, err := ioutil.TempDir(tmpDir, "run-")
+	if err != nil {
+		log.Fatalln("Failed to create directory in", tmpDir, err)
+	}
+	return workDir, func() {
+		os.RemoveAll(workDir)
+		// fails if other runs are using it
+		os.Remove(tmpDir)
+	}
+}
+
+// transformResource applies jsonnet transformer script of resource type and returns path of transformed resource (in workDir) and the script
+func transformResource(resourceType string, repoDir string, workDir string, relPath string, manifestFilePath string) (string, string) {
+	scriptPath := transformerScript(repoDir, resourceType)
+	json, err := deploy.Transform(filepath.Join(repoDir, relPath), scriptPath, resourceType, repoDir, manifestFilePath, transformerVars())
 	if err != nil {
 		log.Fatalln("Failed to transform resource", relPath, "using", scriptPath, err)
 	}
-	resourcePath := filepath.Join(repoDir, "_tmp", relPath) + ".json"
+	resourcePath := filepath.Join(workDir, relPath) + ".json"
 	deploy.WriteToPath(resourcePath, []byte(json))
-	return resourcePath
+	return resourcePath, scriptPath
 }
 
-func deployCortexManifest(repoDir string, manifestFilePath string, actionImageMapping map[string]string) {
+// deployOptions are flags of root and deploy command controlling deployment of manifest
+type deployOptions struct {
+	DryRun      bool
+	KeepGoing   bool           // continue deploying remaining resources after a failure
+	Concurrency int            // resources deployed at the same time
+	Atomic      bool           // roll back deployed resources on failure
+	Prune       bool           // delete resources not in manifest after deployment
+	Yes         bool           // delete pruned resources without confirmation
+	Report      *report.Report // nil unless requested with --report
+}
+
+func getDeployOptions(cmd *cobra.Command, manifestFile string) deployOptions {
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	keepGoing, _ := cmd.Flags().GetBool("keep-going")
+	failFast, _ := cmd.Flags().GetBool("fail-fast")
+	if keepGoing && failFast && cmd.Flags().Changed("fail-fast") {
+		log.Fatalln("Only one of --fail-fast and --keep-going can be used")
+	}
+	concurrency, _ := cmd.Flags().GetInt("concurrency")
+	if concurrency < 1 {
+		log.Fatalln("--concurrency must be at least 1")
+	}
+	atomicDeploy, _ := cmd.Flags().GetBool("atomic")
+	if atomicDeploy && keepGoing {
+		log.Fatalln("Only one of --atomic and --keep-going can be used")
+	}
+	prune, _ := cmd.Flags().GetBool("prune")
+	yes, _ := cmd.Flags().GetBool("yes")
+	options := deployOptions{DryRun: dryRun, KeepGoing: keepGoing, Concurrency: concurrency, Atomic: atomicDeploy, Prune: prune, Yes: yes}
+	if format := cmd.Flag("report").Value.String(); format != "" {
+		if err := report.ValidateFormat(format); err != nil {
+			log.Fatalln(err)
+		}
+		options.Report = report.New(manifestFile)
+	}
+	return options
+}
+
+// writeReport saves report to --report-file, defaults to fabric-report.json or fabric-report.xml (for junit)
+func writeReport(cmd *cobra.Command, deployReport *report.Report) {
+	if deployReport == nil {
+		return
+	}
+	format := cmd.Flag("report").Value.String()
+	reportFile := cmd.Flag("report-file").Value.String()
+	if reportFile == "" {
+		reportFile = "fabric-report.json"
+		if format == report.FORMAT_JUNIT {
+			reportFile = "fabric-report.xml"
+		}
+	}
+	if err := deployReport.Write(format, reportFile); err != nil {
+		log.Println("Failed to write report", reportFile, err)
+		return
+	}
+	log.Println("Report written to", reportFile)
+}
+
+// deployResult is outcome of deploying a resource, shown in deployment summary
+type deployResult struct {
+	Resource   deploy.Resource
+	StatusCode int
+	Duration   time.Duration
+	Err        error
+	Deployed   bool
+	RolledBack bool
+}
+
+// deployCortexManifest deploys all resources in manifest and logs summary. Returns error if any resource failed to deploy
+func deployCortexManifest(repoDir string, manifestFilePath string, actionImageMapping map[string]string, options deployOptions) error {
 	var cortex = createCortexClientFromConfig()
+	workDir, removeWorkDir := newWorkDir(repoDir)
+	defer removeWorkDir()
+	graph := manifestResources(cortex, repoDir, workDir, manifestFilePath, actionImageMapping)
+	return deployManifestResources(cortex, repoDir, manifestFilePath, graph, options)
+}
 
+// deployManifestResources deploys resources of manifest in dependency order and logs summary. Returns error if any resource failed to deploy
+func deployManifestResources(cortex deploy.CortexAPI, repoDir string, manifestFilePath string, graph *deploy.DependencyGraph, options deployOptions) error {
+	if options.DryRun {
+		planCortexResources(cortex, deployableResources(graph.Resources))
+		if options.Prune {
+			planPrune(cortex, graph.Resources)
+		}
+		log.Println("Planned all artifacts from manifest", manifestFilePath, ". Nothing is deployed in dry run")
+		return nil
+	}
+	if options.Concurrency > 1 {
+		log.Println("Deploying up to", options.Concurrency, "independent resources at the same time")
+	}
+	var tx *deploy.Transaction
+	if options.Atomic {
+		tx = deploy.NewTransaction(cortex)
+	}
+	results := make([]deployResult, len(graph.Resources))
+	var failed int32
+	graph.Walk(options.Concurrency, options.KeepGoing, func(i int) error {
+		resource := graph.Resources[i]
+		if resource.Campaign != "" {
+			// deployed by campaign import
+			return nil
+		}
+		start := time.Now()
+		err := captureResource(tx, graph, resource)
+		var res *deploy.Response
+		if err == nil {
+			res, err = deployResource(cortex, repoDir, resource)
+		}
+		results[i].Duration = time.Since(start)
+		results[i].Deployed = true
+		results[i].Err = err
+		if res != nil {
+			results[i].StatusCode = res.StatusCode
+		}
+		var responseError *deploy.ResponseError
+		if errors.As(err, &responseError) {
+			results[i].StatusCode = responseError.StatusCode
+		}
+		if err != nil {
+			atomic.AddInt32(&failed, 1)
+			log.Println("Failed to deploy", resource.Kind, resource.Name, "from", resource.Source, ". Error:", err)
+		} else {
+			log.Println(res)
+		}
+		return err
+	})
+	var rollbackErr error
+	if failed > 0 && options.Atomic {
+		var reverted deploy.Reverted
+		reverted, rollbackErr = tx.Rollback()
+		for i := range results {
+			// resources failed to revert (or which can't be restored, like existing campaigns) are still deployed
+			results[i].RolledBack = results[i].Deployed && results[i].Err == nil && reverted.Contains(graph.Resources[i])
+		}
+		if rollbackErr != nil {
+			log.Println(rollbackErr)
+		}
+	}
+	// resources not visited are not deployed due to failure
+	var deployable []deployResult
+	for i, result := range results {
+		if graph.Resources[i].Campaign == "" {
+			result.Resource = graph.Resources[i]
+			deployable = append(deployable, result)
+		}
+	}
+	results = deployable
+	logDeploymentSummary(results)
+	retryStats := deploy.GetRetryStats()
+	log.Println(retryStats)
+	for _, result := range results {
+		options.Report.AddResource(result.reportResult())
+	}
+	options.Report.SetRetries(report.RetryStats{
+		Requests:        retryStats.Requests,
+		RetriedRequests: retryStats.RetriedRequests,
+		Retries:         retryStats.Retries,
+		Recovered:       retryStats.Recovered,
+		Exhausted:       retryStats.Exhausted,
+		ByReason:        retryStats.ByReason,
+	})
+	if failed > 0 && rollbackErr != nil {
+		return fmt.Errorf("%d of %d resources failed to deploy from manifest %s, and rollback failed: %w", failed, len(results), manifestFilePath, rollbackErr)
+	}
+	if failed > 0 && options.Atomic {
+		return fmt.Errorf("%d of %d resources failed to deploy from manifest %s, deployed resources are rolled back", failed, len(results), manifestFilePath)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d resources failed to deploy from manifest %s", failed, len(results), manifestFilePath)
+	}
+	if options.Prune {
+		if err := pruneCortexResources(cortex, graph.Resources, options.Yes); err != nil {
+			return err
+		}
+	}
+	log.Println("Deployed all artifacts from manifest", manifestFilePath)
+	return nil
+}
+
+// captureResource records current definition of resource for rollback. Campaign is captured along with resources imported with it
+func captureResource(tx *deploy.Transaction, graph *deploy.DependencyGraph, resource deploy.Resource) error {
+	if err := tx.Capture(resource); err != nil || tx == nil || resource.Kind != deploy.KIND_CAMPAIGN {
+		return err
+	}
+	for _, r := range graph.Resources {
+		if r.Campaign == resource.Name {
+			if err := tx.Capture(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r deployResult) reportResult() report.ResourceResult {
+	result := report.ResourceResult{
+		Kind:        r.Resource.Kind,
+		Name:        r.Resource.Name,
+		Source:      r.Resource.Source,
+		Transformer: r.Resource.Transformer,
+		Status:      report.STATUS_DEPLOYED,
+		StatusCode:  r.StatusCode,
+		Duration:    r.Duration.Milliseconds(),
+	}
+	if !r.Deployed {
+		result.Status = report.STATUS_NOT_DEPLOYED
+	} else if r.RolledBack {
+		result.Status = report.STATUS_ROLLED_BACK
+	} else if r.Err != nil {
+		result.Status = report.STATUS_FAILED
+		result.Error = secret.Redact(r.Err.Error())
+	}
+	return result
+}
+
+func logDeploymentSummary(results []deployResult) {
+	var summary bytes.Buffer
+	table := tabwriter.NewWriter(&summary, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "KIND\tNAME\tSOURCE\tSTATUS\tRESULT")
+	for _, result := range results {
+		status := "-"
+		if result.StatusCode > 0 {
+			status = strconv.Itoa(result.StatusCode)
+		}
+		outcome := "OK"
+		if !result.Deployed {
+			outcome = "NOT DEPLOYED"
+		} else if result.RolledBack {
+			outcome = "ROLLED BACK"
+		} else if result.Err != nil {
+			outcome = "FAILED: " + result.Err.Error()
+		}
+		fmt.Fprintln(table, strings.Join([]string{result.Resource.Kind, result.Resource.Name, result.Resource.Source, status, outcome}, "\t"))
+	}
+	table.Flush()
+	log.Print("Deployment summary:\n", summary.String())
+}
+
+// manifestResources walks manifest and returns dependency graph of resources in order of deployment (dependencies first), after applying transformers.
+// Resources included in campaigns are returned with campaign name and without applying transformers, because campaigns are deployed with all its dependencies
+func manifestResources(cortex deploy.CortexAPI, repoDir string, workDir string, manifestFilePath string, actionImageMapping map[string]string) *deploy.DependencyGraph {
 	// check if transformer jsonnet script exists for the resource type
 	scriptTypeExists := checkTransformerExists(repoDir)
 	// process manifest
 	manifest := deploy.NewManifest(filepath.Join(repoDir, manifestFilePath))
-	//depsMapping := manifest.Cortex.Dependencies
-	// dependency checking is on hold https://cognitivescale.atlassian.net/browse/FAB-2481
 
+	_, isV6 := cortex.(*deploy.CortexClientV6)
+	var resources []deploy.Resource
 	// deploy campaigns first because they will be zipped with all dependencies and post together. after that we don't have to skip those dependencies
 	var campaigns []string
 	for _, campaign := range manifest.Cortex.Campaign {
-		v6Client, ok := cortex.(*deploy.CortexClientV6)
-		if ok {
-			relPath := parseManifestResourcePath(campaign)
-			campaignPathSplits := pathSep.Split(relPath, 3)
-			campaignBasepath := filepath.Join(repoDir, campaignPathSplits[0], campaignPathSplits[1])
-
-			//zip campaign
-			zipPath := zipDirectory(campaignBasepath)
-			err := deploy.DeployCampaign(*v6Client, zipPath, true, true)
-			if err != nil {
-				log.Println("Campaign "+campaignPathSplits[1]+"deployment failed with: ", err)
-			}
-			campaigns = append(campaigns, filepath.Join(campaignPathSplits[0], campaignPathSplits[1]))
-			os.Remove(zipPath)
-		} else {
+		if !isV6 {
 			log.Fatalln("Configured Cortex URL and token configured are not of v6. Campaigns are supported in v6 onwards.")
 		}
+		relPath := parseManifestResourcePath(campaign)
+		resources = append(resources, deploy.NewResource(deploy.KIND_CAMPAIGN, relPath, filepath.Join(repoDir, campaignDir(relPath)), ""))
+		campaigns = append(campaigns, campaignDir(relPath))
 	}
-	// deploy types
-	for _, typ := range manifest.Cortex.Type {
-		cortex.DeployTypes(filepath.Join(repoDir, parseManifestResourcePath(typ)))
-	}
-	// deploy connections excluding those deployed as part of campaigns
-	for _, connection := range manifest.Cortex.Connection {
-		relPath := parseManifestResourcePath(connection)
-		// skip connections deployed in campaign deployment
-		skip := false
+	newResource := func(kind string, resourcePath string) deploy.Resource {
+		relPath := parseManifestResourcePath(resourcePath)
 		for _, campaign := range campaigns {
-			if strings.HasPrefix(connection, campaign) {
-				skip = true
-				break
+			if deploy.DeployedWithCampaign(kind) && strings.HasPrefix(resourcePath, campaign) {
+				resource := deploy.NewResource(kind, relPath, filepath.Join(repoDir, relPath), "")
+				resource.Campaign = filepath.Base(campaign)
+				return resource
 			}
 		}
-		if !skip {
-			if scriptTypeExists["connection"] {
-				transformedResource := transformResource("connection", repoDir, relPath, manifestFilePath)
-				cortex.DeployConnection(transformedResource)
-			} else {
-				cortex.DeployConnection(filepath.Join(repoDir, relPath))
-			}
+		if scriptTypeExists[kind] {
+			transformedResource, scriptPath := transformResource(kind, repoDir, workDir, relPath, manifestFilePath)
+			return deploy.NewResource(kind, relPath, transformedResource, scriptPath)
 		}
+		return deploy.NewResource(kind, relPath, filepath.Join(repoDir, relPath), "")
+	}
+
+	for _, typ := range manifest.Cortex.Type {
+		resources = append(resources, deploy.NewResource(deploy.KIND_TYPE, typ, filepath.Join(repoDir, parseManifestResourcePath(typ)), ""))
+	}
+	// connections, models, experiments, runs and agents may be deployed as part of campaigns
+	for _, connection := range manifest.Cortex.Connection {
+		resources = append(resources, newResource(deploy.KIND_CONNECTION, connection))
 	}
-	// deploy models, experiments and runs excluding those deployed as part of campaigns
 	for _, model := range manifest.Cortex.Model {
-		v6Client, ok := cortex.(*deploy.CortexClientV6)
-		if ok {
-			relPath := parseManifestResourcePath(model)
-			// skip models deployed in campaign deployment
-			skip := false
-			for _, campaign := range campaigns {
-				if strings.HasPrefix(model, campaign) {
-					skip = true
-					break
-				}
-			}
-			if !skip {
-				if scriptTypeExists["model"] {
-					transformedResource := transformResource("model", repoDir, relPath, manifestFilePath)
-					deploy.DeployModel(*v6Client, transformedResource)
-				} else {
-					deploy.DeployModel(*v6Client, filepath.Join(repoDir, relPath))
-				}
-			}
-		} else {
+		if !isV6 {
 			log.Fatalln("Model deployment support is for Cortex v6 onwards")
 		}
+		resources = append(resources, newResource(deploy.KIND_MODEL, model))
 	}
 	for _, experiment := range manifest.Cortex.Experiment {
-		v6Client, ok := cortex.(*deploy.CortexClientV6)
-		if ok {
-			relPath := parseManifestResourcePath(experiment)
-			// skip experiment deployed in campaign deployment
-			skip := false
-			for _, campaign := range campaigns {
-				if strings.HasPrefix(experiment, campaign) {
-					skip = true
-					break
-				}
-			}
-			if !skip {
-				if scriptTypeExists["experiment"] {
-					transformedResource := transformResource("experiment", repoDir, relPath, manifestFilePath)
-					deploy.DeployExperiment(*v6Client, transformedResource)
-				} else {
-					deploy.DeployExperiment(*v6Client, filepath.Join(repoDir, relPath))
-				}
-			}
-		} else {
+		if !isV6 {
 			log.Fatalln("Experiment deployment support is for Cortex v6 onwards")
 		}
+		resources = append(resources, newResource(deploy.KIND_EXPERIMENT, experiment))
 	}
 	for _, run := range manifest.Cortex.Run {
-		v6Client, ok := cortex.(*deploy.CortexClientV6)
-		if ok {
-			relPath := parseManifestResourcePath(run)
-			// skip run deployed in campaign deployment
-			skip := false
-			for _, campaign := range campaigns {
-				if strings.HasPrefix(run, campaign) {
-					skip = true
-					break
-				}
-			}
-			if !skip {
-				if scriptTypeExists["run"] {
-					transformedResource := transformResource("run", repoDir, relPath, manifestFilePath)
-					deploy.DeployExperimentRun(*v6Client, transformedResource, repoDir)
-				} else {
-					deploy.DeployExperimentRun(*v6Client, filepath.Join(repoDir, relPath), repoDir)
-				}
-			}
-		} else {
+		if !isV6 {
 			log.Fatalln("Run deployment support is for Cortex v6 onwards")
 		}
+		resources = append(resources, newResource(deploy.KIND_RUN, run))
 	}
 	for _, action := range manifest.Cortex.Action {
-		relPath := parseManifestResourcePath(action)
-		if scriptTypeExists["action"] {
-			transformedResource := transformResource("action", repoDir, relPath, manifestFilePath)
-			cortex.DeployAction(transformedResource)
-		} else {
-			cortex.DeployAction(filepath.Join(repoDir, relPath))
-		}
+		resources = append(resources, deploy.SubstituteResourceImage(newResource(deploy.KIND_ACTION, action), actionImageMapping))
 	}
 	for _, skill := range manifest.Cortex.Skill {
-		relPath := parseManifestResourcePath(skill)
-		if scriptTypeExists["skill"] {
-			transformedResource := transformResource("skill", repoDir, relPath, manifestFilePath)
-			cortex.DeploySkill(transformedResource)
-		} else {
-			cortex.DeploySkill(filepath.Join(repoDir, relPath))
-		}
+		resources = append(resources, newResource(deploy.KIND_SKILL, skill))
 	}
 	for _, agent := range manifest.Cortex.Agent {
-		relPath := parseManifestResourcePath(agent)
-		skip := false
-		for _, campaign := range campaigns {
-			if strings.HasPrefix(agent, campaign) {
-				skip = true
-				break
-			}
+		resources = append(resources, newResource(deploy.KIND_AGENT, agent))
+	}
+	// snapshots are deployed as its dependencies followed by the agent
+	for _, snapshot := range manifest.Cortex.Snapshots {
+		resources = append(resources, deploy.SnapshotResources(newResource(deploy.KIND_SNAPSHOT, snapshot), actionImageMapping)...)
+	}
+
+	graph := deploy.NewDependencyGraph(resources, manifest.Cortex.Dependencies)
+	if err := graph.LogMissing(); err != nil {
+		log.Fatalln(err)
+	}
+	sorted, err := graph.Sort()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return sorted
+}
+
+// substituteActionImages replaces docker images of actions in graph with images built in this run
+func substituteActionImages(graph *deploy.DependencyGraph, actionImageMapping map[string]string) {
+	for i, resource := range graph.Resources {
+		if resource.Kind == deploy.KIND_ACTION {
+			graph.Resources[i] = deploy.SubstituteResourceImage(resource, actionImageMapping)
 		}
-		if !skip {
-			if scriptTypeExists["agent"] {
-				transformedResource := transformResource("agent", repoDir, relPath, manifestFilePath)
-				cortex.DeployAgent(transformedResource)
-			} else {
-				cortex.DeployAgent(filepath.Join(repoDir, relPath))
-			}
+	}
+}
+
+// campaignDir returns directory of campaign (relative to repo) from path of campaign in manifest. Campaign is the directory with all its resources, at `<dir>/<campaign>`
+func campaignDir(relPath string) string {
+	campaignPathSplits := pathSep.Split(relPath, 3)
+	return filepath.Join(campaignPathSplits[0], campaignPathSplits[1])
+}
+
+// deployableResources excludes resources deployed as part of campaigns
+func deployableResources(resources []deploy.Resource) []deploy.Resource {
+	var deployable []deploy.Resource
+	for _, resource := range resources {
+		if resource.Campaign == "" {
+			deployable = append(deployable, resource)
 		}
 	}
-	for _, snapshot := range manifest.Cortex.Snapshots {
-		relPath := parseManifestResourcePath(snapshot)
-		if scriptTypeExists["snapshot"] {
-			transformedResource := transformResource("snapshot", repoDir, relPath, manifestFilePath)
-			deploy.DeploySnapshot(cortex, transformedResource, actionImageMapping)
-		} else {
-			deploy.DeploySnapshot(cortex, filepath.Join(repoDir, relPath), actionImageMapping)
+	return deployable
+}
+
+func deployResource(cortex deploy.CortexAPI, repoDir string, resource deploy.Resource) (*deploy.Response, error) {
+	if resource.Kind == deploy.KIND_CAMPAIGN {
+		//zip campaign
+		zipPath := zipDirectory(resource.Path)
+		defer os.Remove(zipPath)
+		return deploy.DeployCampaign(*cortex.(*deploy.CortexClientV6), zipPath, true, true)
+	}
+	return deploy.DeployResource(cortex, resource, repoDir)
+}
+
+// planCortexResources logs whether each resource will be created, updated or unchanged by deployment, without deploying
+func planCortexResources(cortex deploy.CortexAPI, resources []deploy.Resource) {
+	verdicts := map[string]int{}
+	for _, resource := range resources {
+		plan, err := deploy.PlanResource(cortex, resource)
+		if err != nil {
+			log.Fatalln("Failed to fetch ", resource.Kind, " ", resource.Name, " from Cortex. Error: ", err)
 		}
+		verdicts[plan.Verdict]++
+		log.Println(plan)
 	}
-	log.Println("Deployed all artifacts from manifest", manifestFilePath)
-	defer os.RemoveAll(filepath.Join(repoDir, "_tmp"))
+	log.Println("Plan:", verdicts[deploy.PLAN_CREATE], "to create,", verdicts[deploy.PLAN_UPDATE], "to update,", verdicts[deploy.PLAN_UNCHANGED], "unchanged")
 }
 
 func zipDirectory(basepath string) string {
@@ -420,15 +1024,20 @@ func parseManifestResourcePath(relativePath string) string {
 }
 
 func createCortexClientFromConfig() deploy.CortexAPI {
-	var url = strings.TrimSpace(strings.Trim(deploy.GetEnvVar("CORTEX_URL"), "/"))
-	var account = strings.TrimSpace(deploy.GetEnvVar("CORTEX_ACCOUNT"))
-	var user = strings.TrimSpace(deploy.GetEnvVar("CORTEX_USER"))
-	var password = strings.TrimSpace(deploy.GetEnvVar("CORTEX_PASSWORD"))
-	var token = strings.TrimSpace(deploy.GetEnvVar("CORTEX_TOKEN"))
+	return createCortexClient(config.Get)
+}
+
+// createCortexClient creates Cortex client from settings, which are looked up using `get`
+func createCortexClient(get func(key string) string) deploy.CortexAPI {
+	var url = strings.TrimSpace(strings.Trim(get(config.CORTEX_URL), "/"))
+	var account = strings.TrimSpace(get(config.CORTEX_ACCOUNT))
+	var user = strings.TrimSpace(get(config.CORTEX_USER))
+	var password = strings.TrimSpace(get(config.CORTEX_PASSWORD))
+	var token = strings.TrimSpace(get(config.CORTEX_TOKEN))
 	// V6
-	var pat = strings.TrimSpace(deploy.GetEnvVar("CORTEX_ACCESS_TOKEN_PATH"))
-	var patJson = strings.TrimSpace(deploy.GetEnvVar("CORTEX_ACCESS_TOKEN_VALUE"))
-	var project = strings.TrimSpace(deploy.GetEnvVar("CORTEX_PROJECT"))
+	var pat = strings.TrimSpace(get(config.CORTEX_ACCESS_TOKEN_PATH))
+	var patJson = strings.TrimSpace(get(config.CORTEX_ACCESS_TOKEN_VALUE))
+	var project = strings.TrimSpace(get(config.CORTEX_PROJECT))
 
 	var cortex deploy.CortexAPI
 	if pat != "" {
@@ -503,16 +1112,100 @@ func Execute(version string) {
 func init() {
 	cobra.OnInitialize(initConfig)
 	rootCmd.AddCommand(buildCmd, deployCmd, dockerLoginCmd, generateDocsCmd, extractSSLCertCmd)
+	dockerLoginCmd.Flags().Bool("password-stdin", false, "Read password (or token) from stdin")
+	dockerLoginCmd.Flags().String("password-file", "", "Read password (or token) from file")
 	rootCmd.Flags().StringP("manifest", "m", defaultManifestFile, "Relative path of Manifest file <fabric.yaml>")
 	deployCmd.Flags().StringP("manifest", "m", defaultManifestFile, "Relative path of Manifest file <fabric.yaml>")
+	rootCmd.Flags().Bool("dry-run", false, "Show resources to be created, updated or unchanged in Cortex without building images or deploying")
+	deployCmd.Flags().Bool("dry-run", false, "Show resources to be created, updated or unchanged in Cortex without deploying")
+	for _, command := range []*cobra.Command{rootCmd, deployCmd} {
+		command.Flags().Bool("pin-digest", false, "Reference images substituted in actions by digest (`<image>@sha256:..`) instead of tag, if digest is known. Digests are logged and recorded in report")
+	}
+	for _, command := range []*cobra.Command{rootCmd, deployCmd, promoteCmd} {
+		command.Flags().Bool("fail-fast", true, "Stop deploying on first failure")
+		command.Flags().Bool("keep-going", false, "Continue deploying remaining resources after a failure. Resources depending on failed resource are not deployed")
+		command.Flags().Int("concurrency", 1, "Number of independent resources deployed at the same time")
+		command.Flags().Bool("prune", false, "Delete resources in Cortex project not in manifest (or its snapshots and campaigns), of kinds listed in manifest. Asks for confirmation unless --yes")
+		command.Flags().BoolP("yes", "y", false, "Delete resources pruned with --prune without confirmation")
+		command.Flags().Bool("atomic", false, "Roll back deployed resources to their previous definitions (deleting new resources) if any resource fails to deploy")
+		command.Flags().String("report", "", "Write deployment report in format json or junit")
+		command.Flags().String("report-file", "", "Path of deployment report. Defaults to fabric-report.json (or fabric-report.xml for junit)")
+	}
+
+	for _, command := range []*cobra.Command{rootCmd, buildCmd} {
+		command.Flags().Bool("skip-existing", false, "Skip building and pushing image if image with same tag exists in registry, reusing its digest. Images tagged `latest` are always built")
+		command.Flags().Int("build-concurrency", 1, "Number of Docker images built and pushed at the same time. Output of each image is prefixed with its name")
+		command.Flags().Bool("allow-latest", false, "Allow tagging images `latest`, if repo isn't a git repo or tag format renders latest")
+		command.Flags().Bool("context-hash-tag", false, "Tag images with hash of build context (`ctx-<hash>`) instead of git version, so with --skip-existing unchanged actions aren't built again in later commits")
+		command.Flags().String("images-file", "", "Write images built (by image name, with digest) as JSON file, for `fabric deploy --images` in a later stage")
+	}
+	deployCmd.Flags().String("images", "", "JSON file of images written by `fabric build --images-file`. Images of actions (and actions in snapshots) are substituted with these, by image name")
+	deployCmd.Flags().Bool("resolve-images", false, "Substitute images of actions with newest images of Dockerfiles in repo in registry, having tag in tag format of current branch")
+	deployCmd.Flags().String("image-commit", "", "Substitute images of actions with images of Dockerfiles in repo tagged for git commit (hash, tag or like HEAD~1), failing if any doesn't exist in registry")
+
+	buildCmd.Flags().Bool("list", false, "List Dockerfiles found in repo, with image name and build context, without building")
+
+	rootCmd.PersistentFlags().String("env", "", "Named environment (like dev, stage, prod) in ~/"+config.USER_CONFIG_FILE+" or <RepoRootDir>/"+config.REPO_CONFIG_FILE+". Defaults to FABRIC_ENV env var or `default` in config file")
+	for flag, key := range settingFlags {
+		rootCmd.PersistentFlags().String(flag, "", "Overrides "+key+" env var and environment config")
+	}
+	rootCmd.PersistentFlags().String("builder", "", "Image builder: docker (default), podman, buildah or kaniko. Overrides FABRIC_BUILDER env var and environment config")
+	rootCmd.PersistentPreRun = loadConfig
+	rootCmd.PersistentFlags().Int("max-retries", 3, "Maximum retries of Cortex API calls failed with transient errors (429, 502, 503, 504 or network errors)")
+	rootCmd.PersistentFlags().Duration("retry-backoff", time.Second, "Initial wait before retrying Cortex API call, doubled (with jitter) on each retry. 0 retries without waiting")
+	rootCmd.PersistentFlags().Duration("retry-max-backoff", 30*time.Second, "Maximum wait before retrying Cortex API call, including wait requested by Retry-After header")
 
 	generateDocsCmd.Flags().StringP("format", "f", "md", "Documentation format. Defaults to markdown")
 	generateDocsCmd.Flags().StringP("out", "o", "doc", "Documentation output directory. Defaults to doc")
 }
 
+// command line flags overriding settings of environment, by setting
+var settingFlags = map[string]string{
+	"cortex-url":         config.CORTEX_URL,
+	"cortex-account":     config.CORTEX_ACCOUNT,
+	"cortex-project":     config.CORTEX_PROJECT,
+	"docker-registry":    config.DOCKER_PREGISTRY_URL,
+	"docker-prefix":      config.DOCKER_PREGISTRY_PREFIX,
+	"build-context":      config.DOCKER_BUILD_CONTEXT,
+	"tag-format":         config.DOCKER_IMAGE_TAG_FORMAT,
+	"dockerfile-include": config.DOCKERFILE_INCLUDE,
+	"dockerfile-exclude": config.DOCKERFILE_EXCLUDE,
+}
+
+// loadConfig loads environments from user config and config of repo (first argument of command, if it's a directory) and applies setting flags
+func loadConfig(cmd *cobra.Command, args []string) {
+	repoDir := ""
+	if len(args) > 0 {
+		if info, err := os.Stat(args[0]); err == nil && info.IsDir() {
+			repoDir = args[0]
+		}
+	}
+	env, _ := cmd.Flags().GetString("env")
+	if err := config.Load(repoDir, env); err != nil {
+		log.Fatalln(err)
+	}
+	if selected := config.Selected(); selected != "" {
+		log.Println("Using environment", selected)
+	}
+	for flag, key := range settingFlags {
+		value, _ := cmd.Flags().GetString(flag)
+		config.SetFlag(key, value)
+	}
+	builder, _ := cmd.Flags().GetString("builder")
+	config.SetFlag(config.FABRIC_BUILDER, builder)
+	if err := build.SetBuilder(config.Get(config.FABRIC_BUILDER)); err != nil {
+		log.Fatalln(err)
+	}
+}
+
 func initConfig() {
-	// DO NOTHING
 	//viper.AutomaticEnv()
+	maxRetries, _ := rootCmd.PersistentFlags().GetInt("max-retries")
+	retryBackoff, _ := rootCmd.PersistentFlags().GetDuration("retry-backoff")
+	retryMaxBackoff, _ := rootCmd.PersistentFlags().GetDuration("retry-max-backoff")
+	deploy.SetRetryPolicy(deploy.RetryPolicy{MaxRetries: maxRetries, InitialBackoff: retryBackoff, MaxBackoff: retryMaxBackoff})
+	// secret values resolved in deployment must never be logged
+	log.SetOutput(secret.RedactingWriter{Writer: os.Stderr})
 }
 
 var generateDocsCmd = &cobra.Command{
@@ -0,0 +1,146 @@
+package secret
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ghodss/yaml"
+	"github.com/tidwall/gjson"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnvProvider resolves `secret://env/NAME` from environment variable
+type EnvProvider struct{}
+
+func (EnvProvider) Get(path string, key string) (string, error) {
+	value, ok := os.LookupEnv(path)
+	if !ok {
+		return "", errors.New(fmt.Sprint("Environment variable ", path, " is not set"))
+	}
+	return value, nil
+}
+
+// FileProvider resolves `secret://file/<path>` from content of file (trailing newline removed) and `secret://file/<path>#key` from field of JSON or YAML file.
+// Relative paths are relative to working directory, absolute paths are like `secret://file//run/secrets/db.json#password`
+type FileProvider struct{}
+
+func (FileProvider) Get(path string, key string) (string, error) {
+	content, err := ioutil.ReadFile(filepath.FromSlash(path))
+	if err != nil {
+		return "", err
+	}
+	if key == "" {
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		if content, err = yaml.YAMLToJSON(content); err != nil {
+			return "", err
+		}
+	}
+	return field(content, key, "file "+path)
+}
+
+// VaultProvider resolves `secret://vault/<path>#key` using HashiCorp Vault HTTP API, reading `<Addr>/v1/<path>`. Both KV v1 and v2 (`secret/data/..` paths) secrets are supported.
+// Address, token and namespace default to VAULT_ADDR, VAULT_TOKEN (or ~/.vault-token) and VAULT_NAMESPACE env vars. Secrets are cached for the run
+type VaultProvider struct {
+	Addr      string
+	Token     string
+	Namespace string
+	cache     map[string][]byte
+	mutex     sync.Mutex
+}
+
+var vaultClient = &http.Client{Timeout: 30 * time.Second}
+
+func (v *VaultProvider) Get(path string, key string) (string, error) {
+	if key == "" {
+		return "", errors.New("key of Vault secret is required, like secret://vault/<path>#<key>")
+	}
+	content, err := v.read(path)
+	if err != nil {
+		return "", err
+	}
+	data := gjson.GetBytes(content, "data")
+	// KV v2 has secret in data.data along with metadata
+	if nested := data.Get("data"); nested.IsObject() && data.Get("metadata").Exists() {
+		data = nested
+	}
+	return field([]byte(data.Raw), key, "Vault secret "+path)
+}
+
+func (v *VaultProvider) read(path string) ([]byte, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if content, ok := v.cache[path]; ok {
+		return content, nil
+	}
+	addr := strings.TrimRight(firstNonEmpty(v.Addr, os.Getenv("VAULT_ADDR")), "/")
+	if addr == "" {
+		return nil, errors.New("Vault address is not configured, set VAULT_ADDR")
+	}
+	token := firstNonEmpty(v.Token, os.Getenv("VAULT_TOKEN"))
+	if token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			content, _ := ioutil.ReadFile(filepath.Join(home, ".vault-token"))
+			token = strings.TrimSpace(string(content))
+		}
+	}
+	req, err := http.NewRequest(http.MethodGet, addr+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := firstNonEmpty(v.Namespace, os.Getenv("VAULT_NAMESPACE")); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	res, err := vaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		// response body is not included, it may have secret values
+		return nil, errors.New(fmt.Sprint("Vault returned status ", res.StatusCode, " for ", path, ": ", strings.Join(vaultErrors(content), "; ")))
+	}
+	if v.cache == nil {
+		v.cache = map[string][]byte{}
+	}
+	v.cache[path] = content
+	return content, nil
+}
+
+func vaultErrors(content []byte) []string {
+	var response struct {
+		Errors []string `json:"errors"`
+	}
+	json.Unmarshal(content, &response)
+	return response.Errors
+}
+
+// field gets string value of key (a gjson path) from JSON content
+func field(content []byte, key string, source string) (string, error) {
+	value := gjson.GetBytes(content, key)
+	if !value.Exists() {
+		return "", errors.New(fmt.Sprint("Key ", key, " not found in ", source))
+	}
+	return value.String(), nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,174 @@
+package secret
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newVaultServer is a Vault stand-in serving KV v1 secret at kv/db and KV v2 secret at secret/data/db, for token `vt`
+func newVaultServer(t *testing.T, requests *int32) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		if r.Header.Get("X-Vault-Token") != "vt" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		if namespace := r.Header.Get("X-Vault-Namespace"); namespace != "" && namespace != "team" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["unknown namespace"]}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/kv/db":
+			w.Write([]byte(`{"data":{"password":"v1-pass","user":"admin"}}`))
+		case "/v1/secret/data/db":
+			w.Write([]byte(`{"data":{"data":{"password":"v2-pass","nested":{"key":"deep"}},"metadata":{"version":3}}}`))
+		case "/v1/secret/data/leaky":
+			// error responses must not be included in errors, they may have secret values
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"errors":["internal"],"data":{"password":"leaked"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestVaultProvider(t *testing.T) {
+	var requests int32
+	server := newVaultServer(t, &requests)
+	tests := []struct {
+		name      string
+		token     string
+		namespace string
+		path      string
+		key       string
+		want      string
+		wantErr   string
+	}{
+		{name: "KV v1", token: "vt", path: "kv/db", key: "password", want: "v1-pass"},
+		{name: "KV v1 other key", token: "vt", path: "kv/db", key: "user", want: "admin"},
+		{name: "KV v2", token: "vt", path: "secret/data/db", key: "password", want: "v2-pass"},
+		{name: "KV v2 nested key", token: "vt", path: "secret/data/db", key: "nested.key", want: "deep"},
+		{name: "KV v2 metadata is not secret", token: "vt", path: "secret/data/db", key: "version", wantErr: "Key version not found"},
+		{name: "namespace", token: "vt", namespace: "team", path: "kv/db", key: "password", want: "v1-pass"},
+		{name: "missing key", token: "vt", path: "kv/db", key: "missing", wantErr: "Key missing not found in Vault secret kv/db"},
+		{name: "key required", token: "vt", path: "kv/db", wantErr: "key of Vault secret is required"},
+		{name: "permission denied", token: "wrong", path: "kv/db", key: "password", wantErr: "status 403 for kv/db: permission denied"},
+		{name: "not found", token: "vt", path: "kv/none", key: "password", wantErr: "status 404"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := &VaultProvider{Addr: server.URL, Token: test.token, Namespace: test.namespace}
+			got, err := provider.Get(test.path, test.key)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Get(%s, %s) error = %v, want error containing %q", test.path, test.key, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Fatalf("Get(%s, %s) = %q, %v, want %q", test.path, test.key, got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestVaultProviderErrorHasNoSecret(t *testing.T) {
+	var requests int32
+	server := newVaultServer(t, &requests)
+	provider := &VaultProvider{Addr: server.URL, Token: "vt"}
+	_, err := provider.Get("secret/data/leaky", "password")
+	if err == nil || strings.Contains(err.Error(), "leaked") {
+		t.Fatalf("Get error = %v, want error without response body", err)
+	}
+}
+
+func TestVaultProviderCachesSecrets(t *testing.T) {
+	var requests int32
+	server := newVaultServer(t, &requests)
+	provider := &VaultProvider{Addr: server.URL, Token: "vt"}
+	for _, key := range []string{"password", "user", "password"} {
+		if _, err := provider.Get("kv/db", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("Vault requests = %d, want 1", requests)
+	}
+}
+
+func TestVaultProviderEnv(t *testing.T) {
+	var requests int32
+	server := newVaultServer(t, &requests)
+	t.Setenv("VAULT_ADDR", server.URL+"/")
+	t.Setenv("VAULT_TOKEN", "vt")
+	got, err := (&VaultProvider{}).Get("kv/db", "password")
+	if err != nil || got != "v1-pass" {
+		t.Fatalf("Get = %q, %v, want v1-pass", got, err)
+	}
+
+	t.Setenv("VAULT_ADDR", "")
+	if _, err := (&VaultProvider{}).Get("kv/db", "password"); err == nil || !strings.Contains(err.Error(), "VAULT_ADDR") {
+		t.Fatalf("Get error = %v, want error about VAULT_ADDR", err)
+	}
+}
+
+func TestEnvProvider(t *testing.T) {
+	t.Setenv("FABRIC_TEST_SECRET", "env-pass")
+	if got, err := (EnvProvider{}).Get("FABRIC_TEST_SECRET", ""); err != nil || got != "env-pass" {
+		t.Fatalf("Get = %q, %v, want env-pass", got, err)
+	}
+	os.Unsetenv("FABRIC_TEST_MISSING")
+	if _, err := (EnvProvider{}).Get("FABRIC_TEST_MISSING", ""); err == nil {
+		t.Fatal("Get of unset env var succeeded, want error")
+	}
+}
+
+func TestFileProvider(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"plain.txt": "file-pass\n",
+		"db.json":   `{"password":"json-pass","nested":{"key":"json-deep"}}`,
+		"db.yaml":   "password: yaml-pass\nnested:\n  key: yaml-deep\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		file    string
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{file: "plain.txt", want: "file-pass"},
+		{file: "db.json", key: "password", want: "json-pass"},
+		{file: "db.json", key: "nested.key", want: "json-deep"},
+		{file: "db.yaml", key: "password", want: "yaml-pass"},
+		{file: "db.yaml", key: "nested.key", want: "yaml-deep"},
+		{file: "db.json", key: "missing", wantErr: true},
+		{file: "missing.txt", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := (FileProvider{}).Get(filepath.ToSlash(filepath.Join(dir, test.file)), test.key)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("Get(%s, %s) = %q, want error", test.file, test.key, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("Get(%s, %s) = %q, %v, want %q", test.file, test.key, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package secret
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const REDACTED = "*****"
+
+var (
+	redacted      []string
+	redactedMutex sync.RWMutex
+)
+
+// AddRedacted registers secret value to be masked by Redact and RedactingWriter
+func AddRedacted(value string) {
+	if value == "" {
+		return
+	}
+	redactedMutex.Lock()
+	defer redactedMutex.Unlock()
+	for _, existing := range redacted {
+		if existing == value {
+			return
+		}
+	}
+	redacted = append(redacted, value)
+	// longer values first, so values containing other values are fully masked
+	sort.Slice(redacted, func(i, j int) bool { return len(redacted[i]) > len(redacted[j]) })
+}
+
+// Redact masks resolved secret values in text
+func Redact(text string) string {
+	redactedMutex.RLock()
+	defer redactedMutex.RUnlock()
+	for _, value := range redacted {
+		text = strings.ReplaceAll(text, value, REDACTED)
+	}
+	return text
+}
+
+// RedactingWriter masks resolved secret values written to the writer. Used for log output, which writes each line with a single Write
+type RedactingWriter struct {
+	Writer io.Writer
+}
+
+func (w RedactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.Writer, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,59 @@
+package secret
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestRedactingWriterMasksResolvedValues(t *testing.T) {
+	t.Setenv("FABRIC_TEST_LOGGED_SECRET", "logged-pass")
+	connection := `{"password":"secret://env/FABRIC_TEST_LOGGED_SECRET"}`
+	resolved, err := ResolveJson([]byte(connection))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	logger := log.New(RedactingWriter{Writer: &output}, "", 0)
+	logger.Println("Deploying connection", string(resolved))
+	logger.Printf("Failed with password logged-pass and again logged-pass")
+
+	logged := output.String()
+	if strings.Contains(logged, "logged-pass") {
+		t.Fatalf("resolved secret is logged: %s", logged)
+	}
+	if strings.Count(logged, REDACTED) != 3 {
+		t.Fatalf("logged %q, want 3 redacted values", logged)
+	}
+}
+
+func TestRedactMasksLongerValuesFirst(t *testing.T) {
+	AddRedacted("short-secret")
+	AddRedacted("short-secret-and-more")
+	got := Redact("a short-secret-and-more b short-secret c")
+	if want := "a " + REDACTED + " b " + REDACTED + " c"; got != want {
+		t.Fatalf("Redact = %q, want %q", got, want)
+	}
+}
+
+func TestRedactingWriterReturnsLengthWritten(t *testing.T) {
+	AddRedacted("length-secret")
+	var output bytes.Buffer
+	p := []byte("value length-secret\n")
+	n, err := RedactingWriter{Writer: &output}.Write(p)
+	if err != nil || n != len(p) {
+		t.Fatalf("Write = %d, %v, want %d", n, err, len(p))
+	}
+}
+
+func TestRedactMasksShortValues(t *testing.T) {
+	t.Setenv("FABRIC_TEST_SHORT_SECRET", "q7")
+	if _, err := Resolve("secret://env/FABRIC_TEST_SHORT_SECRET"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := Redact("pin q7 set"), "pin "+REDACTED+" set"; got != want {
+		t.Fatalf("Redact = %q, want %q", got, want)
+	}
+}
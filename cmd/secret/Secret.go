@@ -0,0 +1,110 @@
+package secret
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// PREFIX of secret references in resources, like `secret://vault/secret/data/db#password`, `secret://file/db.json#password` or `secret://env/DB_PASSWORD`
+const PREFIX = "secret://"
+
+// references can be part of a value, like `mongodb://secret://env/DB_USER@host`, so path and key end at characters used as separators in URIs
+var referenceRegex = regexp.MustCompile(`secret://([a-zA-Z0-9_-]+)/([^\s"'#@?&,;:]+)(?:#([^\s"'@?&,;:/]+))?`)
+
+// Provider fetches secret value from a secret store. `key` is empty if reference has no `#key`
+type Provider interface {
+	Get(path string, key string) (string, error)
+}
+
+var (
+	providers = map[string]Provider{
+		"env":   EnvProvider{},
+		"file":  FileProvider{},
+		"vault": &VaultProvider{},
+	}
+	providersMutex sync.RWMutex
+)
+
+// Register adds provider for references `secret://<name>/..`, replacing existing provider of the name
+func Register(name string, provider Provider) {
+	providersMutex.Lock()
+	defer providersMutex.Unlock()
+	providers[name] = provider
+}
+
+// IsReference checks whether value has any secret reference
+func IsReference(value string) bool {
+	return strings.Contains(value, PREFIX) && referenceRegex.MatchString(value)
+}
+
+// ResolveJson replaces secret references in string values of JSON content with secret values. Resolved values are registered for redaction from logs.
+// Content without references is returned as is
+func ResolveJson(content []byte) ([]byte, error) {
+	if !strings.Contains(string(content), PREFIX) {
+		return content, nil
+	}
+	var value interface{}
+	if err := json.Unmarshal(content, &value); err != nil {
+		return nil, err
+	}
+	resolved, err := resolveValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(resolved)
+}
+
+func resolveValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			resolved, err := resolveValue(field)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = resolved
+		}
+	case []interface{}:
+		for i, item := range v {
+			resolved, err := resolveValue(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = resolved
+		}
+	case string:
+		return Resolve(v)
+	}
+	return value, nil
+}
+
+// Resolve replaces all secret references in value with secret values
+func Resolve(value string) (string, error) {
+	var resolveErr error
+	resolved := referenceRegex.ReplaceAllStringFunc(value, func(reference string) string {
+		if resolveErr != nil {
+			return reference
+		}
+		match := referenceRegex.FindStringSubmatch(reference)
+		providersMutex.RLock()
+		provider, ok := providers[match[1]]
+		providersMutex.RUnlock()
+		if !ok {
+			resolveErr = errors.New(fmt.Sprint("Secret provider ", match[1], " of ", reference, " is not supported"))
+			return reference
+		}
+		secret, err := provider.Get(match[2], match[3])
+		if err != nil {
+			// error must not have secret value, so only reference is included
+			resolveErr = fmt.Errorf("failed to resolve %s: %w", reference, err)
+			return reference
+		}
+		AddRedacted(secret)
+		return secret
+	})
+	return resolved, resolveErr
+}
@@ -59,6 +59,18 @@ export_agents() {
 	export_snapshots "${snapshot_ids}"
 }
 
+# Same as export_agents using `fabric` (Cortex v6), without `cortex-cli`. Snapshots are exported to `.fabric/snapshots` and added to `fabric.yaml` in given repo directory
+fabric_export_agents() {
+	repo_dir=$1
+	shift
+	agent_flags=""
+	for agent in "$@"
+	do
+		agent_flags="${agent_flags} --agent ${agent}"
+	done
+	fabric export ${agent_flags} "${repo_dir}"
+}
+
 ## Usage examples. Authoring and deployment are two separate phase in development lifecycle.
 # Authoring generates artifacts for deployment & done on developer machine (using cortex-cli) and deployment on CI/CD server (using fabric)
 
@@ -86,10 +98,11 @@ function buildDeploy() {
     fabric $1
 }
 
+# password is read from DOCKER_REGISTRY_PASSWORD on stdin, so it isn't exposed in process list
 function dockerLogin() {
-    fabric dockerAuth $1 $2 $3
+    echo "$DOCKER_REGISTRY_PASSWORD" | fabric dockerAuth $1 $2 --password-stdin
 }
 
-dockerLogin $DOCKER_PREGISTRY_URL <Docker Registry User> <Docker Registry Password> # required once on host to push Docker images
+dockerLogin $DOCKER_PREGISTRY_URL <Docker Registry User> # required once on host to push Docker images, with DOCKER_REGISTRY_PASSWORD set to Docker Registry Password
 
 buildDeploy "<Git repo checkout with exported snapshots (`.fabric` directory with Cortex assets and `fabric.yaml` manifest file for driving deployment>"